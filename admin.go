@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// adminCookie keeps the admin token in the browser of staff signed in as
+// admin.
+const adminCookie = "bloodbank_admin"
+
+type AdminData struct {
+	RolesEnabled bool
+	Admin        bool
+	Backups      []Backup
+	BackupConfig backupConfig
+	Report       *IntegrityReport
+	Message      string
+}
+
+// adminToken is the token that makes a request an admin's, from
+// BLOODBANK_ADMIN_TOKEN. When it is empty there are no roles.
+func adminToken() string {
+	return os.Getenv("BLOODBANK_ADMIN_TOKEN")
+}
+
+// isAdmin reports whether a request comes from an admin: one carrying the
+// admin token as a bearer token or in the admin cookie. Every request is an
+// admin's when no token is set.
+func isAdmin(r *http.Request) bool {
+	token := adminToken()
+	if token == "" {
+		return true
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if c, err := r.Cookie(adminCookie); err == nil && given == "" {
+		given = c.Value
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func registerAdminRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB, backups backupConfig) {
+	mux.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		renderAdmin(w, tmpl, r, backups, nil, "")
+	})
+
+	mux.HandleFunc("/admin/backup", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isAdmin(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if _, err := backupDB(db, backups); err != nil {
+			log.Println("backup error:", err)
+			renderAdmin(w, tmpl, r, backups, nil, "Could not back up the database.")
+			return
+		}
+		http.Redirect(w, r, "/admin", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/admin/check", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isAdmin(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		report, err := checkIntegrity(db)
+		if err != nil {
+			renderAdmin(w, tmpl, r, backups, nil, "Could not check the database.")
+			return
+		}
+		renderAdmin(w, tmpl, r, backups, &report, "")
+	})
+
+	mux.HandleFunc("/admin/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := r.FormValue("token")
+		if adminToken() == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken())) != 1 {
+			renderAdmin(w, tmpl, r, backups, nil, "That is not the admin token.")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: adminCookie, Value: token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		http.Redirect(w, r, "/admin", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/admin/logout", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: adminCookie, Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		http.Redirect(w, r, "/admin", http.StatusSeeOther)
+	})
+}
+
+func renderAdmin(w http.ResponseWriter, tmpl *template.Template, r *http.Request, backups backupConfig, report *IntegrityReport, msg string) {
+	data := AdminData{RolesEnabled: adminToken() != "", Admin: isAdmin(r), BackupConfig: backups, Report: report, Message: msg}
+	if data.Admin {
+		var err error
+		if data.Backups, err = listBackups(backups.Dir); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	renderPage(w, tmpl, "admin.html", data)
+}
+
+// Masked hides a donor's phone, email and date of birth.
+func (d Donor) Masked() Donor {
+	d.Phone, d.Email, d.DateOfBirth = maskPhone(d.Phone), maskEmail(d.Email), maskDate(d.DateOfBirth)
+	return d
+}
+
+// Masked hides a recipient's phone.
+func (r Recipient) Masked() Recipient {
+	r.Phone = maskPhone(r.Phone)
+	return r
+}
+
+// maskFor masks records in place unless the request is an admin's.
+func maskFor[T interface{ Masked() T }](r *http.Request, items []T) {
+	if isAdmin(r) {
+		return
+	}
+	for i := range items {
+		items[i] = items[i].Masked()
+	}
+}
+
+// unmaskDonorInput puts back the stored values of fields a non-admin sent
+// unchanged from the masked edit form, or left empty, so saving does not
+// overwrite them. A browser sends a masked date of birth as empty.
+func unmaskDonorInput(stored Donor, in *DonorInput) {
+	if in.Phone == "" || in.Phone == maskPhone(stored.Phone) {
+		in.Phone = stored.Phone
+	}
+	if in.Email == "" || in.Email == maskEmail(stored.Email) {
+		in.Email = stored.Email
+	}
+	if in.DateOfBirth == "" || in.DateOfBirth == maskDate(stored.DateOfBirth) {
+		in.DateOfBirth = stored.DateOfBirth
+	}
+}
+
+// unmaskRecipientInput is unmaskDonorInput for a recipient's phone.
+func unmaskRecipientInput(stored Recipient, in *RecipientInput) {
+	if in.Phone == "" || in.Phone == maskPhone(stored.Phone) {
+		in.Phone = stored.Phone
+	}
+}
+
+// maskPhone keeps the last three digits.
+func maskPhone(value string) string {
+	if len(value) <= 3 {
+		return strings.Repeat("*", len(value))
+	}
+	return strings.Repeat("*", len(value)-3) + value[len(value)-3:]
+}
+
+// maskEmail keeps the first letter and the domain.
+func maskEmail(value string) string {
+	local, domain, ok := strings.Cut(value, "@")
+	if !ok || local == "" {
+		return maskPhone(value)
+	}
+	return local[:1] + "***@" + domain
+}
+
+// maskDate keeps the year.
+func maskDate(value string) string {
+	if len(value) < 4 {
+		return value
+	}
+	return value[:4]
+}
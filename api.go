@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// registerAPIRoutes exposes the lists as JSON and accepts new records. GET
+// takes the same query parameters as the list pages; POST takes a JSON body
+// checked by the same validators as the HTML forms.
+func registerAPIRoutes(mux *http.ServeMux, db *sql.DB) {
+	mux.HandleFunc("/api/donors", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			page, err := loadDonorPage(db, parseListFilter(r.URL.Query()))
+			maskFor(r, page.Items)
+			writePage(w, page, err)
+		case http.MethodPost:
+			var in DonorInput
+			if !decodeJSON(w, r, &in) {
+				return
+			}
+			if errs := in.Validate(); len(errs) > 0 {
+				writeFieldErrors(w, errs)
+				return
+			}
+			if !in.AllowDuplicate {
+				duplicates, err := findDuplicateDonors(db, in, 0)
+				if err != nil {
+					writeJSONError(w, http.StatusInternalServerError, "server error")
+					return
+				}
+				if len(duplicates) > 0 {
+					maskFor(r, duplicates)
+					writeJSON(w, http.StatusConflict, map[string]any{"error": "possible duplicate donor", "duplicates": duplicates})
+					return
+				}
+			}
+			id, err := createDonor(db, in)
+			writeCreated(w, id, err)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+
+	mux.HandleFunc("/api/recipients", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			page, err := loadRecipientPage(db, parseListFilter(r.URL.Query()))
+			maskFor(r, page.Items)
+			writePage(w, page, err)
+		case http.MethodPost:
+			var in RecipientInput
+			if !decodeJSON(w, r, &in) {
+				return
+			}
+			if errs := in.Validate(); len(errs) > 0 {
+				writeFieldErrors(w, errs)
+				return
+			}
+			id, err := createRecipient(db, in)
+			writeCreated(w, id, err)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+
+	mux.HandleFunc("/api/donations", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			page, err := loadDonationPage(db, parseListFilter(r.URL.Query()))
+			writePage(w, page, err)
+		case http.MethodPost:
+			var in DonationInput
+			if !decodeJSON(w, r, &in) {
+				return
+			}
+			errs, err := in.Validate(db)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, "server error")
+				return
+			}
+			if len(errs) > 0 {
+				writeFieldErrors(w, errs)
+				return
+			}
+			id, err := createDonation(db, in)
+			writeCreated(w, id, err)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+
+	mux.HandleFunc("/api/requests", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			page, err := loadRequestPage(db, parseListFilter(r.URL.Query()))
+			writePage(w, page, err)
+		case http.MethodPost:
+			var in RequestInput
+			if !decodeJSON(w, r, &in) {
+				return
+			}
+			errs, err := in.Validate(db)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, "server error")
+				return
+			}
+			if len(errs) > 0 {
+				writeFieldErrors(w, errs)
+				return
+			}
+			id, err := createRequest(db, in)
+			writeCreated(w, id, err)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+}
+
+func writePage[T any](w http.ResponseWriter, page Page[T], err error) {
+	if errors.Is(err, errInvalidCursor) {
+		writeJSONError(w, http.StatusBadRequest, "invalid page cursor")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "server error")
+		return
+	}
+	if page.Items == nil {
+		page.Items = []T{}
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// decodeJSON reads a request body into v, writing a 400 and reporting false
+// if it is not valid JSON of the expected shape.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return false
+	}
+	return true
+}
+
+func writeCreated(w http.ResponseWriter, id int, err error) {
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "server error")
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]int{"id": id})
+}
+
+// writeFieldErrors reports validation failures keyed by field name, the
+// same names the HTML forms use.
+func writeFieldErrors(w http.ResponseWriter, errs FieldErrors) {
+	writeJSON(w, http.StatusUnprocessableEntity, map[string]any{"error": "validation failed", "fields": errs})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("json error:", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// clockLayout is the HH:MM form of appointment slot times.
+const clockLayout = "15:04"
+
+// minDonationIntervalDays is how long a donor must wait after giving blood
+// before they can be booked to give again.
+const minDonationIntervalDays = 90
+
+// Appointment statuses. An appointment holds a place in its slot unless it
+// was cancelled or the donor did not turn up.
+const (
+	appointmentBooked    = "Booked"
+	appointmentCheckedIn = "Checked in"
+	appointmentDonated   = "Donated"
+	appointmentNoShow    = "No-show"
+	appointmentCancelled = "Cancelled"
+)
+
+// Slot is one appointment time at a site, with the appointments booked in it.
+type Slot struct {
+	ID           int           `json:"id"`
+	Site         string        `json:"site"`
+	SlotDate     string        `json:"slot_date"`
+	StartTime    string        `json:"start_time"`
+	EndTime      string        `json:"end_time"`
+	Capacity     int           `json:"capacity"`
+	Booked       int           `json:"booked"`
+	Appointments []Appointment `json:"appointments"`
+}
+
+func (s Slot) Free() int {
+	return max(s.Capacity-s.Booked, 0)
+}
+
+type Appointment struct {
+	ID          int    `json:"id"`
+	SlotID      int    `json:"slot_id"`
+	Site        string `json:"site"`
+	SlotDate    string `json:"slot_date"`
+	StartTime   string `json:"start_time"`
+	DonorID     int    `json:"donor_id"`
+	DonorName   string `json:"donor_name"`
+	DonorNumber string `json:"donor_number"`
+	BloodType   string `json:"blood_type"`
+	Phone       string `json:"phone"`
+	Status      string `json:"status"`
+	BookedAt    string `json:"booked_at"`
+	RemindedAt  string `json:"reminded_at"`
+	CheckedInAt string `json:"checked_in_at"`
+	DonationID  int    `json:"donation_id"`
+}
+
+type AppointmentsData struct {
+	Date       string
+	Site       string
+	Sites      []string
+	Slots      []Slot
+	Donors     []Donor
+	DonorQuery string
+	SlotForm   Form
+	BookForm   Form
+	Message    string
+}
+
+type RemindersData struct {
+	Date         string
+	Appointments []Appointment
+	Message      string
+}
+
+// appointmentColumns selects an appointment joined to its slot and donor.
+const appointmentColumns = `
+	SELECT a.id, a.slot_id, s.site, s.slot_date, s.start_time, a.donor_id, d.name, COALESCE(d.donor_number, ''),
+		bt.type, d.phone, a.status, a.booked_at, COALESCE(a.reminded_at, ''), COALESCE(a.checked_in_at, ''),
+		COALESCE(a.donation_id, 0)
+	FROM appointments a
+	JOIN appointment_slots s ON s.id = a.slot_id
+	JOIN donors d ON d.id = a.donor_id
+	JOIN blood_types bt ON bt.id = d.blood_type_id
+`
+
+func registerAppointmentRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/appointments", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			renderAppointments(w, tmpl, db, r.URL.Query(), Form{}, Form{}, "")
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		in, form := appointmentForm(r)
+		day := dayValues(r)
+		errs, err := in.Validate(db)
+		if err != nil {
+			renderAppointments(w, tmpl, db, day, Form{}, form, "Could not book appointment.")
+			return
+		}
+		form.Merge(errs)
+		if !form.Valid() {
+			renderAppointments(w, tmpl, db, day, Form{}, form, "Please correct the highlighted fields.")
+			return
+		}
+		full, err := bookAppointment(db, in)
+		if err != nil {
+			renderAppointments(w, tmpl, db, day, Form{}, form, "Could not book appointment.")
+			return
+		}
+		if full {
+			form.Errors.add("slot_id", "This slot is full.")
+			renderAppointments(w, tmpl, db, day, Form{}, form, "Please correct the highlighted fields.")
+			return
+		}
+		http.Redirect(w, r, "/appointments?"+day.Encode(), http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/appointments/slots", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		in, form := slotForm(r)
+		day := url.Values{"date": {in.SlotDate}, "site": {in.Site}}
+		form.Merge(in.Validate())
+		if !form.Valid() {
+			renderAppointments(w, tmpl, db, day, form, Form{}, "Please correct the highlighted fields.")
+			return
+		}
+		if err := createSlots(db, in); err != nil {
+			renderAppointments(w, tmpl, db, day, form, Form{}, "Could not add slots.")
+			return
+		}
+		http.Redirect(w, r, "/appointments?"+day.Encode(), http.StatusSeeOther)
+	})
+
+	// Check-in, no-show and cancellation all move an appointment on from
+	// Booked; a checked-in donor can still be marked as having left.
+	mux.HandleFunc("/appointments/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		day := dayValues(r)
+		problem, err := setAppointmentStatus(db, id, r.FormValue("status"))
+		if err != nil {
+			renderAppointments(w, tmpl, db, day, Form{}, Form{}, "Could not update appointment.")
+			return
+		}
+		if problem != "" {
+			renderAppointments(w, tmpl, db, day, Form{}, Form{}, problem)
+			return
+		}
+		http.Redirect(w, r, "/appointments?"+day.Encode(), http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/appointments/noshows", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		day := dayValues(r)
+		n, err := markNoShows(db, todayDate())
+		if err != nil {
+			renderAppointments(w, tmpl, db, day, Form{}, Form{}, "Could not mark no-shows.")
+			return
+		}
+		renderAppointments(w, tmpl, db, day, Form{}, Form{}, fmt.Sprintf("Marked %d past appointments as no-shows.", n))
+	})
+
+	mux.HandleFunc("/appointments/reminders", func(w http.ResponseWriter, r *http.Request) {
+		date := validDate(r.FormValue("date"))
+		if date == "" {
+			date = time.Now().AddDate(0, 0, 1).Format(dateLayout)
+		}
+		if r.Method == http.MethodGet {
+			renderReminders(w, tmpl, r, db, date, "")
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		n, err := sendReminders(db, date)
+		if err != nil {
+			renderReminders(w, tmpl, r, db, date, "Could not send reminders.")
+			return
+		}
+		renderReminders(w, tmpl, r, db, date, fmt.Sprintf("Queued reminders for %d appointments.", n))
+	})
+}
+
+// dayValues keeps the day and site being viewed across a form post.
+func dayValues(r *http.Request) url.Values {
+	return url.Values{"date": {r.FormValue("date")}, "site": {r.FormValue("site")}}
+}
+
+func renderAppointments(w http.ResponseWriter, tmpl *template.Template, db *sql.DB, values url.Values, slotForm Form, bookForm Form, msg string) {
+	date := validDate(values.Get("date"))
+	if date == "" {
+		date = todayDate()
+	}
+	site := values.Get("site")
+	data := AppointmentsData{Date: date, Site: site, SlotForm: slotForm, BookForm: bookForm, Message: msg}
+	if slotForm.Values == nil {
+		data.SlotForm = newForm(map[string]string{
+			"site": site, "slot_date": date, "start_time": "09:00", "end_time": "17:00",
+			"slot_minutes": "30", "capacity": "4",
+		})
+	}
+	if bookForm.Values == nil {
+		data.BookForm = newForm(map[string]string{"donor_id": values.Get("donor_id")})
+	}
+	var err error
+	if data.Sites, err = loadSites(db); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if data.Slots, err = loadSlots(db, date, site); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	data.DonorQuery = values.Get("donor_q")
+	donorID, _ := strconv.Atoi(data.BookForm.Get("donor_id"))
+	if data.Donors, err = pickDonors(db, donorID, data.DonorQuery); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	renderPage(w, tmpl, "appointments.html", data)
+}
+
+func renderReminders(w http.ResponseWriter, tmpl *template.Template, r *http.Request, db *sql.DB, date string, msg string) {
+	appointments, err := loadAppointments(db, "s.slot_date = ? AND a.status = ?", date, appointmentBooked)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !isAdmin(r) {
+		for i := range appointments {
+			appointments[i].Phone = maskPhone(appointments[i].Phone)
+		}
+	}
+	renderPage(w, tmpl, "reminders.html", RemindersData{Date: date, Appointments: appointments, Message: msg})
+}
+
+// loadSites lists the sites that have had appointment slots.
+func loadSites(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT DISTINCT site FROM appointment_slots ORDER BY site")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sites []string
+	for rows.Next() {
+		var site string
+		if err := rows.Scan(&site); err != nil {
+			return nil, err
+		}
+		sites = append(sites, site)
+	}
+	return sites, rows.Err()
+}
+
+// loadSlots returns a day's slots, at one site or all of them, with their
+// appointments.
+func loadSlots(db *sql.DB, date string, site string) ([]Slot, error) {
+	rows, err := db.Query(`
+		SELECT s.id, s.site, s.slot_date, s.start_time, s.end_time, s.capacity,
+			(SELECT COUNT(*) FROM appointments a WHERE a.slot_id = s.id AND a.status IN (?, ?, ?))
+		FROM appointment_slots s
+		WHERE s.slot_date = ? AND (? = '' OR s.site = ?)
+		ORDER BY s.start_time, s.site
+	`, appointmentBooked, appointmentCheckedIn, appointmentDonated, date, site, site)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var slots []Slot
+	index := map[int]int{}
+	for rows.Next() {
+		var s Slot
+		if err := rows.Scan(&s.ID, &s.Site, &s.SlotDate, &s.StartTime, &s.EndTime, &s.Capacity, &s.Booked); err != nil {
+			return nil, err
+		}
+		index[s.ID] = len(slots)
+		slots = append(slots, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	appointments, err := loadAppointments(db, "s.slot_date = ? AND (? = '' OR s.site = ?)", date, site, site)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range appointments {
+		if i, ok := index[a.SlotID]; ok {
+			slots[i].Appointments = append(slots[i].Appointments, a)
+		}
+	}
+	return slots, nil
+}
+
+func loadAppointments(db *sql.DB, where string, args ...any) ([]Appointment, error) {
+	rows, err := db.Query(appointmentColumns+" WHERE "+where+" ORDER BY s.slot_date, s.start_time, a.id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var appointments []Appointment
+	for rows.Next() {
+		var a Appointment
+		if err := rows.Scan(&a.ID, &a.SlotID, &a.Site, &a.SlotDate, &a.StartTime, &a.DonorID, &a.DonorName, &a.DonorNumber,
+			&a.BloodType, &a.Phone, &a.Status, &a.BookedAt, &a.RemindedAt, &a.CheckedInAt, &a.DonationID); err != nil {
+			return nil, err
+		}
+		appointments = append(appointments, a)
+	}
+	return appointments, rows.Err()
+}
+
+func loadAppointment(db *sql.DB, id int) (Appointment, error) {
+	appointments, err := loadAppointments(db, "a.id = ?", id)
+	if err != nil {
+		return Appointment{}, err
+	}
+	if len(appointments) == 0 {
+		return Appointment{}, sql.ErrNoRows
+	}
+	return appointments[0], nil
+}
+
+// createSlots cuts a day's opening hours into slots. Slots that already
+// exist at the site keep their capacity and bookings.
+func createSlots(db *sql.DB, in SlotInput) error {
+	start, _ := time.Parse(clockLayout, in.StartTime)
+	end, _ := time.Parse(clockLayout, in.EndTime)
+	step := time.Duration(in.SlotMinutes) * time.Minute
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for t := start; !t.Add(step).After(end); t = t.Add(step) {
+		if _, err := tx.Exec(
+			"INSERT OR IGNORE INTO appointment_slots (site, slot_date, start_time, end_time, capacity) VALUES (?, ?, ?, ?, ?)",
+			in.Site, in.SlotDate, t.Format(clockLayout), t.Add(step).Format(clockLayout), in.Capacity,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// bookAppointment books the donor into the slot, reporting full if the last
+// place was taken since the booking was validated.
+func bookAppointment(db *sql.DB, in AppointmentInput) (bool, error) {
+	res, err := db.Exec(`
+		INSERT INTO appointments (slot_id, donor_id, status, booked_at)
+		SELECT s.id, ?, ?, ?
+		FROM appointment_slots s
+		WHERE s.id = ?
+			AND (SELECT COUNT(*) FROM appointments a WHERE a.slot_id = s.id AND a.status IN (?, ?, ?)) < s.capacity
+	`, in.DonorID, appointmentBooked, nowTimestamp(), in.SlotID, appointmentBooked, appointmentCheckedIn, appointmentDonated)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 0, err
+}
+
+// setAppointmentStatus checks a donor in, or marks them as a no-show or
+// cancelled. A non-empty problem explains why the change was refused.
+func setAppointmentStatus(db *sql.DB, id int, status string) (string, error) {
+	var current, slotDate string
+	err := db.QueryRow(`
+		SELECT a.status, s.slot_date FROM appointments a JOIN appointment_slots s ON s.id = a.slot_id WHERE a.id = ?
+	`, id).Scan(&current, &slotDate)
+	if err == sql.ErrNoRows {
+		return "Appointment not found.", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch status {
+	case appointmentCheckedIn:
+		if current != appointmentBooked {
+			return "Only booked appointments can be checked in.", nil
+		}
+		if slotDate != todayDate() {
+			return "Donors can only be checked in on the day of their appointment.", nil
+		}
+		_, err = db.Exec("UPDATE appointments SET status = ?, checked_in_at = ? WHERE id = ?", status, nowTimestamp(), id)
+	case appointmentNoShow:
+		if current != appointmentBooked && current != appointmentCheckedIn {
+			return "Only booked or checked-in appointments can be marked as no-shows.", nil
+		}
+		if slotDate > todayDate() {
+			return "An appointment cannot be a no-show before its day.", nil
+		}
+		_, err = db.Exec("UPDATE appointments SET status = ? WHERE id = ?", status, id)
+	case appointmentCancelled:
+		if current != appointmentBooked {
+			return "Only booked appointments can be cancelled.", nil
+		}
+		_, err = db.Exec("UPDATE appointments SET status = ? WHERE id = ?", status, id)
+	default:
+		return "Unknown appointment status.", nil
+	}
+	return "", err
+}
+
+// markNoShows marks appointments from days before today that were never
+// checked in as no-shows.
+func markNoShows(db *sql.DB, today string) (int64, error) {
+	res, err := db.Exec(`
+		UPDATE appointments SET status = ?
+		WHERE status = ? AND slot_id IN (SELECT id FROM appointment_slots WHERE slot_date < ?)
+	`, appointmentNoShow, appointmentBooked, today)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// sendReminders queues a reminder to each donor booked on the given day who
+// has not been reminded yet, and records that they were.
+func sendReminders(db *sql.DB, date string) (int, error) {
+	appointments, err := loadAppointments(db, "s.slot_date = ? AND a.status = ? AND a.reminded_at IS NULL", date, appointmentBooked)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := nowTimestamp()
+	for _, a := range appointments {
+		key := fmt.Sprintf("appointment_reminder:%d", a.ID)
+		data := map[string]any{"Site": a.Site, "Date": a.SlotDate, "Time": a.StartTime}
+		if err := notifyDonor(tx, a.DonorID, "appointment_reminder", key, data); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE appointments SET reminded_at = ? WHERE id = ?", now, a.ID); err != nil {
+			return 0, err
+		}
+	}
+	return len(appointments), tx.Commit()
+}
+
+// nextEligibleDate is the first day a donor may give blood again after
+// their last donation, or empty if they have never given.
+func nextEligibleDate(db querier, donorID int) (string, error) {
+	var last sql.NullString
+	err := db.QueryRow("SELECT MAX(donation_date) FROM donations WHERE donor_id = ? AND deleted_at IS NULL", donorID).Scan(&last)
+	if err != nil || !last.Valid {
+		return "", err
+	}
+	t, err := parseDate(last.String)
+	if err != nil {
+		return "", err
+	}
+	return t.AddDate(0, 0, minDonationIntervalDays).Format(dateLayout), nil
+}
+
+// donorEligibility explains why a donor may not give blood on the given day,
+// or returns an empty string if they may.
+func donorEligibility(db querier, donorID int, date string) (string, error) {
+	deferral, err := activeDeferral(db, donorID, date)
+	if err != nil {
+		return "", err
+	}
+	if deferral != nil {
+		return "Donor is deferred " + deferral.Period() + ": " + deferral.Reason + ".", nil
+	}
+	next, err := nextEligibleDate(db, donorID)
+	if err != nil {
+		return "", err
+	}
+	if next != "" && date < next {
+		return "Donor gave blood too recently and can donate again from " + next + ".", nil
+	}
+	return "", nil
+}
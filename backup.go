@@ -0,0 +1,495 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// dbFile is the database the server and commands open.
+	dbFile = "bloodbank.db"
+	// dbPragmas are set on every connection.
+	dbPragmas = "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)"
+	// backupLayout names backup files by when they were taken, to the
+	// millisecond so that a scheduled and a manual backup never share a
+	// name, and so they sort oldest first. Parsing it also reads names
+	// without milliseconds, from older backups.
+	backupLayout = "20060102-150405"
+	// maxIntegrityDetails caps how many problems one check lists.
+	maxIntegrityDetails = 20
+)
+
+// requiredTables must exist in a database before it can be restored.
+var requiredTables = []string{"blood_types", "donors", "recipients", "donations", "inventory", "requests"}
+
+// backupConfig says where backups go, how often they are taken and how many
+// are kept. It is read from BLOODBANK_BACKUP_DIR (default backups),
+// BLOODBANK_BACKUP_HOURS (default 24; 0 turns scheduled backups off) and
+// BLOODBANK_BACKUP_KEEP (default 7).
+type backupConfig struct {
+	Dir      string
+	Interval time.Duration
+	Keep     int
+}
+
+// Backup is one backup file.
+type Backup struct {
+	Name    string
+	Size    int64
+	TakenAt time.Time
+}
+
+// IntegrityProblem is one problem an integrity check found.
+type IntegrityProblem struct {
+	Check  string
+	Detail string
+}
+
+// IntegrityReport is the outcome of checking a database: SQLite's own
+// integrity and foreign key checks, and whether inventory agrees with the
+// units left in donations and with the donation ledger.
+type IntegrityReport struct {
+	CheckedAt string
+	Problems  []IntegrityProblem
+}
+
+func (r IntegrityReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func backupConfigFromEnv() backupConfig {
+	cfg := backupConfig{Dir: os.Getenv("BLOODBANK_BACKUP_DIR"), Interval: 24 * time.Hour, Keep: 7}
+	if cfg.Dir == "" {
+		cfg.Dir = "backups"
+	}
+	if hours, err := strconv.Atoi(os.Getenv("BLOODBANK_BACKUP_HOURS")); err == nil && hours >= 0 {
+		cfg.Interval = time.Duration(hours) * time.Hour
+	}
+	if keep, err := strconv.Atoi(os.Getenv("BLOODBANK_BACKUP_KEEP")); err == nil && keep > 0 {
+		cfg.Keep = keep
+	}
+	return cfg
+}
+
+// backupDB copies the live database into the backup directory with VACUUM
+// INTO, which gives a consistent copy while the server keeps running, then
+// removes the oldest backups beyond the number to keep.
+func backupDB(db *sql.DB, cfg backupConfig) (Backup, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return Backup{}, err
+	}
+	now := time.Now()
+	name := "bloodbank-" + now.Format(backupLayout+".000") + ".db"
+	path := filepath.Join(cfg.Dir, name)
+	if _, err := db.Exec("VACUUM INTO ?", path); err != nil {
+		return Backup{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return Backup{}, err
+	}
+	if err := pruneBackups(cfg); err != nil {
+		return Backup{}, err
+	}
+	return Backup{Name: name, Size: info.Size(), TakenAt: now}, nil
+}
+
+// listBackups returns the backups in the directory, newest first.
+func listBackups(dir string) ([]Backup, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var backups []Backup
+	for _, e := range entries {
+		stamp, ok := strings.CutPrefix(e.Name(), "bloodbank-")
+		if !ok || e.IsDir() {
+			continue
+		}
+		takenAt, err := time.ParseInLocation(backupLayout, strings.TrimSuffix(stamp, ".db"), time.Local)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, Backup{Name: e.Name(), Size: info.Size(), TakenAt: takenAt})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].TakenAt.After(backups[j].TakenAt) })
+	return backups, nil
+}
+
+func pruneBackups(cfg backupConfig) error {
+	backups, err := listBackups(cfg.Dir)
+	if err != nil {
+		return err
+	}
+	for len(backups) > cfg.Keep {
+		old := backups[len(backups)-1]
+		if err := os.Remove(filepath.Join(cfg.Dir, old.Name)); err != nil {
+			return err
+		}
+		backups = backups[:len(backups)-1]
+	}
+	return nil
+}
+
+// runBackupJob backs up the database whenever the newest backup is older
+// than the interval, checking every hour.
+func runBackupJob(db *sql.DB, cfg backupConfig) {
+	if cfg.Interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		backups, err := listBackups(cfg.Dir)
+		if err != nil {
+			log.Println("backup error:", err)
+		} else if len(backups) == 0 || time.Since(backups[0].TakenAt) >= cfg.Interval {
+			if b, err := backupDB(db, cfg); err != nil {
+				log.Println("backup error:", err)
+			} else {
+				log.Println("backed up database to", filepath.Join(cfg.Dir, b.Name))
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// checkIntegrity runs every check on a database and lists what is wrong.
+func checkIntegrity(db *sql.DB) (IntegrityReport, error) {
+	report := IntegrityReport{CheckedAt: nowTimestamp()}
+	add := func(check string, details []string) {
+		for i, d := range details {
+			if i == maxIntegrityDetails {
+				d = fmt.Sprintf("and %d more", len(details)-i)
+			}
+			report.Problems = append(report.Problems, IntegrityProblem{Check: check, Detail: d})
+			if i == maxIntegrityDetails {
+				break
+			}
+		}
+	}
+
+	details, err := sqliteIntegrity(db)
+	if err != nil {
+		return report, err
+	}
+	add("integrity", details)
+	if details, err = foreignKeyProblems(db); err != nil {
+		return report, err
+	}
+	add("foreign keys", details)
+	// The inventory checks only make sense on a database of this schema.
+	if ok, err := tableHasColumn(db, "donations", "remaining_units"); err != nil || !ok {
+		return report, err
+	}
+	if details, err = inventoryProblems(db); err != nil {
+		return report, err
+	}
+	add("inventory", details)
+	if details, err = ledgerProblems(db); err != nil {
+		return report, err
+	}
+	add("donation ledger", details)
+	return report, nil
+}
+
+func sqliteIntegrity(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var details []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return nil, err
+		}
+		if msg != "ok" {
+			details = append(details, msg)
+		}
+	}
+	return details, rows.Err()
+}
+
+func foreignKeyProblems(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var details []string
+	for rows.Next() {
+		var table, parent string
+		var rowID sql.NullInt64
+		var fk int
+		if err := rows.Scan(&table, &rowID, &parent, &fk); err != nil {
+			return nil, err
+		}
+		details = append(details, fmt.Sprintf("%s row %d refers to a missing %s row", table, rowID.Int64, parent))
+	}
+	return details, rows.Err()
+}
+
+// inventoryProblems compares each blood type's inventory count with the
+// units left in its active donations.
+func inventoryProblems(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT bt.type, COALESCE(i.units, 0), COALESCE(d.units, 0)
+		FROM blood_types bt
+		LEFT JOIN inventory i ON i.blood_type_id = bt.id AND i.deleted_at IS NULL
+		LEFT JOIN (
+			SELECT donors.blood_type_id, SUM(donations.remaining_units) AS units
+			FROM donations
+			JOIN donors ON donors.id = donations.donor_id
+			WHERE donations.deleted_at IS NULL
+			GROUP BY donors.blood_type_id
+		) d ON d.blood_type_id = bt.id
+		WHERE COALESCE(i.units, 0) != COALESCE(d.units, 0)
+		ORDER BY bt.type
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var details []string
+	for rows.Next() {
+		var bt string
+		var inventory, remaining int
+		if err := rows.Scan(&bt, &inventory, &remaining); err != nil {
+			return nil, err
+		}
+		details = append(details, fmt.Sprintf("%s inventory is %d units but donations have %d left", bt, inventory, remaining))
+	}
+	return details, rows.Err()
+}
+
+// ledgerProblems finds active donations whose units left differ from their
+// units less those already out when imported, less those issued, plus those
+// returned and less those discarded. Units issued before issues were
+// recorded show up here.
+func ledgerProblems(db *sql.DB) ([]string, error) {
+	// Databases from before imports were tracked have no units out at import.
+	outAtImport := "d.units_out_at_import"
+	if ok, err := tableHasColumn(db, "donations", "units_out_at_import"); err != nil {
+		return nil, err
+	} else if !ok {
+		outAtImport = "0"
+	}
+	rows, err := db.Query(`
+		SELECT d.id, COALESCE(d.din, ''), d.remaining_units,
+			d.units - ` + outAtImport + `
+			- COALESCE((SELECT SUM(units) FROM issues WHERE donation_id = d.id), 0)
+			+ COALESCE((SELECT SUM(units) FROM returns WHERE donation_id = d.id), 0)
+			- COALESCE((SELECT SUM(units) FROM discards WHERE donation_id = d.id), 0) AS ledger
+		FROM donations d
+		WHERE d.deleted_at IS NULL AND d.remaining_units IS NOT ledger
+		ORDER BY d.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var details []string
+	for rows.Next() {
+		var id int
+		var din string
+		var remaining sql.NullInt64
+		var ledger int
+		if err := rows.Scan(&id, &din, &remaining, &ledger); err != nil {
+			return nil, err
+		}
+		details = append(details, fmt.Sprintf("donation %d (%s) has %d units left but its ledger gives %d", id, din, remaining.Int64, ledger))
+	}
+	return details, rows.Err()
+}
+
+// validateRestore opens a database file read-only and checks that it is a
+// sound blood bank database.
+func validateRestore(path string) (IntegrityReport, error) {
+	if _, err := os.Stat(path); err != nil {
+		return IntegrityReport{}, err
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return IntegrityReport{}, err
+	}
+	defer db.Close()
+	for _, table := range requiredTables {
+		ok, err := exists(db, "SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?", table)
+		if err != nil {
+			return IntegrityReport{}, fmt.Errorf("%s is not a SQLite database: %w", path, err)
+		}
+		if !ok {
+			return IntegrityReport{}, fmt.Errorf("%s has no %s table", path, table)
+		}
+	}
+	return checkIntegrity(db)
+}
+
+// restoreDB replaces the database file with a copy of a backup. The copy
+// is written next to the database and renamed over it, so an interrupted
+// restore leaves the old database in place. The old database is kept as
+// bloodbank.db.before-restore.
+func restoreDB(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := dbFile + ".restoring"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if _, err := os.Stat(dbFile); err == nil {
+		if err := saveBeforeRestore(); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	// The old database's journal is in the saved copy, and must not be
+	// applied to the new one.
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		if err := os.Remove(dbFile + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return os.Rename(tmp, dbFile)
+}
+
+// saveBeforeRestore copies the database through SQLite with VACUUM INTO, so
+// the copy takes in a journal left by a crash rather than losing it.
+func saveBeforeRestore() error {
+	path := dbFile + ".before-restore"
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	db, err := sql.Open("sqlite", "file:"+dbFile+dbPragmas)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec("VACUUM INTO ?", path)
+	return err
+}
+
+func printIntegrity(report IntegrityReport) {
+	if report.OK() {
+		fmt.Println("no problems found")
+		return
+	}
+	for _, p := range report.Problems {
+		fmt.Printf("%s: %s\n", p.Check, p.Detail)
+	}
+}
+
+// backupCommand takes a backup from the command line.
+func backupCommand(db *sql.DB, args []string) int {
+	cfg := backupConfigFromEnv()
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	fs.StringVar(&cfg.Dir, "dir", cfg.Dir, "directory to write the backup to")
+	fs.IntVar(&cfg.Keep, "keep", cfg.Keep, "number of backups to keep")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	b, err := backupDB(db, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "backup:", err)
+		return 1
+	}
+	fmt.Println("backed up database to", filepath.Join(cfg.Dir, b.Name))
+	return 0
+}
+
+// checkCommand runs the integrity check from the command line. It exits
+// with 1 when there are problems.
+func checkCommand(db *sql.DB, args []string) int {
+	report, err := checkIntegrity(db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "check:", err)
+		return 1
+	}
+	printIntegrity(report)
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+// restoreCommand validates a backup and swaps it in for the database. It
+// runs before the database is opened; the server must be stopped first.
+// SQLite or foreign key errors stop the restore; inventory and ledger
+// problems are listed but do not, unless -strict is given.
+func restoreCommand(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	strict := fs.Bool("strict", false, "refuse backups with any problem")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: restore [flags] backup.db")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	path := fs.Arg(0)
+
+	report, err := validateRestore(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "restore:", err)
+		return 1
+	}
+	printIntegrity(report)
+	for _, p := range report.Problems {
+		if *strict || p.Check == "integrity" || p.Check == "foreign keys" {
+			fmt.Fprintln(os.Stderr, "restore: not restoring a backup with problems")
+			return 1
+		}
+	}
+	if err := restoreDB(path); err != nil {
+		fmt.Fprintln(os.Stderr, "restore:", err)
+		return 1
+	}
+	fmt.Printf("restored %s to %s; the previous database is %s\n", path, dbFile, dbFile+".before-restore")
+	return 0
+}
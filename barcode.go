@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"strings"
+)
+
+var errBarcodeData = errors.New("barcode data must be printable ASCII")
+
+// code128Patterns are the bar and space widths, in modules, of each Code 128
+// symbol value. Every pattern starts with a bar; the last one is the stop
+// pattern, which carries a trailing bar.
+var code128Patterns = [...]string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232", "2331112",
+}
+
+const (
+	code128CodeC  = 99
+	code128CodeB  = 100
+	code128StartB = 104
+	code128StartC = 105
+	code128Stop   = 106
+)
+
+// code128 encodes printable ASCII as Code 128 and returns the module widths
+// of its bars and spaces, alternating and starting with a bar. Runs of four
+// or more digits use code set C, which packs two digits per symbol; anything
+// else uses code set B.
+func code128(data string) ([]int, error) {
+	if data == "" {
+		return nil, errBarcodeData
+	}
+	for i := 0; i < len(data); i++ {
+		if data[i] < 32 || data[i] > 126 {
+			return nil, errBarcodeData
+		}
+	}
+
+	var values []int
+	set := 0
+	for i := 0; i < len(data); {
+		run := digitRun(data[i:])
+		// Switching to set C costs a symbol, so it only pays off for an
+		// even run of at least four digits, or six in the middle of text.
+		useC := run >= 4 && (i == 0 || i+run == len(data) || run >= 6)
+		if useC && run%2 == 1 {
+			if i == 0 {
+				// Encode the odd digit in set B after the run instead.
+				run--
+			} else {
+				values, set = code128Switch(values, set, code128CodeB)
+				values = append(values, int(data[i])-32)
+				i++
+				run--
+			}
+		}
+		if useC {
+			values, set = code128Switch(values, set, code128CodeC)
+			for end := i + run; i < end; i += 2 {
+				values = append(values, int(data[i]-'0')*10+int(data[i+1]-'0'))
+			}
+			continue
+		}
+		values, set = code128Switch(values, set, code128CodeB)
+		values = append(values, int(data[i])-32)
+		i++
+	}
+
+	checksum := values[0]
+	for i, v := range values[1:] {
+		checksum += (i + 1) * v
+	}
+	values = append(values, checksum%103, code128Stop)
+
+	var widths []int
+	for _, v := range values {
+		for _, w := range code128Patterns[v] {
+			widths = append(widths, int(w-'0'))
+		}
+	}
+	return widths, nil
+}
+
+// code128Switch moves to code set B or C, emitting a start symbol for the
+// first set and a shift symbol for later changes.
+func code128Switch(values []int, set int, want int) ([]int, int) {
+	if set == want {
+		return values, set
+	}
+	if set == 0 {
+		start := code128StartB
+		if want == code128CodeC {
+			start = code128StartC
+		}
+		return append(values, start), want
+	}
+	return append(values, want), want
+}
+
+func digitRun(s string) int {
+	n := 0
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
+
+// barcodeSVG renders data as an inline Code 128 SVG for HTML pages, with the
+// quiet zone Code 128 requires on both sides.
+func barcodeSVG(data string) (template.HTML, error) {
+	widths, err := code128(data)
+	if err != nil {
+		return "", err
+	}
+	const quiet, height = 10, 50
+	var bars strings.Builder
+	x := quiet
+	for i, w := range widths {
+		if i%2 == 0 {
+			fmt.Fprintf(&bars, "M%d 0h%dv%dh-%dz", x, w, height, w)
+		}
+		x += w
+	}
+	return template.HTML(fmt.Sprintf(
+		`<svg class="barcode" xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" preserveAspectRatio="none" role="img" aria-label="%s"><path d="%s" fill="#000"/></svg>`,
+		x+quiet, height, template.HTMLEscapeString(data), bars.String(),
+	)), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// code128Values decodes module widths back into Code 128 symbol values.
+func code128Values(t *testing.T, widths []int) []int {
+	t.Helper()
+	symbols := map[string]int{}
+	for v, p := range code128Patterns {
+		symbols[p] = v
+	}
+	var b strings.Builder
+	for _, w := range widths {
+		b.WriteByte(byte('0' + w))
+	}
+	s := b.String()
+	var values []int
+	for len(s) > 0 {
+		n := 6
+		if len(s) == 7 {
+			n = 7
+		}
+		v, ok := symbols[s[:n]]
+		if !ok {
+			t.Fatalf("no Code 128 symbol has widths %s", s[:n])
+		}
+		values = append(values, v)
+		s = s[n:]
+	}
+	return values
+}
+
+func TestCode128(t *testing.T) {
+	tests := []struct {
+		data string
+		want []int
+	}{
+		// Start B, the characters, checksum 55, stop.
+		{"PJJ123C", []int{104, 48, 42, 42, 17, 18, 19, 35, 55, 106}},
+		// Start C packs the digits in pairs: checksum 44.
+		{"123456", []int{105, 12, 34, 56, 44, 106}},
+		// An odd run of digits at the start ends in set B.
+		{"12345", []int{105, 12, 34, 100, 21, 54, 106}},
+		{"D00000018", []int{104, 36, 99, 0, 0, 0, 18, 34, 106}},
+	}
+	for _, tt := range tests {
+		widths, err := code128(tt.data)
+		if err != nil {
+			t.Errorf("code128(%q): %v", tt.data, err)
+			continue
+		}
+		if got := code128Values(t, widths); !slices.Equal(got, tt.want) {
+			t.Errorf("code128(%q) = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestCode128Invalid(t *testing.T) {
+	for _, data := range []string{"", "café", "tab\there"} {
+		if _, err := code128(data); err != errBarcodeData {
+			t.Errorf("code128(%q) error = %v, want %v", data, err, errBarcodeData)
+		}
+	}
+}
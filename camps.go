@@ -0,0 +1,421 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Camp is a donation camp or mobile collection drive, with what it achieved.
+// A donor counts as registered once they are signed in at the camp, give
+// blood there or are deferred there.
+type Camp struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Location    string `json:"location"`
+	CampDate    string `json:"camp_date"`
+	Organizer   string `json:"organizer"`
+	TargetUnits int    `json:"target_units"`
+	CreatedAt   string `json:"created_at"`
+	Registered  int    `json:"registered"`
+	Donors      int    `json:"donors"`
+	Units       int    `json:"units"`
+	Deferred    int    `json:"deferred"`
+}
+
+// DeferralRate is the percentage of registered donors who were deferred.
+func (c Camp) DeferralRate() int {
+	if c.Registered == 0 {
+		return 0
+	}
+	return c.Deferred * 100 / c.Registered
+}
+
+// TargetPercent is how much of the unit target was collected.
+func (c Camp) TargetPercent() int {
+	if c.TargetUnits == 0 {
+		return 0
+	}
+	return c.Units * 100 / c.TargetUnits
+}
+
+// CampDonor is one donor registered at a camp and what happened to them.
+type CampDonor struct {
+	DonorID      int
+	DonorNumber  string
+	Name         string
+	BloodType    string
+	RegisteredAt string
+	Units        int
+	Deferral     string
+}
+
+type CampListData struct {
+	Camps   []Camp
+	Form    Form
+	Message string
+}
+
+type CampData struct {
+	Camp            Camp
+	Donors          []CampDonor
+	DeferralReasons []string
+	Walkins         Form
+	Deferral        Form
+	Message         string
+}
+
+type CampEditData struct {
+	Camp    Camp
+	Form    Form
+	Message string
+}
+
+// campStats selects a camp and its totals; deleted donations do not count.
+const campStats = `
+	SELECT c.id, c.name, c.location, c.camp_date, COALESCE(c.organizer, ''), c.target_units, c.created_at,
+		(SELECT COUNT(*) FROM camp_donors cd WHERE cd.camp_id = c.id),
+		(SELECT COUNT(DISTINCT d.donor_id) FROM donations d WHERE d.camp_id = c.id AND d.deleted_at IS NULL),
+		(SELECT COALESCE(SUM(d.units), 0) FROM donations d WHERE d.camp_id = c.id AND d.deleted_at IS NULL),
+		(SELECT COUNT(DISTINCT f.donor_id) FROM deferrals f WHERE f.camp_id = c.id)
+	FROM camps c
+`
+
+func registerCampRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/camps", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			renderCampList(w, tmpl, db, Form{}, "")
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		in, form := campForm(r)
+		form.Merge(in.Validate())
+		if !form.Valid() {
+			renderCampList(w, tmpl, db, form, "Please correct the highlighted fields.")
+			return
+		}
+		id, err := createCamp(db, in)
+		if err != nil {
+			renderCampList(w, tmpl, db, form, "Could not add camp.")
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/camps/%d", id), http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/camps/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		renderCamp(w, tmpl, db, id, Form{}, Form{}, "")
+	})
+
+	mux.HandleFunc("/camps/{id}/edit", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		renderCampEdit(w, tmpl, db, id, Form{}, "")
+	})
+
+	mux.HandleFunc("/camps/update", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		in, form := campForm(r)
+		form.Merge(in.Validate())
+		if !form.Valid() {
+			renderCampEdit(w, tmpl, db, id, form, "Please correct the highlighted fields.")
+			return
+		}
+		if err := updateCamp(db, id, in); err != nil {
+			renderCampEdit(w, tmpl, db, id, form, "Could not update camp.")
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/camps/%d", id), http.StatusSeeOther)
+	})
+
+	// Walk-ins are registered in bulk, one donor per line, so a camp's sign-in
+	// sheet can be typed up in one go. Either every line is registered or
+	// none is.
+	mux.HandleFunc("/camps/walkins", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.FormValue("camp_id"))
+		form := newForm(map[string]string{"donors": r.FormValue("donors")})
+		if ok, err := exists(db, "SELECT 1 FROM camps WHERE id = ?", id); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		} else if !ok {
+			http.Error(w, "camp not found", http.StatusNotFound)
+			return
+		}
+		walkins, problems, err := parseWalkins(db, form.Get("donors"))
+		if err != nil {
+			renderCamp(w, tmpl, db, id, form, Form{}, "Could not register walk-ins.")
+			return
+		}
+		if len(problems) > 0 {
+			form.Errors.add("donors", strings.Join(problems, " "))
+			renderCamp(w, tmpl, db, id, form, Form{}, "Please correct the highlighted lines.")
+			return
+		}
+		if len(walkins) == 0 {
+			form.Errors.add("donors", "Enter at least one donor.")
+			renderCamp(w, tmpl, db, id, form, Form{}, "Please correct the highlighted fields.")
+			return
+		}
+		if err := registerWalkins(db, id, walkins); err != nil {
+			renderCamp(w, tmpl, db, id, form, Form{}, "Could not register walk-ins.")
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/camps/%d", id), http.StatusSeeOther)
+	})
+}
+
+func renderCampList(w http.ResponseWriter, tmpl *template.Template, db *sql.DB, form Form, msg string) {
+	camps, err := loadCamps(db)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if form.Values == nil {
+		form = newForm(map[string]string{"camp_date": todayDate()})
+	}
+	renderPage(w, tmpl, "camps.html", CampListData{Camps: camps, Form: form, Message: msg})
+}
+
+func renderCamp(w http.ResponseWriter, tmpl *template.Template, db *sql.DB, id int, walkins Form, deferral Form, msg string) {
+	camp, err := loadCamp(db, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "camp not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	data := CampData{Camp: camp, DeferralReasons: deferralReasons, Walkins: walkins, Deferral: deferral, Message: msg}
+	if data.Donors, err = loadCampDonors(db, id); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	renderPage(w, tmpl, "camp.html", data)
+}
+
+func renderCampEdit(w http.ResponseWriter, tmpl *template.Template, db *sql.DB, id int, form Form, msg string) {
+	camp, err := loadCamp(db, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "camp not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if form.Values == nil {
+		form = newForm(map[string]string{
+			"name": camp.Name, "location": camp.Location, "camp_date": camp.CampDate,
+			"organizer": camp.Organizer, "target_units": strconv.Itoa(camp.TargetUnits),
+		})
+	}
+	renderPage(w, tmpl, "camp_edit.html", CampEditData{Camp: camp, Form: form, Message: msg})
+}
+
+func scanCamp(row interface{ Scan(...any) error }) (Camp, error) {
+	var c Camp
+	err := row.Scan(&c.ID, &c.Name, &c.Location, &c.CampDate, &c.Organizer, &c.TargetUnits, &c.CreatedAt,
+		&c.Registered, &c.Donors, &c.Units, &c.Deferred)
+	return c, err
+}
+
+func loadCamp(db *sql.DB, id int) (Camp, error) {
+	return scanCamp(db.QueryRow(campStats+" WHERE c.id = ?", id))
+}
+
+// loadCamps lists camps with the most recent first.
+func loadCamps(db *sql.DB) ([]Camp, error) {
+	rows, err := db.Query(campStats + " ORDER BY c.camp_date DESC, c.id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var camps []Camp
+	for rows.Next() {
+		c, err := scanCamp(rows)
+		if err != nil {
+			return nil, err
+		}
+		camps = append(camps, c)
+	}
+	return camps, rows.Err()
+}
+
+func loadCampDonors(db *sql.DB, campID int) ([]CampDonor, error) {
+	rows, err := db.Query(`
+		SELECT d.id, COALESCE(d.donor_number, ''), d.name, bt.type, cd.registered_at,
+			(SELECT COALESCE(SUM(x.units), 0) FROM donations x
+				WHERE x.camp_id = cd.camp_id AND x.donor_id = d.id AND x.deleted_at IS NULL),
+			COALESCE((SELECT f.reason FROM deferrals f
+				WHERE f.camp_id = cd.camp_id AND f.donor_id = d.id ORDER BY f.id DESC LIMIT 1), '')
+		FROM camp_donors cd
+		JOIN donors d ON d.id = cd.donor_id
+		JOIN blood_types bt ON bt.id = d.blood_type_id
+		WHERE cd.camp_id = ?
+		ORDER BY cd.registered_at, d.name
+	`, campID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var donors []CampDonor
+	for rows.Next() {
+		var d CampDonor
+		if err := rows.Scan(&d.DonorID, &d.DonorNumber, &d.Name, &d.BloodType, &d.RegisteredAt, &d.Units, &d.Deferral); err != nil {
+			return nil, err
+		}
+		donors = append(donors, d)
+	}
+	return donors, rows.Err()
+}
+
+func createCamp(db *sql.DB, in CampInput) (int, error) {
+	res, err := db.Exec(
+		"INSERT INTO camps (name, location, camp_date, organizer, target_units, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		in.Name, in.Location, in.CampDate, nullIfEmpty(in.Organizer), in.TargetUnits, nowTimestamp(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func updateCamp(db *sql.DB, id int, in CampInput) error {
+	_, err := db.Exec(
+		"UPDATE camps SET name = ?, location = ?, camp_date = ?, organizer = ?, target_units = ? WHERE id = ?",
+		in.Name, in.Location, in.CampDate, nullIfEmpty(in.Organizer), in.TargetUnits, id,
+	)
+	return err
+}
+
+// registerCampDonor signs a donor in at a camp; signing in twice is a no-op.
+func registerCampDonor(db querier, campID int, donorID int, at string) error {
+	_, err := db.Exec("INSERT OR IGNORE INTO camp_donors (camp_id, donor_id, registered_at) VALUES (?, ?, ?)", campID, donorID, at)
+	return err
+}
+
+// walkin is one parsed line of a walk-in sheet: an existing donor, or a new
+// one to register.
+type walkin struct {
+	donorID int
+	donor   DonorInput
+}
+
+// parseWalkins reads a walk-in sheet. Each line is either a donor number
+// from a donor card or "name, blood type, phone, city", where phone and city
+// are optional. A new donor whose name and phone match a registered donor is
+// taken to be that donor. Problems are reported by line number.
+func parseWalkins(db *sql.DB, text string) ([]walkin, []string, error) {
+	var walkins []walkin
+	var problems []string
+	// seen holds the line of each new donor already on the sheet, so one
+	// listed twice is not registered twice.
+	seen := map[string]int{}
+	for n, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) == 1 {
+			number, err := parseDonorNumber(line)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("Line %d: enter a donor number or name, blood type, phone, city.", n+1))
+				continue
+			}
+			id, err := findDonorByNumber(db, number)
+			if err != nil {
+				return nil, nil, err
+			}
+			if id == 0 {
+				problems = append(problems, fmt.Sprintf("Line %d: no donor has number %s.", n+1, number))
+				continue
+			}
+			walkins = append(walkins, walkin{donorID: id})
+			continue
+		}
+		if len(fields) > 4 {
+			problems = append(problems, fmt.Sprintf("Line %d: expected name, blood type, phone, city.", n+1))
+			continue
+		}
+		fields = append(fields, "", "")
+		in := DonorInput{Name: fields[0], BloodType: fields[1], Phone: fields[2], City: fields[3]}
+		if errs := in.Validate(); len(errs) > 0 {
+			for _, field := range []string{"name", "blood_type", "phone", "city"} {
+				if msg, ok := errs[field]; ok {
+					problems = append(problems, fmt.Sprintf("Line %d: %s", n+1, msg))
+					break
+				}
+			}
+			continue
+		}
+		key := strings.ToLower(in.Name) + "|" + in.Phone
+		if line, ok := seen[key]; ok {
+			problems = append(problems, fmt.Sprintf("Line %d: same donor as line %d.", n+1, line))
+			continue
+		}
+		seen[key] = n + 1
+		duplicates, err := findDuplicateDonors(db, in, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(duplicates) > 0 {
+			walkins = append(walkins, walkin{donorID: duplicates[0].ID})
+			continue
+		}
+		walkins = append(walkins, walkin{donor: in})
+	}
+	return walkins, problems, nil
+}
+
+// registerWalkins adds any new donors and signs everyone in at the camp.
+func registerWalkins(db *sql.DB, campID int, walkins []walkin) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := nowTimestamp()
+	for _, w := range walkins {
+		id := w.donorID
+		if id == 0 {
+			bloodTypeID, err := getOrCreateBloodTypeID(tx, w.donor.BloodType)
+			if err != nil {
+				return err
+			}
+			if id, err = insertDonor(tx, bloodTypeID, w.donor); err != nil {
+				return err
+			}
+		}
+		if err := registerCampDonor(tx, campID, id, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Delete modes for donors and recipients that still have dependent records.
+//
+//   - block refuses the delete and explains what is still in use.
+//   - cascade voids the donor's donations still in stock, or cancels the
+//     recipient's pending requests.
+//   - anonymize clears the person's name and contact details but keeps their
+//     donation or request history. As in cascade, the donor's stock is
+//     voided so no unit is issued from a deleted donor, and the recipient's
+//     pending requests are cancelled.
+const (
+	deleteBlock     = "block"
+	deleteCascade   = "cascade"
+	deleteAnonymize = "anonymize"
+)
+
+// deleteDonor soft-deletes a donor according to mode. A non-empty problem
+// explains why the delete was refused.
+func deleteDonor(db *sql.DB, id int, mode string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT COUNT(*) > 0 FROM donors WHERE id = ? AND deleted_at IS NULL", id).Scan(&exists); err != nil {
+		return "", err
+	}
+	if !exists {
+		return "Donor not found.", nil
+	}
+
+	inStock, err := queryIDs(tx, `
+		SELECT id FROM donations
+		WHERE donor_id = ? AND deleted_at IS NULL AND remaining_units > 0
+	`, id)
+	if err != nil {
+		return "", err
+	}
+
+	switch mode {
+	case deleteCascade:
+		for _, donationID := range inStock {
+			if err := voidDonationTx(tx, donationID, "Donor deleted"); err != nil {
+				return "", err
+			}
+		}
+	case deleteAnonymize:
+		for _, donationID := range inStock {
+			if err := voidDonationTx(tx, donationID, "Donor anonymized"); err != nil {
+				return "", err
+			}
+		}
+		if _, err := tx.Exec("UPDATE donors SET name = ?, phone = '', city = '', email = NULL, date_of_birth = NULL WHERE id = ?", fmt.Sprintf("Anonymized donor #%d", id), id); err != nil {
+			return "", err
+		}
+	default:
+		if len(inStock) > 0 {
+			return fmt.Sprintf("Donor still has units in stock from %d donations. Void them, or delete with another option.", len(inStock)), nil
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE donors SET deleted_at = ? WHERE id = ?", nowTimestamp(), id); err != nil {
+		return "", err
+	}
+	return "", tx.Commit()
+}
+
+// deleteRecipient soft-deletes a recipient according to mode. A non-empty
+// problem explains why the delete was refused.
+func deleteRecipient(db *sql.DB, id int, mode string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT COUNT(*) > 0 FROM recipients WHERE id = ? AND deleted_at IS NULL", id).Scan(&exists); err != nil {
+		return "", err
+	}
+	if !exists {
+		return "Recipient not found.", nil
+	}
+
+	var pending int
+	if err := tx.QueryRow(
+		"SELECT COUNT(*) FROM requests WHERE recipient_id = ? AND deleted_at IS NULL AND status = 'Pending'", id,
+	).Scan(&pending); err != nil {
+		return "", err
+	}
+	if pending > 0 && mode != deleteCascade && mode != deleteAnonymize {
+		return fmt.Sprintf("Recipient has %d pending requests. Cancel them, or delete with another option.", pending), nil
+	}
+
+	deletedAt := nowTimestamp()
+	if _, err := tx.Exec(
+		"UPDATE requests SET status = 'Cancelled', deleted_at = ? WHERE recipient_id = ? AND deleted_at IS NULL AND status = 'Pending'",
+		deletedAt, id,
+	); err != nil {
+		return "", err
+	}
+	if mode == deleteAnonymize {
+		if _, err := tx.Exec("UPDATE recipients SET name = ?, phone = '' WHERE id = ?", fmt.Sprintf("Anonymized recipient #%d", id), id); err != nil {
+			return "", err
+		}
+	}
+	if _, err := tx.Exec("UPDATE recipients SET deleted_at = ? WHERE id = ?", deletedAt, id); err != nil {
+		return "", err
+	}
+	return "", tx.Commit()
+}
+
+func queryIDs(db querier, query string, args ...any) ([]int, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+)
+
+const commandUsage = `usage: sarthak-sql-project [command] [flags]
+
+With no command, the web server starts on :8080.
+
+commands:
+  import    check and import a CSV file of donors, recipients or donations
+  backup    copy the database into the backup directory
+  check     check the database's integrity and that inventory adds up
+  restore   check a backup and replace the database with it; stop the server first`
+
+// readOnlyCommands only read the database, so it is not migrated for them.
+var readOnlyCommands = map[string]bool{"backup": true, "check": true}
+
+// runCommand runs a command given on the command line and returns the
+// process exit code.
+func runCommand(db *sql.DB, args []string) int {
+	switch args[0] {
+	case "import":
+		return importCommand(db, args[1:])
+	case "backup":
+		return backupCommand(db, args[1:])
+	case "check":
+		return checkCommand(db, args[1:])
+	}
+	fmt.Fprintln(os.Stderr, commandUsage)
+	return 2
+}
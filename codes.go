@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Pixel sizes of generated code images.
+const (
+	barcodeModulePixels = 2
+	barcodeHeightPixels = 60
+	qrModulePixels      = 8
+)
+
+// defaultBaseURL is where QR codes link when BLOODBANK_BASE_URL is not set.
+const defaultBaseURL = "http://localhost:8080"
+
+type RequestSlipData struct {
+	Request Request
+	Number  string
+	Message string
+}
+
+// requestNumber is the number printed and barcoded on a request slip.
+func requestNumber(id int) string {
+	return fmt.Sprintf("REQ%06d", id)
+}
+
+func registerCodeRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	// Code images for a record: code128.png encodes its donor number, DIN or
+	// request number, and qr.png links to its page.
+	mux.HandleFunc("/codes/{entity}/{id}/{kind}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		entity, kind := r.PathValue("entity"), r.PathValue("kind")
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		data, err := codeData(db, entity, id)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+
+		var img image.Image
+		switch kind {
+		case "code128.png":
+			widths, err := code128(data)
+			if err != nil {
+				http.Error(w, "server error", http.StatusInternalServerError)
+				return
+			}
+			img = barcodeImage(widths)
+		case "qr.png":
+			q, err := encodeQR([]byte(fmt.Sprintf("%s/%s/%d", baseURL(), entity, id)))
+			if err != nil {
+				http.Error(w, "server error", http.StatusInternalServerError)
+				return
+			}
+			img = qrImage(q)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Write(buf.Bytes())
+	})
+
+	mux.HandleFunc("/requests/{id}/slip", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		req, err := loadRequest(db, id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "request not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		renderPage(w, tmpl, "request_slip.html", RequestSlipData{Request: req, Number: requestNumber(id)})
+	})
+}
+
+// codeData returns what a record's Code 128 barcode encodes, or
+// sql.ErrNoRows if there is no such record.
+func codeData(db *sql.DB, entity string, id int) (string, error) {
+	var data string
+	var err error
+	switch entity {
+	case "donors":
+		err = db.QueryRow("SELECT donor_number FROM donors WHERE id = ? AND deleted_at IS NULL", id).Scan(&data)
+	case "donations":
+		err = db.QueryRow("SELECT '=' || din || ? FROM donations WHERE id = ? AND deleted_at IS NULL", isbtFlags, id).Scan(&data)
+	case "requests":
+		err = db.QueryRow("SELECT 1 FROM requests WHERE id = ? AND deleted_at IS NULL", id).Scan(new(int))
+		data = requestNumber(id)
+	default:
+		err = sql.ErrNoRows
+	}
+	return data, err
+}
+
+// baseURL is the address QR codes link back to, from BLOODBANK_BASE_URL. It
+// is configured rather than taken from the request's Host header, which a
+// client could set to send a scanned code to another site.
+func baseURL() string {
+	if u := strings.TrimRight(os.Getenv("BLOODBANK_BASE_URL"), "/"); u != "" {
+		return u
+	}
+	return defaultBaseURL
+}
+
+// barcodeImage draws Code 128 module widths as a black and white image with
+// a ten-module quiet zone on each side.
+func barcodeImage(widths []int) image.Image {
+	const quiet = 10
+	modules := 2 * quiet
+	for _, w := range widths {
+		modules += w
+	}
+	img := newCodeImage(modules*barcodeModulePixels, barcodeHeightPixels)
+	x := quiet * barcodeModulePixels
+	for i, w := range widths {
+		if i%2 == 0 {
+			fillRect(img, x, 0, w*barcodeModulePixels, barcodeHeightPixels)
+		}
+		x += w * barcodeModulePixels
+	}
+	return img
+}
+
+// qrImage draws a QR code with the four-module quiet zone scanners expect.
+func qrImage(q *qrCode) image.Image {
+	const quiet = 4
+	size := (q.size + 2*quiet) * qrModulePixels
+	img := newCodeImage(size, size)
+	for y, row := range q.modules {
+		for x, dark := range row {
+			if dark {
+				fillRect(img, (x+quiet)*qrModulePixels, (y+quiet)*qrModulePixels, qrModulePixels, qrModulePixels)
+			}
+		}
+	}
+	return img
+}
+
+// newCodeImage returns a white two-colour image; index 1 is black.
+func newCodeImage(width, height int) *image.Paletted {
+	return image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{color.White, color.Black})
+}
+
+func fillRect(img *image.Paletted, x, y, w, h int) {
+	for yy := y; yy < y+h; yy++ {
+		for xx := x; xx < x+w; xx++ {
+			img.SetColorIndex(xx, yy, 1)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import "database/sql"
+
+// defaultComponent is assigned to donations recorded before components were
+// tracked.
+const defaultComponent = "Whole Blood"
+
+// standardComponents are seeded on startup with their maximum shelf life and
+// the ISBT 128 product description code printed on their labels. The codes
+// are typical ones for each component; check them against the ICCBBA product
+// database for the bags and processing actually used.
+var standardComponents = []Component{
+	{Name: "Whole Blood", ShelfLifeDays: 35, ISBTCode: "E0001"},
+	{Name: "Packed Red Cells", ShelfLifeDays: 42, ISBTCode: "E0336"},
+	{Name: "Platelets", ShelfLifeDays: 5, ISBTCode: "E3087"},
+	{Name: "Fresh Frozen Plasma", ShelfLifeDays: 365, ISBTCode: "E2555"},
+	{Name: "Cryoprecipitate", ShelfLifeDays: 365, ISBTCode: "E5165"},
+}
+
+type Component struct {
+	ID            int
+	Name          string
+	ShelfLifeDays int
+	ISBTCode      string
+}
+
+func seedComponents(db *sql.DB) error {
+	for _, c := range standardComponents {
+		if _, err := db.Exec("INSERT OR IGNORE INTO components (name, shelf_life_days) VALUES (?, ?)", c.Name, c.ShelfLifeDays); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedComponentCodes fills in the product code of standard components that
+// do not have one yet.
+func seedComponentCodes(db *sql.DB) error {
+	for _, c := range standardComponents {
+		if _, err := db.Exec("UPDATE components SET isbt_code = ? WHERE name = ? AND isbt_code IS NULL", c.ISBTCode, c.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadComponents(db *sql.DB) ([]Component, error) {
+	rows, err := db.Query("SELECT id, name, shelf_life_days, COALESCE(isbt_code, '') FROM components ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var components []Component
+	for rows.Next() {
+		var c Component
+		if err := rows.Scan(&c.ID, &c.Name, &c.ShelfLifeDays, &c.ISBTCode); err != nil {
+			return nil, err
+		}
+		components = append(components, c)
+	}
+	return components, rows.Err()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+)
+
+// defaultCallingCode is assumed for phone numbers entered without a country
+// code.
+const defaultCallingCode = "91"
+
+var (
+	errInvalidPhone = errors.New("invalid phone number")
+	errInvalidEmail = errors.New("invalid email address")
+)
+
+// normalizePhone converts a phone number to E.164, e.g. "+919876543210".
+// Spaces, dashes, dots and brackets are ignored. A number starting with "+"
+// or "00" already carries its country code; otherwise a single leading
+// trunk "0" is dropped and defaultCallingCode is added.
+func normalizePhone(value string) (string, error) {
+	var digits strings.Builder
+	international := false
+	for i, r := range strings.TrimSpace(value) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+			international = true
+		case strings.ContainsRune(" -.()", r):
+		default:
+			return "", errInvalidPhone
+		}
+	}
+	number := digits.String()
+	switch {
+	case international:
+	case strings.HasPrefix(number, "00"):
+		number = number[2:]
+	default:
+		number = defaultCallingCode + strings.TrimPrefix(number, "0")
+	}
+	// E.164 allows at most 15 digits; shorter than 8 is not a real number.
+	if len(number) < 8 || len(number) > 15 || number[0] == '0' {
+		return "", errInvalidPhone
+	}
+	return "+" + number, nil
+}
+
+// normalizeEmail lower-cases a bare email address, rejecting display names
+// and anything mail.ParseAddress does not accept.
+func normalizeEmail(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Address != value {
+		return "", errInvalidEmail
+	}
+	if at := strings.LastIndex(value, "@"); !strings.Contains(value[at:], ".") {
+		return "", errInvalidEmail
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+// normalizeStoredPhones rewrites donor and recipient phone numbers saved
+// before validation existed. Numbers that cannot be converted are left as
+// they are and logged.
+func normalizeStoredPhones(db *sql.DB) error {
+	for _, table := range []string{"donors", "recipients"} {
+		rows, err := db.Query(fmt.Sprintf("SELECT id, phone FROM %s WHERE phone IS NOT NULL AND phone != '' AND phone NOT LIKE '+%%'", table))
+		if err != nil {
+			return err
+		}
+		updates := map[int]string{}
+		for rows.Next() {
+			var id int
+			var phone string
+			if err := rows.Scan(&id, &phone); err != nil {
+				rows.Close()
+				return err
+			}
+			normalized, err := normalizePhone(phone)
+			if err != nil {
+				log.Printf("%s %d: phone %q is not a valid number; left unchanged", table, id, phone)
+				continue
+			}
+			updates[id] = normalized
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for id, phone := range updates {
+			if _, err := db.Exec(fmt.Sprintf("UPDATE %s SET phone = ? WHERE id = ?", table), phone, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"time"
+)
+
+// dateLayout is used for calendar dates such as expiry dates. Moments in
+// time, such as when a record was created or deleted, are stored as RFC 3339
+// timestamps with the server's UTC offset.
+const dateLayout = "2006-01-02"
+
+func nowTimestamp() string {
+	return time.Now().Format(time.RFC3339)
+}
+
+func todayDate() string {
+	return time.Now().Format(dateLayout)
+}
+
+// parseDate accepts only a YYYY-MM-DD calendar date.
+func parseDate(value string) (time.Time, error) {
+	return time.ParseInLocation(dateLayout, value, time.Local)
+}
+
+// legacyLayouts are the formats found in older databases, tried in order
+// when normalizing stored dates.
+var legacyLayouts = []string{
+	time.RFC3339,
+	dateLayout,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006/01/02",
+	"02/01/2006",
+	"02-01-2006",
+	"2 Jan 2006",
+	"Jan 2, 2006",
+}
+
+func parseLegacyDate(value string) (time.Time, bool) {
+	for _, layout := range legacyLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// templateFuncs format stored dates and timestamps for display.
+var templateFuncs = template.FuncMap{
+	"date": func(value string) string {
+		if t, ok := parseLegacyDate(value); ok {
+			return t.Format(dateLayout)
+		}
+		return value
+	},
+	"datetime": func(value string) string {
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t.Format("2006-01-02 15:04")
+		}
+		return value
+	},
+}
+
+// dateColumns lists every stored date. Timestamp columns hold RFC 3339
+// values; the rest hold calendar dates.
+var dateColumns = []struct {
+	table     string
+	column    string
+	timestamp bool
+}{
+	{"donors", "created_at", true},
+	{"donors", "date_of_birth", false},
+	{"donors", "deleted_at", true},
+	{"recipients", "created_at", true},
+	{"recipients", "deleted_at", true},
+	{"donations", "donation_date", false},
+	{"donations", "expiry_date", false},
+	{"donations", "deleted_at", true},
+	{"inventory", "deleted_at", true},
+	{"requests", "request_date", true},
+	{"requests", "deleted_at", true},
+	{"issues", "issue_date", true},
+	{"returns", "return_date", true},
+	{"discards", "discard_date", true},
+	{"donation_revisions", "old_expiry_date", false},
+	{"donation_revisions", "new_expiry_date", false},
+	{"donation_revisions", "revised_at", true},
+}
+
+// normalizeDates rewrites stored dates into the current formats. Values that
+// cannot be parsed are replaced: a donation's expiry is recomputed from its
+// donation date and component shelf life, an unknown date of birth is
+// cleared, and anything else is set to now. Each replacement is logged so it
+// can be reviewed.
+func normalizeDates(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var badExpiry []int
+	changed := 0
+	for _, c := range dateColumns {
+		rows, err := tx.Query(fmt.Sprintf("SELECT id, %s FROM %s WHERE %[1]s IS NOT NULL", c.column, c.table))
+		if err != nil {
+			return err
+		}
+		updates := map[int]any{}
+		for rows.Next() {
+			var id int
+			var value string
+			if err := rows.Scan(&id, &value); err != nil {
+				rows.Close()
+				return err
+			}
+			t, ok := parseLegacyDate(value)
+			if !ok {
+				if c.table == "donations" && c.column == "expiry_date" {
+					badExpiry = append(badExpiry, id)
+					continue
+				}
+				if c.column == "date_of_birth" {
+					log.Printf("%s %d: invalid %s %q cleared", c.table, id, c.column, value)
+					updates[id] = nil
+					continue
+				}
+				log.Printf("%s %d: invalid %s %q replaced with the current time", c.table, id, c.column, value)
+				t = time.Now()
+			}
+			normalized := t.Format(dateLayout)
+			if c.timestamp {
+				normalized = t.Format(time.RFC3339)
+			}
+			if normalized != value {
+				updates[id] = normalized
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for id, value := range updates {
+			if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE id = ?", c.table, c.column), value, id); err != nil {
+				return err
+			}
+		}
+		changed += len(updates)
+	}
+
+	for _, id := range badExpiry {
+		var expiry string
+		err := tx.QueryRow(`
+			SELECT date(d.donation_date, '+' || c.shelf_life_days || ' days')
+			FROM donations d
+			JOIN components c ON c.id = d.component_id
+			WHERE d.id = ?
+		`, id).Scan(&expiry)
+		if err != nil {
+			return err
+		}
+		log.Printf("donations %d: invalid expiry_date replaced with %s from shelf life", id, expiry)
+		if _, err := tx.Exec("UPDATE donations SET expiry_date = ? WHERE id = ?", expiry, id); err != nil {
+			return err
+		}
+		changed++
+	}
+	if changed > 0 {
+		log.Printf("normalized %d stored dates", changed)
+	}
+
+	var outOfRange int
+	err = tx.QueryRow(`
+		SELECT COUNT(*)
+		FROM donations d
+		JOIN components c ON c.id = d.component_id
+		WHERE d.deleted_at IS NULL
+			AND (d.expiry_date <= d.donation_date
+				OR d.expiry_date > date(d.donation_date, '+' || c.shelf_life_days || ' days'))
+	`).Scan(&outOfRange)
+	if err != nil {
+		return err
+	}
+	if outOfRange > 0 {
+		log.Printf("%d donations have an expiry outside their component's shelf life; review and correct them", outOfRange)
+	}
+	return tx.Commit()
+}
+
+// checkExpiry requires an expiry after the donation date and no later than
+// the component's shelf life allows.
+func checkExpiry(errs FieldErrors, field string, donated time.Time, expiry time.Time, shelfLifeDays int) {
+	if !expiry.After(donated) {
+		errs.add(field, "Expiry must be after the donation date.")
+		return
+	}
+	if latest := donated.AddDate(0, 0, shelfLifeDays); expiry.After(latest) {
+		errs.add(field, fmt.Sprintf("Expiry is beyond the %d-day shelf life (latest %s).", shelfLifeDays, latest.Format(dateLayout)))
+	}
+}
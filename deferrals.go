@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+// deferralReasons are offered when deferring a donor; any other reason can
+// be typed in.
+var deferralReasons = []string{
+	"Low hemoglobin",
+	"Low weight",
+	"Blood pressure out of range",
+	"Recent illness or fever",
+	"Medication",
+	"Recent tattoo or piercing",
+	"Travel to a malaria area",
+	"Failed screening test",
+}
+
+// Deferral records that a donor was turned away. An empty DeferredUntil
+// means the deferral is permanent; otherwise the donor may give again on
+// that date.
+type Deferral struct {
+	ID            int    `json:"id"`
+	DonorID       int    `json:"donor_id"`
+	DonorName     string `json:"donor_name"`
+	CampID        int    `json:"camp_id"`
+	Reason        string `json:"reason"`
+	DeferredUntil string `json:"deferred_until"`
+	DeferralDate  string `json:"deferral_date"`
+}
+
+func (d Deferral) Period() string {
+	if d.DeferredUntil == "" {
+		return "permanently"
+	}
+	return "until " + d.DeferredUntil
+}
+
+func registerDeferralRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/deferrals", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		in, form := deferralForm(r)
+		// Deferrals are recorded from a camp's page or a donor's page, and
+		// errors are shown where the form was submitted.
+		fail := func(msg string) {
+			if in.CampID != 0 {
+				renderCamp(w, tmpl, db, in.CampID, Form{}, form, msg)
+				return
+			}
+			renderDonor(w, tmpl, r, db, in.DonorID, form, msg)
+		}
+		errs, err := in.Validate(db)
+		if err != nil {
+			fail("Could not record deferral.")
+			return
+		}
+		form.Merge(errs)
+		if !form.Valid() {
+			fail("Please correct the highlighted fields.")
+			return
+		}
+		if err := createDeferral(db, in); err != nil {
+			fail("Could not record deferral.")
+			return
+		}
+		if in.CampID != 0 {
+			http.Redirect(w, r, fmt.Sprintf("/camps/%d", in.CampID), http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/donors/%d", in.DonorID), http.StatusSeeOther)
+	})
+}
+
+// createDeferral records a deferral. One made at a camp also counts the donor
+// as having attended it.
+func createDeferral(db *sql.DB, in DeferralInput) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := nowTimestamp()
+	if _, err := tx.Exec(
+		"INSERT INTO deferrals (donor_id, camp_id, reason, deferred_until, deferral_date) VALUES (?, ?, ?, ?, ?)",
+		in.DonorID, nullIfZero(in.CampID), in.Reason, nullIfEmpty(in.DeferredUntil), now,
+	); err != nil {
+		return err
+	}
+	if in.CampID != 0 {
+		if err := registerCampDonor(tx, in.CampID, in.DonorID, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// activeDeferral returns the deferral that stops a donor giving blood on the
+// given date, or nil if they may donate.
+func activeDeferral(db querier, donorID int, date string) (*Deferral, error) {
+	var d Deferral
+	var until sql.NullString
+	var campID sql.NullInt64
+	err := db.QueryRow(`
+		SELECT id, donor_id, camp_id, reason, deferred_until, deferral_date
+		FROM deferrals
+		WHERE donor_id = ? AND (deferred_until IS NULL OR deferred_until > ?)
+		ORDER BY deferred_until IS NULL DESC, deferred_until DESC
+		LIMIT 1
+	`, donorID, date).Scan(&d.ID, &d.DonorID, &campID, &d.Reason, &until, &d.DeferralDate)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.CampID = int(campID.Int64)
+	d.DeferredUntil = until.String
+	return &d, nil
+}
+
+func loadDonorDeferrals(db *sql.DB, donorID int) ([]Deferral, error) {
+	rows, err := db.Query(`
+		SELECT id, donor_id, COALESCE(camp_id, 0), reason, COALESCE(deferred_until, ''), deferral_date
+		FROM deferrals
+		WHERE donor_id = ?
+		ORDER BY deferral_date DESC, id DESC
+	`, donorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deferrals []Deferral
+	for rows.Next() {
+		var d Deferral
+		if err := rows.Scan(&d.ID, &d.DonorID, &d.CampID, &d.Reason, &d.DeferredUntil, &d.DeferralDate); err != nil {
+			return nil, err
+		}
+		deferrals = append(deferrals, d)
+	}
+	return deferrals, rows.Err()
+}
+
+// nullIfZero stores an optional reference as NULL rather than 0.
+func nullIfZero(id int) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
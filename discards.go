@@ -0,0 +1,270 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// discardReasons are the accepted reasons for taking units out of stock
+// without issuing them.
+var discardReasons = []string{
+	"Expired",
+	"Broken bag",
+	"Reactive screening",
+	"Cold-chain breach",
+	"Clotted",
+	"Underweight",
+}
+
+type Discard struct {
+	ID          int
+	DonationID  int
+	DonorName   string
+	BloodType   string
+	Component   string
+	Units       int
+	Reason      string
+	Staff       string
+	DiscardDate string
+}
+
+type DiscardsData struct {
+	Donations []Donation
+	Reasons   []string
+	Discards  []Discard
+	Message   string
+}
+
+// WastageRow is the units discarded for one month, blood type, component and
+// reason.
+type WastageRow struct {
+	Month     string
+	BloodType string
+	Component string
+	Reason    string
+	Units     int
+}
+
+type WastageTotal struct {
+	Label string
+	Units int
+}
+
+type WastageData struct {
+	From     string
+	To       string
+	Rows     []WastageRow
+	ByReason []WastageTotal
+	ByType   []WastageTotal
+	Total    int
+	Message  string
+}
+
+func registerDiscardRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/discards", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			renderDiscards(w, tmpl, db, "")
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		donationID, _ := strconv.Atoi(r.FormValue("donation_id"))
+		units, _ := strconv.Atoi(r.FormValue("units"))
+		reason := strings.TrimSpace(r.FormValue("reason"))
+		staff := strings.TrimSpace(r.FormValue("staff"))
+		if donationID == 0 || units <= 0 || staff == "" {
+			renderDiscards(w, tmpl, db, "Discard requires donation, units, reason, and staff name.")
+			return
+		}
+		if !slices.Contains(discardReasons, reason) {
+			renderDiscards(w, tmpl, db, "Choose a valid discard reason.")
+			return
+		}
+		ok, err := discardUnits(db, donationID, units, reason, staff)
+		if err != nil {
+			renderDiscards(w, tmpl, db, "Could not discard units.")
+			return
+		}
+		if !ok {
+			renderDiscards(w, tmpl, db, "Donation does not have that many units in stock.")
+			return
+		}
+		http.Redirect(w, r, "/discards", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/wastage", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data := WastageData{
+			From: validDate(strings.TrimSpace(r.FormValue("from"))),
+			To:   validDate(strings.TrimSpace(r.FormValue("to"))),
+		}
+		rows, err := loadWastage(db, data.From, data.To)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		data.Rows = rows
+		data.ByReason = totalWastage(rows, func(row WastageRow) string { return row.Reason })
+		data.ByType = totalWastage(rows, func(row WastageRow) string { return row.BloodType + " " + row.Component })
+		for _, row := range rows {
+			data.Total += row.Units
+		}
+		if err := tmpl.ExecuteTemplate(w, "wastage.html", data); err != nil {
+			log.Println("template error:", err)
+		}
+	})
+}
+
+func renderDiscards(w http.ResponseWriter, tmpl *template.Template, db *sql.DB, msg string) {
+	data := DiscardsData{Reasons: discardReasons, Message: msg}
+	donations, err := loadDonations(db)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	for _, d := range donations {
+		if d.RemainingUnits > 0 {
+			data.Donations = append(data.Donations, d)
+		}
+	}
+	if data.Discards, err = loadDiscards(db); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, "discards.html", data); err != nil {
+		log.Println("template error:", err)
+	}
+}
+
+// discardUnits removes units of a donation from stock and records why. It
+// reports false when the donation does not have enough units left.
+func discardUnits(db *sql.DB, donationID int, units int, reason string, staff string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var remaining int
+	var bloodTypeID int
+	err = tx.QueryRow(`
+		SELECT COALESCE(d.remaining_units, 0), donors.blood_type_id
+		FROM donations d
+		JOIN donors ON donors.id = d.donor_id
+		WHERE d.id = ? AND d.deleted_at IS NULL
+	`, donationID).Scan(&remaining, &bloodTypeID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if remaining < units {
+		return false, nil
+	}
+	if _, err := tx.Exec("UPDATE donations SET remaining_units = remaining_units - ? WHERE id = ?", units, donationID); err != nil {
+		return false, err
+	}
+	ok, err := consumeInventoryByTypeID(tx, bloodTypeID, units)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := recordDiscard(tx, donationID, units, reason, staff); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// recordDiscard logs wasted units. It does not touch inventory, so it is also
+// used for returned units that never went back into stock.
+func recordDiscard(db querier, donationID int, units int, reason string, staff string) error {
+	_, err := db.Exec(
+		"INSERT INTO discards (donation_id, units, reason, staff, discard_date) VALUES (?, ?, ?, ?, ?)",
+		donationID, units, reason, staff, nowTimestamp(),
+	)
+	return err
+}
+
+func loadDiscards(db *sql.DB) ([]Discard, error) {
+	rows, err := db.Query(`
+		SELECT x.id, x.donation_id, donors.name, bt.type, c.name, x.units, x.reason, x.staff, x.discard_date
+		FROM discards x
+		JOIN donations d ON d.id = x.donation_id
+		JOIN donors ON donors.id = d.donor_id
+		JOIN blood_types bt ON bt.id = donors.blood_type_id
+		JOIN components c ON c.id = d.component_id
+		ORDER BY x.id DESC
+		LIMIT 50
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var discards []Discard
+	for rows.Next() {
+		var x Discard
+		if err := rows.Scan(&x.ID, &x.DonationID, &x.DonorName, &x.BloodType, &x.Component, &x.Units, &x.Reason, &x.Staff, &x.DiscardDate); err != nil {
+			return nil, err
+		}
+		discards = append(discards, x)
+	}
+	return discards, rows.Err()
+}
+
+// loadWastage groups discarded units by month, blood type, component and
+// reason. Empty bounds leave the date range open.
+func loadWastage(db *sql.DB, from string, to string) ([]WastageRow, error) {
+	rows, err := db.Query(`
+		SELECT substr(x.discard_date, 1, 7), bt.type, c.name, x.reason, SUM(x.units)
+		FROM discards x
+		JOIN donations d ON d.id = x.donation_id
+		JOIN donors ON donors.id = d.donor_id
+		JOIN blood_types bt ON bt.id = donors.blood_type_id
+		JOIN components c ON c.id = d.component_id
+		WHERE (? = '' OR x.discard_date >= ?) AND (? = '' OR x.discard_date < date(?, '+1 day'))
+		GROUP BY 1, 2, 3, 4
+		ORDER BY 1 DESC, 2, 3, 4
+	`, from, from, to, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var wastage []WastageRow
+	for rows.Next() {
+		var row WastageRow
+		if err := rows.Scan(&row.Month, &row.BloodType, &row.Component, &row.Reason, &row.Units); err != nil {
+			return nil, err
+		}
+		wastage = append(wastage, row)
+	}
+	return wastage, rows.Err()
+}
+
+func totalWastage(rows []WastageRow, key func(WastageRow) string) []WastageTotal {
+	var totals []WastageTotal
+	index := map[string]int{}
+	for _, row := range rows {
+		label := key(row)
+		i, ok := index[label]
+		if !ok {
+			i = len(totals)
+			index[label] = i
+			totals = append(totals, WastageTotal{Label: label})
+		}
+		totals[i].Units += row.Units
+	}
+	slices.SortFunc(totals, func(a, b WastageTotal) int { return b.Units - a.Units })
+	return totals
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Donor numbers look like "D00000018": the letter D, the donor's id padded
+// to seven digits, and a Luhn check digit. It catches any single mistyped
+// digit and most swaps of neighbouring digits before the number is looked
+// up, but not 09 typed as 90 or the reverse.
+const donorNumberPrefix = "D"
+
+var errDonorNumber = errors.New("invalid donor number")
+
+type DonorCardData struct {
+	Donor   Donor
+	Barcode template.HTML
+	Message string
+}
+
+func formatDonorNumber(id int) string {
+	digits := fmt.Sprintf("%07d", id)
+	return donorNumberPrefix + digits + strconv.Itoa(luhnCheckDigit(digits))
+}
+
+// parseDonorNumber accepts a donor number as typed or scanned, ignoring case,
+// spaces and dashes, and returns it in canonical form.
+func parseDonorNumber(value string) (string, error) {
+	value = strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(value)))
+	digits := strings.TrimPrefix(value, donorNumberPrefix)
+	if len(digits) < 8 || digitRun(digits) != len(digits) {
+		return "", errDonorNumber
+	}
+	body, check := digits[:len(digits)-1], int(digits[len(digits)-1]-'0')
+	if luhnCheckDigit(body) != check {
+		return "", errDonorNumber
+	}
+	return donorNumberPrefix + digits, nil
+}
+
+func luhnCheckDigit(digits string) int {
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if (len(digits)-1-i)%2 == 0 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return (10 - sum%10) % 10
+}
+
+// assignDonorNumbers gives a donor number to donors registered before donor
+// numbers existed.
+func assignDonorNumbers(db *sql.DB) error {
+	ids, err := queryIDs(db, "SELECT id FROM donors WHERE donor_number IS NULL")
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := db.Exec("UPDATE donors SET donor_number = ? WHERE id = ?", formatDonorNumber(id), id); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		log.Printf("assigned donor numbers to %d donors", len(ids))
+	}
+	return nil
+}
+
+// findDonorByNumber returns the id of the active donor with the given donor
+// number, or zero if there is none.
+func findDonorByNumber(db querier, number string) (int, error) {
+	var id int
+	err := db.QueryRow("SELECT id FROM donors WHERE donor_number = ?", number).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return activeDonorID(db, id)
+}
+
+// activeDonorID follows merges from a donor to the surviving record, so an
+// old card still finds the donor. It returns zero if that donor is deleted.
+func activeDonorID(db querier, id int) (int, error) {
+	var deleted bool
+	var mergedInto sql.NullInt64
+	err := db.QueryRow("SELECT deleted_at IS NOT NULL, merged_into FROM donors WHERE id = ?", id).Scan(&deleted, &mergedInto)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if mergedInto.Valid {
+		return activeDonorID(db, int(mergedInto.Int64))
+	}
+	if deleted {
+		return 0, nil
+	}
+	return id, nil
+}
+
+func registerDonorCardRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/donors/{id}/card", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		donor, ok := loadDonorData(w, db, id, "")
+		if !ok {
+			return
+		}
+		if !isAdmin(r) {
+			donor.Donor = donor.Donor.Masked()
+		}
+		barcode, err := barcodeSVG(donor.Donor.DonorNumber)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		renderPage(w, tmpl, "donor_card.html", DonorCardData{Donor: donor.Donor, Barcode: barcode})
+	})
+
+	mux.HandleFunc("/donors/{id}/card.pdf", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		donor, ok := loadDonorData(w, db, id, "")
+		if !ok {
+			return
+		}
+		if !isAdmin(r) {
+			donor.Donor = donor.Donor.Masked()
+		}
+		doc, err := donorCardPDF(donor.Donor)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		var buf bytes.Buffer
+		if _, err := doc.WriteTo(&buf); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="donor-%s.pdf"`, donor.Donor.DonorNumber))
+		w.Write(buf.Bytes())
+	})
+
+	mux.HandleFunc("/donors/lookup", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		number, err := parseDonorNumber(r.FormValue("number"))
+		if err != nil {
+			renderDonorList(w, tmpl, r, db, nil, Form{}, nil, "Donor number is not valid; check it and scan or type it again.")
+			return
+		}
+		id, err := findDonorByNumber(db, number)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if id == 0 {
+			renderDonorList(w, tmpl, r, db, nil, Form{}, nil, "No donor has number "+number+".")
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/donors/%d", id), http.StatusSeeOther)
+	})
+}
+
+// donorCardPDF lays out a donor card at ID-1 size (85.6 x 54 mm), the size
+// of a bank card.
+func donorCardPDF(d Donor) (*pdfDoc, error) {
+	doc := newPDF(85.6*mm, 54*mm)
+	doc.AddPage()
+	doc.Text(5*mm, 8*mm, 8, true, "BLOOD DONOR CARD")
+	doc.Text(5*mm, 12*mm, 6, false, "Blood Bank Management")
+	doc.Text(80.6*mm-doc.TextWidth(22, d.BloodType), 14*mm, 22, true, d.BloodType)
+	doc.Line(5*mm, 17*mm, 80.6*mm, 17*mm)
+	doc.Text(5*mm, 23*mm, 10, true, d.Name)
+	doc.Text(5*mm, 28*mm, 7, false, "Donor number "+d.DonorNumber)
+	if d.DateOfBirth != "" {
+		doc.Text(5*mm, 32*mm, 7, false, "Born "+d.DateOfBirth)
+	}
+	if err := doc.Barcode(5*mm, 35*mm, 50*mm, 11*mm, d.DonorNumber); err != nil {
+		return nil, err
+	}
+	doc.Text(5*mm, 50*mm, 7, false, d.DonorNumber)
+	return doc, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestLuhnCheckDigit(t *testing.T) {
+	tests := []struct {
+		digits string
+		want   int
+	}{
+		{"7992739871", 3},
+		{"0000000", 0},
+		{"0000001", 8},
+		{"0000018", 2},
+		{"1234567", 4},
+		{"9999999", 7},
+	}
+	for _, tt := range tests {
+		if got := luhnCheckDigit(tt.digits); got != tt.want {
+			t.Errorf("luhnCheckDigit(%q) = %d, want %d", tt.digits, got, tt.want)
+		}
+	}
+}
+
+func TestParseDonorNumber(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"D00000018", "D00000018", true},
+		{" d0000-0018 ", "D00000018", true},
+		{"00000018", "D00000018", true},
+		{"D00000017", "", false},
+		{"D00000109", "D00000109", true},
+		{"D00000019", "", false},
+		// Luhn cannot tell 09 from 90.
+		{"D00000091", "D00000091", true},
+		{"D00000901", "D00000901", true},
+		{"D0000001", "", false},
+		{"D0000001X", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, err := parseDonorNumber(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseDonorNumber(%q) = %q, %v; want %q, ok %v", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFormatDonorNumber(t *testing.T) {
+	tests := []struct {
+		id   int
+		want string
+	}{
+		{1, "D00000018"},
+		{18, "D00000182"},
+		{1234567, "D12345674"},
+	}
+	for _, tt := range tests {
+		if got := formatDonorNumber(tt.id); got != tt.want {
+			t.Errorf("formatDonorNumber(%d) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// exportFlushRows is how many rows are written between flushes to the
+// client.
+const exportFlushRows = 500
+
+// exportSpec is a list that can be exported, with a heading for each of
+// its columns.
+type exportSpec struct {
+	name    string
+	list    listSpec
+	headers []string
+}
+
+var inventoryList = listSpec{
+	columns:   "i.id, bt.type, i.units",
+	from:      "inventory i JOIN blood_types bt ON bt.id = i.blood_type_id",
+	where:     "i.deleted_at IS NULL",
+	id:        "i.id",
+	bloodType: "bt.type",
+	sorts:     withSorts(map[string]sortSpec{"blood_type": {column: "bt.type"}}),
+}
+
+// revisionList is the audit log of donation voids, corrections and
+// restores. The status filter picks an action.
+var revisionList = listSpec{
+	columns:    "r.id, r.donation_id, COALESCE(d.din, ''), r.action, r.old_units, r.new_units, r.old_expiry_date, r.new_expiry_date, r.reason, r.revised_at",
+	from:       "donation_revisions r JOIN donations d ON d.id = r.donation_id",
+	id:         "r.id",
+	search:     []string{"d.din", "r.reason"},
+	dateColumn: "r.revised_at",
+	status:     "r.action",
+	donor:      "d.donor_id",
+	sorts:      withSorts(nil),
+}
+
+var exportSpecs = []exportSpec{
+	{"donors", donorList, []string{"id", "donor_number", "name", "blood_type", "phone", "city", "email", "date_of_birth", "created_at"}},
+	{"recipients", recipientList, []string{"id", "name", "blood_type", "phone", "hospital", "created_at"}},
+	{"donations", donationList, []string{"id", "din", "donor_id", "donor_name", "blood_type", "component", "units", "remaining_units", "donation_date", "expiry_date", "camp_id", "camp"}},
+	{"requests", requestList, []string{"id", "recipient_id", "recipient_name", "blood_type", "units", "issued_units", "status", "request_date"}},
+	{"inventory", inventoryList, []string{"id", "blood_type", "units"}},
+	{"audit", revisionList, []string{"id", "donation_id", "din", "action", "old_units", "new_units", "old_expiry_date", "new_expiry_date", "reason", "revised_at"}},
+}
+
+// sensitiveFields are masked in exports for staff who are not admins, as
+// they are on the pages and in the API.
+var sensitiveFields = map[string]func(string) string{
+	"phone":         maskPhone,
+	"email":         maskEmail,
+	"date_of_birth": maskDate,
+}
+
+func registerExportRoutes(mux *http.ServeMux, db *sql.DB) {
+	mux.HandleFunc("/export/{entity}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var spec exportSpec
+		for _, s := range exportSpecs {
+			if s.name == r.PathValue("entity") {
+				spec = s
+			}
+		}
+		if spec.name == "" {
+			http.NotFound(w, r)
+			return
+		}
+		format := r.FormValue("format")
+		if format == "" {
+			format = "csv"
+		}
+		if format != "csv" && format != "json" && format != "xlsx" {
+			http.Error(w, "format must be csv, json or xlsx", http.StatusBadRequest)
+			return
+		}
+
+		// The export covers the whole filtered list, not one page of it.
+		f := parseListFilter(r.URL.Query())
+		f.After = ""
+		query, args, err := listQuery(spec.list, f)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		filename := fmt.Sprintf("%s-%s.%s", spec.name, todayDate(), format)
+		w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+		if err := writeExport(w, rows, spec, format, !isAdmin(r)); err != nil {
+			// The response has started, so the download is cut short.
+			log.Println("export error:", err)
+		}
+	})
+}
+
+// exportWriter writes exported rows in one format.
+type exportWriter interface {
+	Write(record []string) error
+	Close() error
+}
+
+// writeExport streams rows to the client as they are read, so large lists
+// are never held in memory. mask hides sensitive fields.
+func writeExport(w http.ResponseWriter, rows *sql.Rows, spec exportSpec, format string, mask bool) error {
+	var out exportWriter
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		out = &jsonExportWriter{w: w, headers: spec.headers}
+	case "xlsx":
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		x, err := newXLSXWriter(w, spec.name)
+		if err != nil {
+			return err
+		}
+		out = x
+	default:
+		w.Header().Set("Content-Type", "text/csv")
+		out = &csvExportWriter{csv.NewWriter(w)}
+	}
+	if format != "json" {
+		if err := out.Write(spec.headers); err != nil {
+			return err
+		}
+	}
+
+	flusher, _ := w.(http.Flusher)
+	// The query returns the list's columns followed by its cursor columns.
+	values := make([]sql.NullString, len(spec.headers)+2)
+	dest := make([]any, len(values))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	record := make([]string, len(spec.headers))
+	for n := 1; rows.Next(); n++ {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		for i, field := range spec.headers {
+			record[i] = values[i].String
+			if maskField, ok := sensitiveFields[field]; ok && mask {
+				record[i] = maskField(record[i])
+			}
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+		if n%exportFlushRows == 0 && flusher != nil && format != "xlsx" {
+			flusher.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// csvExportWriter writes CSV that is safe to open in a spreadsheet: a cell
+// starting with a character that begins a formula is prefixed with ', so it
+// is shown as text rather than run. Plain numbers, such as phone numbers
+// in E.164 form, are left as they are.
+type csvExportWriter struct {
+	*csv.Writer
+}
+
+func (c *csvExportWriter) Write(record []string) error {
+	safe := make([]string, len(record))
+	for i, value := range record {
+		safe[i] = value
+		if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) && !isSignedNumber(value) {
+			safe[i] = "'" + value
+		}
+	}
+	return c.Writer.Write(safe)
+}
+
+func (c *csvExportWriter) Close() error {
+	c.Flush()
+	return c.Error()
+}
+
+// isSignedNumber reports whether value is a sign followed by a number.
+func isSignedNumber(value string) bool {
+	digits := value[1:]
+	return digits != "" && strings.Trim(digits, "0123456789.") == ""
+}
+
+// jsonExportWriter writes rows as an array of objects keyed by heading.
+// Whole numbers are written as numbers.
+type jsonExportWriter struct {
+	w       io.Writer
+	headers []string
+	rows    int
+}
+
+func (j *jsonExportWriter) Write(record []string) error {
+	var b strings.Builder
+	if j.rows == 0 {
+		b.WriteString("[\n")
+	} else {
+		b.WriteString(",\n")
+	}
+	j.rows++
+	b.WriteString("{")
+	for i, value := range record {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		key, _ := json.Marshal(j.headers[i])
+		b.Write(key)
+		b.WriteString(":")
+		if n, err := strconv.Atoi(value); err == nil && strconv.Itoa(n) == value {
+			b.WriteString(value)
+		} else {
+			v, _ := json.Marshal(value)
+			b.Write(v)
+		}
+	}
+	b.WriteString("}")
+	_, err := io.WriteString(j.w, b.String())
+	return err
+}
+
+func (j *jsonExportWriter) Close() error {
+	end := "\n]\n"
+	if j.rows == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(j.w, end)
+	return err
+}
+
+// ExportURL links to an export of the list with the same filters.
+func (f ListFilter) ExportURL(entity string, format string) string {
+	v := url.Values{}
+	set := func(key, value string) {
+		if value != "" && value != "0" {
+			v.Set(key, value)
+		}
+	}
+	set("q", f.Query)
+	set("blood_type", f.BloodType)
+	set("status", f.Status)
+	set("donor_id", strconv.Itoa(f.DonorID))
+	set("recipient_id", strconv.Itoa(f.RecipientID))
+	set("camp_id", strconv.Itoa(f.CampID))
+	set("from", f.From)
+	set("to", f.To)
+	set("sort", f.Sort)
+	v.Set("format", format)
+	return "/export/" + entity + "?" + v.Encode()
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	// forecastWindowWeeks is how many recent weeks the moving average of
+	// demand and donations covers.
+	forecastWindowWeeks = 8
+	// forecastHorizonWeeks is how far ahead stock is projected.
+	forecastHorizonWeeks = 4
+	// maxSupplyDays caps days of supply; stock lasting longer shows as 90+.
+	maxSupplyDays = 90
+	// seasonalWeeks is the offset of the same weeks a year earlier.
+	seasonalWeeks = 52
+)
+
+// Forecast projects the demand and stock of one blood type.
+//
+// Weekly demand is the moving average of units requested over the last
+// forecastWindowWeeks weeks. When there is history from a year ago, it is
+// scaled by how the coming weeks compared with the weeks before them last
+// year, so seasonal peaks carry over. Donations are forecast the same way.
+// Days of supply is how long unexpired stock meets forecast demand with no
+// new donations, issuing the earliest expiry first and losing units as they
+// expire.
+type Forecast struct {
+	BloodType       string           `json:"blood_type"`
+	History         []int            `json:"weekly_requested_units"`
+	WeeklyDemand    float64          `json:"weekly_demand"`
+	WeeklyDonations float64          `json:"weekly_donations"`
+	Seasonal        float64          `json:"seasonal_factor"`
+	Stock           int              `json:"stock"`
+	Expiring        int              `json:"expiring_units"`
+	DaysOfSupply    int              `json:"days_of_supply"`
+	Weeks           []WeekProjection `json:"weeks"`
+}
+
+// WeekProjection is the expected stock at the end of a coming week.
+type WeekProjection struct {
+	WeekStart string `json:"week_start"`
+	Demand    int    `json:"demand"`
+	Donations int    `json:"donations"`
+	Expired   int    `json:"expired"`
+	Shortfall int    `json:"shortfall"`
+	Stock     int    `json:"stock"`
+}
+
+// SupplyClass is the CSS class that colors a forecast's row: under a week of
+// supply is low, under two weeks short.
+func (f Forecast) SupplyClass() string {
+	switch {
+	case f.DaysOfSupply < 7:
+		return "stock-low"
+	case f.DaysOfSupply < 14:
+		return "stock-short"
+	}
+	return "stock-ok"
+}
+
+func (f Forecast) EndStock() int {
+	if len(f.Weeks) == 0 {
+		return f.Stock
+	}
+	return f.Weeks[len(f.Weeks)-1].Stock
+}
+
+type ForecastData struct {
+	Forecasts []Forecast
+	Message   string
+}
+
+// stockBatch is unexpired stock of one blood type sharing an expiry date.
+type stockBatch struct {
+	expiry string
+	units  float64
+}
+
+func registerForecastRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/forecast", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		forecasts, err := loadForecasts(db, time.Now())
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		renderPage(w, tmpl, "forecast.html", ForecastData{Forecasts: forecasts})
+	})
+
+	mux.HandleFunc("/api/forecast", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		forecasts, err := loadForecasts(db, time.Now())
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "server error")
+			return
+		}
+		writeJSON(w, http.StatusOK, forecasts)
+	})
+}
+
+// loadForecasts forecasts every blood type as of the given day.
+func loadForecasts(db *sql.DB, now time.Time) ([]Forecast, error) {
+	today, err := parseDate(now.Format(dateLayout))
+	if err != nil {
+		return nil, err
+	}
+	historyWeeks := seasonalWeeks + forecastWindowWeeks
+	since := today.AddDate(0, 0, -7*historyWeeks).Format(dateLayout)
+
+	demand, err := weeklyUnits(db, today, historyWeeks, `
+		SELECT bt.type, substr(r.request_date, 1, 10), SUM(r.units)
+		FROM requests r
+		JOIN recipients rec ON rec.id = r.recipient_id
+		JOIN blood_types bt ON bt.id = rec.blood_type_id
+		WHERE r.deleted_at IS NULL AND substr(r.request_date, 1, 10) >= ?
+		GROUP BY 1, 2
+	`, since)
+	if err != nil {
+		return nil, err
+	}
+	donations, err := weeklyUnits(db, today, historyWeeks, `
+		SELECT bt.type, d.donation_date, SUM(d.units)
+		FROM donations d
+		JOIN donors ON donors.id = d.donor_id
+		JOIN blood_types bt ON bt.id = donors.blood_type_id
+		WHERE d.deleted_at IS NULL AND d.donation_date >= ?
+		GROUP BY 1, 2
+	`, since)
+	if err != nil {
+		return nil, err
+	}
+	batches, err := loadStockBatches(db, today.Format(dateLayout))
+	if err != nil {
+		return nil, err
+	}
+
+	horizonEnd := today.AddDate(0, 0, 7*forecastHorizonWeeks).Format(dateLayout)
+	forecasts := make([]Forecast, 0, len(bloodTypes))
+	for _, bt := range bloodTypes {
+		f := Forecast{BloodType: bt, History: make([]int, forecastWindowWeeks)}
+		for i := range f.History {
+			// Oldest first, ending with the current week.
+			f.History[i] = int(weekAt(demand[bt], forecastWindowWeeks-1-i))
+		}
+		f.WeeklyDemand, f.Seasonal = forecastWeekly(demand[bt])
+		f.WeeklyDonations, _ = forecastWeekly(donations[bt])
+		for _, b := range batches[bt] {
+			f.Stock += int(b.units)
+			if b.expiry < horizonEnd {
+				f.Expiring += int(b.units)
+			}
+		}
+		f.DaysOfSupply = daysOfSupply(batches[bt], today, f.WeeklyDemand/7)
+		f.Weeks = projectStock(batches[bt], today, f.WeeklyDemand/7, f.WeeklyDonations/7)
+		forecasts = append(forecasts, f)
+	}
+	return forecasts, nil
+}
+
+// weeklyUnits sums units per blood type into weeks counted back from today:
+// week 0 is the seven days ending today.
+func weeklyUnits(db *sql.DB, today time.Time, weeks int, query string, args ...any) (map[string][]float64, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byType := map[string][]float64{}
+	for rows.Next() {
+		var bt, date string
+		var units int
+		if err := rows.Scan(&bt, &date, &units); err != nil {
+			return nil, err
+		}
+		t, err := parseDate(date)
+		if err != nil {
+			continue
+		}
+		days := int(math.Round(today.Sub(t).Hours() / 24))
+		if days < 0 || days/7 >= weeks {
+			continue
+		}
+		if byType[bt] == nil {
+			byType[bt] = make([]float64, weeks)
+		}
+		byType[bt][days/7] += float64(units)
+	}
+	return byType, rows.Err()
+}
+
+func weekAt(weeks []float64, i int) float64 {
+	if i < 0 || i >= len(weeks) {
+		return 0
+	}
+	return weeks[i]
+}
+
+func averageWeeks(weeks []float64, from int, to int) float64 {
+	var sum float64
+	for i := from; i < to; i++ {
+		sum += weekAt(weeks, i)
+	}
+	return sum / float64(to-from)
+}
+
+// forecastWeekly returns the expected weekly units over the coming horizon
+// and the seasonal factor applied to the moving average.
+func forecastWeekly(weeks []float64) (float64, float64) {
+	average := averageWeeks(weeks, 0, forecastWindowWeeks)
+	// A year ago, the weeks matching the coming horizon are seasonalWeeks
+	// back less the horizon; the window before them matches the recent one.
+	lastYearAhead := averageWeeks(weeks, seasonalWeeks-forecastHorizonWeeks, seasonalWeeks)
+	lastYearBefore := averageWeeks(weeks, seasonalWeeks, seasonalWeeks+forecastWindowWeeks)
+	seasonal := 1.0
+	if lastYearBefore > 0 && lastYearAhead > 0 {
+		seasonal = math.Min(math.Max(lastYearAhead/lastYearBefore, 0.5), 2)
+	}
+	return average * seasonal, seasonal
+}
+
+// loadStockBatches returns unexpired stock per blood type, earliest expiry
+// first.
+func loadStockBatches(db *sql.DB, today string) (map[string][]stockBatch, error) {
+	rows, err := db.Query(`
+		SELECT bt.type, d.expiry_date, SUM(d.remaining_units)
+		FROM donations d
+		JOIN donors ON donors.id = d.donor_id
+		JOIN blood_types bt ON bt.id = donors.blood_type_id
+		WHERE d.deleted_at IS NULL AND d.remaining_units > 0 AND d.expiry_date >= ?
+		GROUP BY 1, 2
+		ORDER BY 2
+	`, today)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batches := map[string][]stockBatch{}
+	for rows.Next() {
+		var bt string
+		var b stockBatch
+		if err := rows.Scan(&bt, &b.expiry, &b.units); err != nil {
+			return nil, err
+		}
+		batches[bt] = append(batches[bt], b)
+	}
+	return batches, rows.Err()
+}
+
+// stockDay is the outcome of one simulated day.
+type stockDay struct {
+	demand    float64
+	donations float64
+	expired   float64
+	shortfall float64
+	stock     float64
+}
+
+// simulateStock runs stock forward day by day from today. Each day units
+// past their expiry are lost, then demand is issued earliest expiry first,
+// then the day's donations are added. Donated units are assumed to outlast
+// the simulation.
+func simulateStock(batches []stockBatch, today time.Time, dailyDemand float64, dailyDonations float64, days int) []stockDay {
+	stock := make([]stockBatch, len(batches))
+	copy(stock, batches)
+	sort.SliceStable(stock, func(i, j int) bool { return stock[i].expiry < stock[j].expiry })
+	var fresh float64
+
+	out := make([]stockDay, days)
+	for d := range out {
+		date := today.AddDate(0, 0, d).Format(dateLayout)
+		day := stockDay{demand: dailyDemand, donations: dailyDonations}
+		for len(stock) > 0 && stock[0].expiry < date {
+			day.expired += stock[0].units
+			stock = stock[1:]
+		}
+		need := dailyDemand
+		for need > 0 && len(stock) > 0 {
+			take := math.Min(need, stock[0].units)
+			stock[0].units -= take
+			need -= take
+			if stock[0].units <= 0 {
+				stock = stock[1:]
+			}
+		}
+		take := math.Min(need, fresh)
+		fresh -= take
+		day.shortfall = need - take
+		fresh += dailyDonations
+		day.stock = fresh
+		for _, b := range stock {
+			day.stock += b.units
+		}
+		out[d] = day
+	}
+	return out
+}
+
+// daysOfSupply is the number of days current stock meets demand with no new
+// donations, up to maxSupplyDays.
+func daysOfSupply(batches []stockBatch, today time.Time, dailyDemand float64) int {
+	for d, day := range simulateStock(batches, today, dailyDemand, 0, maxSupplyDays) {
+		if day.shortfall > 1e-9 {
+			return d
+		}
+	}
+	return maxSupplyDays
+}
+
+// projectStock sums the simulated days into the coming weeks, including
+// forecast donations.
+func projectStock(batches []stockBatch, today time.Time, dailyDemand float64, dailyDonations float64) []WeekProjection {
+	days := simulateStock(batches, today, dailyDemand, dailyDonations, 7*forecastHorizonWeeks)
+	weeks := make([]WeekProjection, forecastHorizonWeeks)
+	for w := range weeks {
+		var demand, donations, expired, shortfall float64
+		for _, day := range days[7*w : 7*w+7] {
+			demand += day.demand
+			donations += day.donations
+			expired += day.expired
+			shortfall += day.shortfall
+		}
+		weeks[w] = WeekProjection{
+			WeekStart: today.AddDate(0, 0, 7*w).Format(dateLayout),
+			Demand:    int(math.Round(demand)),
+			Donations: int(math.Round(donations)),
+			Expired:   int(math.Round(expired)),
+			Shortfall: int(math.Round(shortfall)),
+			Stock:     int(math.Round(days[7*w+6].stock)),
+		}
+	}
+	return weeks
+}
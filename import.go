@@ -0,0 +1,699 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxImportBytes caps the size of an uploaded CSV file.
+	maxImportBytes = 10 << 20
+	// importPreviewRows is how many rows the dry run shows.
+	importPreviewRows = 100
+)
+
+// importSkip maps a field to no column, so it is not matched by heading.
+const importSkip = "-"
+
+var errImportInvalid = errors.New("import has rows with errors")
+
+// importDateFormats are the date layouts an import reads, by the name shown
+// to staff. Dates already written as YYYY-MM-DD are read in any format.
+var importDateFormats = []struct{ Name, layout string }{
+	{"YYYY-MM-DD", dateLayout},
+	{"DD/MM/YYYY", "02/01/2006"},
+	{"MM/DD/YYYY", "01/02/2006"},
+}
+
+// importAliases maps spreadsheet headings, normalized by importKey, to the
+// fields they fill when no column mapping is given.
+var importAliases = map[string]string{
+	"full_name":     "name",
+	"donor_name":    "name",
+	"patient_name":  "name",
+	"blood_group":   "blood_type",
+	"group":         "blood_type",
+	"mobile":        "phone",
+	"phone_number":  "phone",
+	"contact":       "phone",
+	"email_address": "email",
+	"dob":           "date_of_birth",
+	"birth_date":    "date_of_birth",
+	"donor_no":      "donor_number",
+	"donor":         "donor_number",
+	"donor_mobile":  "donor_phone",
+	"date":          "donation_date",
+	"donated_on":    "donation_date",
+	"expiry":        "expiry_date",
+	"expires":       "expiry_date",
+	"quantity":      "units",
+	"qty":           "units",
+	"remaining":     "remaining_units",
+	"product":       "component",
+}
+
+// importKind describes one kind of record that can be imported. check
+// validates and normalizes a row's values; insert saves a valid row.
+type importKind struct {
+	name   string
+	fields []string
+	dates  []string
+	check  func(c *importContext, values map[string]string, row *ImportRow) error
+	insert func(tx *sql.Tx, row ImportRow, bloodTypeIDs map[string]int) error
+}
+
+var importKinds = []importKind{
+	{
+		name:   "donors",
+		fields: []string{"name", "blood_type", "phone", "city", "email", "date_of_birth"},
+		dates:  []string{"date_of_birth"},
+		check:  checkImportedDonor,
+		insert: func(tx *sql.Tx, row ImportRow, bloodTypeIDs map[string]int) error {
+			in := row.input.(DonorInput)
+			_, err := insertDonor(tx, bloodTypeIDs[in.BloodType], in)
+			return err
+		},
+	},
+	{
+		name:   "recipients",
+		fields: []string{"name", "blood_type", "phone", "hospital"},
+		check:  checkImportedRecipient,
+		insert: func(tx *sql.Tx, row ImportRow, bloodTypeIDs map[string]int) error {
+			in := row.input.(RecipientInput)
+			_, err := insertRecipient(tx, bloodTypeIDs[in.BloodType], in)
+			return err
+		},
+	},
+	{
+		name:   "donations",
+		fields: []string{"donor_number", "donor_phone", "component", "units", "remaining_units", "donation_date", "expiry_date"},
+		dates:  []string{"donation_date", "expiry_date"},
+		check:  checkImportedDonation,
+		insert: insertImportedDonation,
+	},
+}
+
+// ImportOptions says how to read a CSV file. Mapping names the column that
+// fills each field, or importSkip for none; fields left out are matched by
+// heading.
+type ImportOptions struct {
+	Kind            string
+	Mapping         map[string]string
+	DateFormat      string
+	AllowDuplicates bool
+}
+
+// ImportRow is one data row of a CSV file. Line is its line in the file
+// and Values its normalized values in field order.
+type ImportRow struct {
+	Line      int
+	Values    []string
+	Errors    FieldErrors
+	input     any
+	bloodType string
+}
+
+// ImportError is one field error of one row.
+type ImportError struct {
+	Line    int
+	Field   string
+	Message string
+}
+
+// ImportResult is a checked CSV file. Mapping is the column used for each
+// field, empty for fields the file does not have.
+type ImportResult struct {
+	Kind    string
+	Fields  []string
+	Headers []string
+	Mapping map[string]string
+	Rows    []ImportRow
+	Errors  []ImportError
+	Invalid int
+}
+
+// importContext is what checking rows needs across a file.
+type importContext struct {
+	db              *sql.DB
+	components      []Component
+	allowDuplicates bool
+	// seen holds the line of each donor or donation already in the file,
+	// so a file listing one twice is caught.
+	seen map[string]int
+}
+
+// importedDonation is a checked historical donation. Remaining is how many
+// of its units are still in stock.
+type importedDonation struct {
+	DonorID      int
+	BloodTypeID  int
+	ComponentID  int
+	Units        int
+	Remaining    int
+	DonationDate string
+	ExpiryDate   string
+}
+
+type ImportData struct {
+	Kinds           []string
+	Kind            string
+	Fields          []string
+	DateFormats     []string
+	DateFormat      string
+	AllowDuplicates bool
+	Data            string
+	Result          *ImportResult
+	Preview         []ImportRow
+	Message         string
+}
+
+func registerImportRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/import", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			data := newImportData(ImportOptions{Kind: r.FormValue("kind")})
+			renderPage(w, tmpl, "import.html", data)
+		case http.MethodPost:
+			r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+			opts := ImportOptions{
+				Kind:            r.FormValue("kind"),
+				DateFormat:      r.FormValue("date_format"),
+				AllowDuplicates: r.FormValue("allow_duplicates") != "",
+				Mapping:         map[string]string{},
+			}
+			data := newImportData(opts)
+			// A new file is matched by heading; the mapping chosen on the
+			// preview applies to the file carried over from it.
+			if file, _, err := r.FormFile("file"); err == nil {
+				b, err := io.ReadAll(file)
+				file.Close()
+				if err != nil {
+					data.Message = "Could not read the file; it must be under 10 MB."
+					renderPage(w, tmpl, "import.html", data)
+					return
+				}
+				data.Data = string(b)
+			} else {
+				data.Data = r.FormValue("data")
+				for _, field := range data.Fields {
+					if header := r.FormValue("map_" + field); header != "" {
+						opts.Mapping[field] = header
+					}
+				}
+			}
+			if strings.TrimSpace(data.Data) == "" {
+				data.Message = "Choose a CSV file to import."
+				renderPage(w, tmpl, "import.html", data)
+				return
+			}
+
+			result, err := checkImport(db, strings.NewReader(data.Data), opts)
+			if err != nil {
+				data.Message = "Could not read the file: " + err.Error() + "."
+				renderPage(w, tmpl, "import.html", data)
+				return
+			}
+			data.Result = &result
+			data.Preview = result.Rows[:min(len(result.Rows), importPreviewRows)]
+			if r.FormValue("action") == "import" {
+				_, err := commitImport(db, result)
+				switch {
+				case err == nil:
+					http.Redirect(w, r, "/"+result.Kind, http.StatusSeeOther)
+					return
+				case errors.Is(err, errImportInvalid):
+					data.Message = "Nothing was imported; fix the rows with errors and upload the file again."
+				default:
+					data.Message = "Could not import; nothing was saved."
+				}
+			} else {
+				data.Message = fmt.Sprintf("Dry run: %d rows, %d with errors. Nothing has been saved yet.", len(result.Rows), result.Invalid)
+			}
+			renderPage(w, tmpl, "import.html", data)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func newImportData(opts ImportOptions) ImportData {
+	kind := findImportKind(opts.Kind)
+	data := ImportData{
+		Kind:            kind.name,
+		Fields:          kind.fields,
+		DateFormat:      opts.DateFormat,
+		AllowDuplicates: opts.AllowDuplicates,
+	}
+	for _, k := range importKinds {
+		data.Kinds = append(data.Kinds, k.name)
+	}
+	for _, f := range importDateFormats {
+		data.DateFormats = append(data.DateFormats, f.Name)
+	}
+	return data
+}
+
+// findImportKind returns the named kind, or donors for an unknown name.
+func findImportKind(name string) importKind {
+	for _, k := range importKinds {
+		if k.name == name {
+			return k
+		}
+	}
+	return importKinds[0]
+}
+
+// importKey normalizes a heading: lower case, with runs of anything but
+// letters and digits as one underscore.
+func importKey(header string) string {
+	var b strings.Builder
+	gap := false
+	for _, r := range strings.ToLower(strings.TrimSpace(header)) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			if gap && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			gap = false
+			b.WriteRune(r)
+		} else {
+			gap = true
+		}
+	}
+	return b.String()
+}
+
+// importDate rewrites a date in the chosen layout as YYYY-MM-DD. Values it
+// cannot read are left for validation to report.
+func importDate(value string, layout string) string {
+	if value == "" || layout == dateLayout {
+		return value
+	}
+	if _, err := parseDate(value); err == nil {
+		return value
+	}
+	if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+		return t.Format(dateLayout)
+	}
+	return value
+}
+
+// checkImport reads a CSV file with a heading row and checks every row
+// without saving anything.
+func checkImport(db *sql.DB, r io.Reader, opts ImportOptions) (ImportResult, error) {
+	kind := findImportKind(opts.Kind)
+	layout := dateLayout
+	for _, f := range importDateFormats {
+		if f.Name == opts.DateFormat {
+			layout = f.layout
+		}
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	headers, err := cr.Read()
+	if err == io.EOF {
+		return ImportResult{}, errors.New("the file is empty")
+	}
+	if err != nil {
+		return ImportResult{}, err
+	}
+	if len(headers) > 0 {
+		headers[0] = strings.TrimPrefix(headers[0], "\ufeff")
+	}
+
+	result := ImportResult{Kind: kind.name, Fields: kind.fields, Headers: headers, Mapping: map[string]string{}}
+	columns := map[string]int{}
+	for _, field := range kind.fields {
+		columns[field] = -1
+		if header, ok := opts.Mapping[field]; ok {
+			if header == importSkip {
+				continue
+			}
+			i := slices.IndexFunc(headers, func(h string) bool { return strings.EqualFold(strings.TrimSpace(h), strings.TrimSpace(header)) })
+			if i < 0 {
+				return ImportResult{}, fmt.Errorf("there is no column %q", header)
+			}
+			columns[field] = i
+			continue
+		}
+		for i, h := range headers {
+			key := importKey(h)
+			if key == field || importAliases[key] == field {
+				columns[field] = i
+				break
+			}
+		}
+	}
+	for field, i := range columns {
+		if i >= 0 {
+			result.Mapping[field] = headers[i]
+		}
+	}
+
+	components, err := loadComponents(db)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	c := &importContext{db: db, components: components, allowDuplicates: opts.AllowDuplicates, seen: map[string]int{}}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ImportResult{}, err
+		}
+		line, _ := cr.FieldPos(0)
+		values := map[string]string{}
+		blank := true
+		for _, field := range kind.fields {
+			if i := columns[field]; i >= 0 && i < len(record) {
+				values[field] = strings.TrimSpace(record[i])
+				blank = blank && values[field] == ""
+			}
+		}
+		if blank {
+			continue
+		}
+		for _, field := range kind.dates {
+			values[field] = importDate(values[field], layout)
+		}
+
+		row := ImportRow{Line: line, Errors: FieldErrors{}}
+		if err := kind.check(c, values, &row); err != nil {
+			return ImportResult{}, err
+		}
+		for _, field := range kind.fields {
+			row.Values = append(row.Values, values[field])
+		}
+		if len(row.Errors) > 0 {
+			result.Invalid++
+			fields := make([]string, 0, len(row.Errors))
+			for field := range row.Errors {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			for _, field := range fields {
+				result.Errors = append(result.Errors, ImportError{Line: line, Field: field, Message: row.Errors[field]})
+			}
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if len(result.Rows) == 0 {
+		return ImportResult{}, errors.New("the file has no rows")
+	}
+	return result, nil
+}
+
+func checkImportedDonor(c *importContext, values map[string]string, row *ImportRow) error {
+	in := DonorInput{
+		Name:        values["name"],
+		BloodType:   values["blood_type"],
+		Phone:       values["phone"],
+		City:        values["city"],
+		Email:       values["email"],
+		DateOfBirth: values["date_of_birth"],
+	}
+	row.Errors = in.Validate()
+	values["blood_type"], values["phone"], values["email"] = in.BloodType, in.Phone, in.Email
+	row.input, row.bloodType = in, in.BloodType
+	if len(row.Errors) > 0 || c.allowDuplicates {
+		return nil
+	}
+
+	key := strings.ToLower(in.Name) + "|" + in.Phone + "|" + in.DateOfBirth
+	if line, ok := c.seen[key]; ok {
+		row.Errors.add("name", fmt.Sprintf("Same donor as line %d.", line))
+		return nil
+	}
+	c.seen[key] = row.Line
+	dups, err := findDuplicateDonors(c.db, in, 0)
+	if err != nil {
+		return err
+	}
+	if len(dups) > 0 {
+		row.Errors.add("name", fmt.Sprintf("Looks like donor %s, who is already registered.", dups[0].DonorNumber))
+	}
+	return nil
+}
+
+func checkImportedRecipient(c *importContext, values map[string]string, row *ImportRow) error {
+	in := RecipientInput{Name: values["name"], BloodType: values["blood_type"], Phone: values["phone"], Hospital: values["hospital"]}
+	row.Errors = in.Validate()
+	values["blood_type"], values["phone"] = in.BloodType, in.Phone
+	row.input, row.bloodType = in, in.BloodType
+	return nil
+}
+
+// checkImportedDonation checks a historical donation. Unlike a donation
+// recorded at the desk, its expiry may be past and deferrals are not
+// checked. The donor is found by donor number or, failing that, by phone.
+func checkImportedDonation(c *importContext, values map[string]string, row *ImportRow) error {
+	errs := row.Errors
+	in := importedDonation{}
+	var err error
+	switch {
+	case values["donor_number"] != "":
+		if in.DonorID, values["donor_number"], err = checkDonor(c.db, errs, 0, values["donor_number"]); err != nil {
+			return err
+		}
+	case values["donor_phone"] != "":
+		phone := checkPhone(errs, "donor_phone", values["donor_phone"])
+		if len(errs) > 0 {
+			break
+		}
+		values["donor_phone"] = phone
+		ids, err := queryIDs(c.db, "SELECT id FROM donors WHERE phone = ? AND deleted_at IS NULL", phone)
+		if err != nil {
+			return err
+		}
+		switch len(ids) {
+		case 0:
+			errs.add("donor_phone", "No donor has this phone number.")
+		case 1:
+			in.DonorID = ids[0]
+		default:
+			errs.add("donor_phone", "Several donors have this phone number; use the donor number.")
+		}
+	default:
+		errs.add("donor_number", "Enter the donor number or the donor's phone.")
+	}
+	if in.DonorID != 0 {
+		if in.BloodTypeID, err = getDonorBloodTypeID(c.db, in.DonorID); err != nil {
+			return err
+		}
+	}
+
+	var component Component
+	if name := values["component"]; name == "" {
+		errs.add("component", "This field is required.")
+	} else if i := slices.IndexFunc(c.components, func(comp Component) bool {
+		return strings.EqualFold(comp.Name, name) || strconv.Itoa(comp.ID) == name
+	}); i < 0 {
+		errs.add("component", "Component not found.")
+	} else {
+		component = c.components[i]
+		in.ComponentID = component.ID
+		values["component"] = component.Name
+	}
+
+	in.Units, err = strconv.Atoi(values["units"])
+	if err != nil {
+		errs.add("units", "Enter a whole number of units.")
+	} else {
+		checkUnits(errs, "units", in.Units)
+	}
+	in.DonationDate = values["donation_date"]
+	donated, donatedOK := checkDate(errs, "donation_date", in.DonationDate)
+	today, _ := parseDate(todayDate())
+	if donatedOK && donated.After(today) {
+		errs.add("donation_date", "Donation date cannot be in the future.")
+	}
+	in.ExpiryDate = values["expiry_date"]
+	if in.ExpiryDate == "" {
+		if donatedOK && component.ID != 0 {
+			in.ExpiryDate = donated.AddDate(0, 0, component.ShelfLifeDays).Format(dateLayout)
+			values["expiry_date"] = in.ExpiryDate
+		}
+	} else if expiry, ok := checkDate(errs, "expiry_date", in.ExpiryDate); ok && donatedOK && component.ID != 0 {
+		checkExpiry(errs, "expiry_date", donated, expiry, component.ShelfLifeDays)
+	}
+
+	// Units of a donation that has expired are no longer in stock, so they
+	// are left out of inventory unless the file says otherwise.
+	expired := in.ExpiryDate != "" && in.ExpiryDate < todayDate()
+	if values["remaining_units"] == "" {
+		if !expired {
+			in.Remaining = in.Units
+		}
+	} else if in.Remaining, err = strconv.Atoi(values["remaining_units"]); err != nil || in.Remaining < 0 || in.Remaining > in.Units {
+		errs.add("remaining_units", "Enter a number of units from 0 to the units donated.")
+	} else if expired && in.Remaining > 0 {
+		errs.add("remaining_units", "This donation has expired, so none of its units can be in stock.")
+	}
+	values["remaining_units"] = strconv.Itoa(in.Remaining)
+
+	// Importing the same file twice, or a file listing a donation twice,
+	// must not record donations twice.
+	if len(errs) == 0 {
+		key := fmt.Sprintf("%d|%d|%s", in.DonorID, in.ComponentID, in.DonationDate)
+		if line, ok := c.seen[key]; ok {
+			errs.add("donation_date", fmt.Sprintf("Same donation as line %d.", line))
+			row.input = in
+			return nil
+		}
+		c.seen[key] = row.Line
+		dup, err := exists(c.db, `
+			SELECT 1 FROM donations
+			WHERE donor_id = ? AND component_id = ? AND donation_date = ? AND deleted_at IS NULL
+		`, in.DonorID, in.ComponentID, in.DonationDate)
+		if err != nil {
+			return err
+		}
+		if dup {
+			errs.add("donation_date", "This donation is already recorded.")
+		}
+	}
+	row.input = in
+	return nil
+}
+
+// insertImportedDonation records a historical donation with its own DIN
+// and adds the units still in stock to inventory. Units already used or
+// expired have no issue or discard records, so they are kept as the
+// donation's units out at import, which the ledger starts from.
+func insertImportedDonation(tx *sql.Tx, row ImportRow, _ map[string]int) error {
+	in := row.input.(importedDonation)
+	res, err := tx.Exec(
+		"INSERT INTO donations (donor_id, component_id, units, donation_date, expiry_date, remaining_units, units_out_at_import) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		in.DonorID, in.ComponentID, in.Units, in.DonationDate, in.ExpiryDate, in.Remaining, in.Units-in.Remaining,
+	)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if err := assignDIN(tx, int(id), in.DonationDate); err != nil {
+		return err
+	}
+	if in.Remaining > 0 {
+		return upsertInventoryByTypeID(tx, in.BloodTypeID, in.Remaining)
+	}
+	return nil
+}
+
+// commitImport saves every row of a checked file in one transaction, so
+// either the whole file is imported or nothing is. It refuses a file with
+// any invalid row.
+func commitImport(db *sql.DB, result ImportResult) (int, error) {
+	if result.Invalid > 0 {
+		return 0, errImportInvalid
+	}
+	kind := findImportKind(result.Kind)
+	bloodTypeIDs := map[string]int{}
+	for _, row := range result.Rows {
+		if row.bloodType == "" {
+			continue
+		}
+		if _, ok := bloodTypeIDs[row.bloodType]; ok {
+			continue
+		}
+		id, err := getOrCreateBloodTypeID(db, row.bloodType)
+		if err != nil {
+			return 0, err
+		}
+		bloodTypeIDs[row.bloodType] = id
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, row := range result.Rows {
+		if err := kind.insert(tx, row, bloodTypeIDs); err != nil {
+			return 0, fmt.Errorf("line %d: %w", row.Line, err)
+		}
+	}
+	return len(result.Rows), tx.Commit()
+}
+
+// importCommand imports a CSV file from the command line. It is a dry run
+// unless -commit is given.
+func importCommand(db *sql.DB, args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	kind := fs.String("kind", "donors", "records to import: donors, recipients or donations")
+	mapping := fs.String("map", "", "columns for fields, as field=Column,field=Column")
+	dateFormat := fs.String("date-format", importDateFormats[0].Name, "date format: YYYY-MM-DD, DD/MM/YYYY or MM/DD/YYYY")
+	allowDuplicates := fs.Bool("allow-duplicates", false, "import donors that look like registered donors")
+	commit := fs.Bool("commit", false, "save the rows; without it nothing is saved")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: import [flags] file.csv")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 || findImportKind(*kind).name != *kind {
+		fs.Usage()
+		return 2
+	}
+
+	opts := ImportOptions{Kind: *kind, DateFormat: *dateFormat, AllowDuplicates: *allowDuplicates, Mapping: map[string]string{}}
+	for _, pair := range strings.Split(*mapping, ",") {
+		if field, header, ok := strings.Cut(pair, "="); ok {
+			opts.Mapping[strings.TrimSpace(field)] = header
+		}
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	result, err := checkImport(db, f, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import:", err)
+		return 1
+	}
+	for _, field := range result.Fields {
+		if header, ok := result.Mapping[field]; ok {
+			fmt.Printf("%s <- %q\n", field, header)
+		}
+	}
+	for _, e := range result.Errors {
+		fmt.Fprintf(os.Stderr, "line %d: %s: %s\n", e.Line, e.Field, e.Message)
+	}
+	fmt.Printf("%d rows, %d with errors\n", len(result.Rows), result.Invalid)
+	if result.Invalid > 0 {
+		fmt.Fprintln(os.Stderr, "nothing imported")
+		return 1
+	}
+	if !*commit {
+		fmt.Println("dry run; run again with -commit to import")
+		return 0
+	}
+	n, err := commitImport(db, result)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import:", err)
+		return 1
+	}
+	fmt.Printf("imported %d %s\n", n, result.Kind)
+	return 0
+}
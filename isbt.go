@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ISBT 128 settings for this blood bank. isbtFacilityCode is the five
+// character Facility Identification Number assigned by ICCBBA; replace the
+// placeholder before printing labels that leave the building.
+const (
+	isbtFacilityCode = "A9999"
+	// isbtDonationType is the donation type character of product codes:
+	// "V" for a volunteer allogeneic donation.
+	isbtDonationType = "V"
+	// isbtFlags are the flag characters that follow a DIN in its barcode;
+	// "00" means no flag is in use.
+	isbtFlags = "00"
+)
+
+var errDIN = errors.New("invalid donation identification number")
+
+// isbtBloodGroups are the ABO/RhD codes of the blood groups data structure.
+var isbtBloodGroups = map[string]string{
+	"O-": "95", "O+": "51",
+	"A-": "06", "A+": "62",
+	"B-": "17", "B+": "73",
+	"AB-": "28", "AB+": "84",
+}
+
+// UnitLabel holds what is printed on a unit's ISBT 128 label. The barcode
+// fields hold the encoded data, data identifiers included.
+type UnitLabel struct {
+	Donation       Donation
+	DIN            string
+	CheckCharacter string
+	ProductCode    string
+	DINBarcode     string
+	GroupBarcode   string
+	ProductBarcode string
+	ExpiryBarcode  string
+}
+
+type UnitLabelData struct {
+	Label      UnitLabel
+	DINSVG     template.HTML
+	GroupSVG   template.HTML
+	ProductSVG template.HTML
+	ExpirySVG  template.HTML
+	Message    string
+}
+
+// assignDIN gives a donation the next donation identification number for
+// the year it was collected: the facility code, two-digit year and a
+// six-digit sequence number.
+func assignDIN(db querier, donationID int, donationDate string) error {
+	prefix := isbtFacilityCode + donationDate[2:4]
+	var seq int
+	err := db.QueryRow(
+		"SELECT COALESCE(MAX(CAST(substr(din, 8) AS INTEGER)), 0) + 1 FROM donations WHERE din LIKE ? || '%'", prefix,
+	).Scan(&seq)
+	if err != nil {
+		return err
+	}
+	if seq > 999999 {
+		return fmt.Errorf("no donation identification numbers left for %s", prefix)
+	}
+	_, err = db.Exec("UPDATE donations SET din = ? WHERE id = ?", fmt.Sprintf("%s%06d", prefix, seq), donationID)
+	return err
+}
+
+// assignMissingDINs numbers donations recorded before DINs existed, in the
+// order they were recorded.
+func assignMissingDINs(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, donation_date FROM donations WHERE din IS NULL ORDER BY id")
+	if err != nil {
+		return err
+	}
+	dates := map[int]string{}
+	var ids []int
+	for rows.Next() {
+		var id int
+		var date string
+		if err := rows.Scan(&id, &date); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+		dates[id] = date
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := assignDIN(tx, id, dates[id]); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		log.Printf("assigned donation identification numbers to %d donations", len(ids))
+	}
+	return tx.Commit()
+}
+
+// isbtCheckCharacter computes the ISO 7064 mod 37-2 check character printed
+// in a box after the DIN, used to verify a DIN typed in by hand.
+func isbtCheckCharacter(din string) string {
+	const chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ*"
+	sum := 0
+	for _, r := range din {
+		sum = (sum + strings.IndexRune(chars, r)) * 2 % 37
+	}
+	return string(chars[(38-sum)%37])
+}
+
+// parseDIN reads a donation identification number from a barcode scan, with
+// its "=" data identifier and flag characters, or as typed from the label,
+// with or without the check character. Spaces are ignored.
+func parseDIN(value string) (string, error) {
+	value = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(value), " ", ""))
+	if strings.HasPrefix(value, "=") {
+		// A scanned DIN: the data identifier, 13 characters and usually
+		// the two flag characters.
+		if len(value) != 14 && len(value) != 16 {
+			return "", errDIN
+		}
+		value = value[1:14]
+	} else if len(value) == 14 {
+		if isbtCheckCharacter(value[:13]) != value[13:] {
+			return "", errDIN
+		}
+		value = value[:13]
+	}
+	if len(value) != 13 || digitRun(value[1:]) != 12 {
+		return "", errDIN
+	}
+	if c := value[0]; !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+		return "", errDIN
+	}
+	return value, nil
+}
+
+// findDonationByDIN returns the id of the donation with the given DIN, or
+// zero if there is none.
+func findDonationByDIN(db querier, din string) (int, error) {
+	var id int
+	err := db.QueryRow("SELECT id FROM donations WHERE din = ? AND deleted_at IS NULL", din).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// scanDonation resolves a scanned or typed DIN to a donation id. A non-empty
+// problem explains why the scan was not accepted.
+func scanDonation(db querier, value string) (int, string, error) {
+	din, err := parseDIN(value)
+	if err != nil {
+		return 0, fmt.Sprintf("%q is not a donation identification number; scan the DIN barcode.", value), nil
+	}
+	id, err := findDonationByDIN(db, din)
+	if err != nil {
+		return 0, "", err
+	}
+	if id == 0 {
+		return 0, fmt.Sprintf("No unit has DIN %s.", din), nil
+	}
+	return id, "", nil
+}
+
+// scanDonations resolves a batch of scanned DINs, refusing a unit scanned
+// twice.
+func scanDonations(db querier, values []string) ([]int, string, error) {
+	var ids []int
+	for _, value := range values {
+		id, problem, err := scanDonation(db, value)
+		if err != nil || problem != "" {
+			return nil, problem, err
+		}
+		if slices.Contains(ids, id) {
+			return nil, fmt.Sprintf("Unit %s was scanned twice.", value), nil
+		}
+		ids = append(ids, id)
+	}
+	return ids, "", nil
+}
+
+// scannedLines splits scanner input into one value per non-blank line.
+func scannedLines(value string) []string {
+	var lines []string
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// isbtDate encodes a calendar date as cyyjjj: the last three digits of the
+// year and the day of the year.
+func isbtDate(date string) (string, error) {
+	t, err := parseDate(date)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%03d%03d", t.Year()%1000, t.YearDay()), nil
+}
+
+// PrintedDIN is the DIN as printed under its barcode, grouped and followed by
+// its check character, e.g. "A9999 26 000123 K".
+func (l UnitLabel) PrintedDIN() string {
+	return formatDIN(l.DIN) + " " + l.CheckCharacter
+}
+
+func loadUnitLabel(db *sql.DB, donationID int) (UnitLabel, error) {
+	var l UnitLabel
+	d := &l.Donation
+	var productCode string
+	err := db.QueryRow(`
+		SELECT d.id, d.din, d.donor_id, donors.name, bt.type, c.name, COALESCE(c.isbt_code, ''), d.units,
+			COALESCE(d.remaining_units, 0), d.donation_date, d.expiry_date
+		FROM donations d
+		JOIN donors ON donors.id = d.donor_id
+		JOIN blood_types bt ON bt.id = donors.blood_type_id
+		JOIN components c ON c.id = d.component_id
+		WHERE d.id = ? AND d.deleted_at IS NULL
+	`, donationID).Scan(&d.ID, &d.DIN, &d.DonorID, &d.DonorName, &d.BloodType, &d.Component, &productCode, &d.Units,
+		&d.RemainingUnits, &d.DonationDate, &d.ExpiryDate)
+	if err != nil {
+		return l, err
+	}
+	expiry, err := isbtDate(d.ExpiryDate)
+	if err != nil {
+		return l, err
+	}
+	l.DIN = d.DIN
+	l.CheckCharacter = isbtCheckCharacter(d.DIN)
+	l.DINBarcode = "=" + d.DIN + isbtFlags
+	if group, ok := isbtBloodGroups[d.BloodType]; ok {
+		l.GroupBarcode = "=%" + group + "00"
+	}
+	if productCode != "" {
+		l.ProductCode = productCode + isbtDonationType + "00"
+		l.ProductBarcode = "=<" + l.ProductCode
+	}
+	l.ExpiryBarcode = "=>" + expiry
+	return l, nil
+}
+
+func registerLabelRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/donations/{id}/label", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		label, ok := loadLabelOrError(w, db, id)
+		if !ok {
+			return
+		}
+		data := UnitLabelData{Label: label}
+		for _, b := range []struct {
+			out  *template.HTML
+			data string
+		}{
+			{&data.DINSVG, label.DINBarcode},
+			{&data.GroupSVG, label.GroupBarcode},
+			{&data.ProductSVG, label.ProductBarcode},
+			{&data.ExpirySVG, label.ExpiryBarcode},
+		} {
+			if b.data == "" {
+				continue
+			}
+			svg, err := barcodeSVG(b.data)
+			if err != nil {
+				http.Error(w, "server error", http.StatusInternalServerError)
+				return
+			}
+			*b.out = svg
+		}
+		renderPage(w, tmpl, "donation_label.html", data)
+	})
+
+	mux.HandleFunc("/donations/{id}/label.pdf", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		label, ok := loadLabelOrError(w, db, id)
+		if !ok {
+			return
+		}
+		doc, err := unitLabelPDF(label)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		var buf bytes.Buffer
+		if _, err := doc.WriteTo(&buf); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="unit-%s.pdf"`, label.DIN))
+		w.Write(buf.Bytes())
+	})
+
+	mux.HandleFunc("/donations/lookup", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, problem, err := scanDonation(db, r.FormValue("din"))
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if problem != "" {
+			renderDonationList(w, tmpl, db, nil, Form{}, problem)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/donations/%d", id), http.StatusSeeOther)
+	})
+}
+
+func loadLabelOrError(w http.ResponseWriter, db *sql.DB, id int) (UnitLabel, bool) {
+	label, err := loadUnitLabel(db, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "donation not found", http.StatusNotFound)
+		return label, false
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return label, false
+	}
+	return label, true
+}
+
+// unitLabelPDF lays out a 100 x 100 mm ISBT 128 bag label in the standard
+// quadrants: DIN top left, blood group top right, product bottom left and
+// expiry bottom right.
+func unitLabelPDF(l UnitLabel) (*pdfDoc, error) {
+	d := l.Donation
+	doc := newPDF(100*mm, 100*mm)
+	doc.AddPage()
+	doc.Line(50*mm, 4*mm, 50*mm, 96*mm)
+	doc.Line(4*mm, 50*mm, 96*mm, 50*mm)
+
+	barcodes := []struct {
+		x, y float64
+		data string
+	}{
+		{3 * mm, 5 * mm, l.DINBarcode},
+		{53 * mm, 5 * mm, l.GroupBarcode},
+		{3 * mm, 53 * mm, l.ProductBarcode},
+		{53 * mm, 53 * mm, l.ExpiryBarcode},
+	}
+	for _, b := range barcodes {
+		if b.data == "" {
+			continue
+		}
+		if err := doc.Barcode(b.x, b.y, 44*mm, 12*mm, b.data); err != nil {
+			return nil, err
+		}
+	}
+
+	doc.Text(6*mm, 22*mm, 11, true, l.PrintedDIN())
+	doc.Text(6*mm, 28*mm, 7, false, "Collected "+d.DonationDate)
+	doc.Text(6*mm, 33*mm, 7, false, "Blood Bank Management ("+isbtFacilityCode+")")
+
+	doc.Text(56*mm, 40*mm, 36, true, d.BloodType)
+
+	doc.Text(6*mm, 70*mm, 11, true, d.Component)
+	if l.ProductCode != "" {
+		doc.Text(6*mm, 76*mm, 7, false, "Product "+l.ProductCode)
+	}
+	doc.Text(6*mm, 81*mm, 7, false, fmt.Sprintf("%d units", d.Units))
+
+	doc.Text(56*mm, 70*mm, 7, false, "EXPIRES")
+	doc.Text(56*mm, 78*mm, 14, true, expiryDisplay(d.ExpiryDate))
+	return doc, nil
+}
+
+func formatDIN(din string) string {
+	if len(din) != 13 {
+		return din
+	}
+	return din[:5] + " " + din[5:7] + " " + din[7:]
+}
+
+// expiryDisplay prints an expiry date the way ISBT 128 labels show it, e.g.
+// "31 JAN 2026".
+func expiryDisplay(date string) string {
+	t, err := parseDate(date)
+	if err != nil {
+		return date
+	}
+	return strings.ToUpper(t.Format("02 Jan 2006"))
+}
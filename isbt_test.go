@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestISBTCheckCharacter(t *testing.T) {
+	// Check characters worked out by ISO 7064 mod 37-2 as a pure system: the
+	// DIN and its check character, weighted by powers of two from the right,
+	// sum to 1 modulo 37.
+	tests := []struct {
+		din  string
+		want string
+	}{
+		{"A999926000001", "8"},
+		{"W000007123456", "D"},
+		{"G151709123456", "Y"},
+		{"0000000000000", "1"},
+		{"Z999999999999", "P"},
+	}
+	for _, tt := range tests {
+		if got := isbtCheckCharacter(tt.din); got != tt.want {
+			t.Errorf("isbtCheckCharacter(%q) = %q, want %q", tt.din, got, tt.want)
+		}
+	}
+}
+
+func TestParseDIN(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"=A99992600000100", "A999926000001", true},
+		{"=A999926000001", "A999926000001", true},
+		{"A9999 26 000001", "A999926000001", true},
+		{"a9999 26 000001 8", "A999926000001", true},
+		{"A9999 26 000001 9", "", false},
+		{"W0000 07 123456 D", "W000007123456", true},
+		{"A9999 26 00001", "", false},
+		{"A9999 2A 000001", "", false},
+		{"-9999 26 000001", "", false},
+	}
+	for _, tt := range tests {
+		got, err := parseDIN(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseDIN(%q) = %q, %v; want %q, ok %v", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
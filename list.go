@@ -0,0 +1,366 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageSize = 25
+	maxPageSize     = 100
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// ListFilter holds the search, sort and paging options for one list. The
+// same options are read from HTML query strings and the JSON API.
+type ListFilter struct {
+	Query       string
+	BloodType   string
+	Status      string
+	DonorID     int
+	RecipientID int
+	CampID      int
+	From        string
+	To          string
+	Sort        string
+	After       string
+	Limit       int
+}
+
+// Page is one page of a list. NextCursor is empty on the last page.
+type Page[T any] struct {
+	Items      []T        `json:"items"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+	NextURL    string     `json:"-"`
+	Filter     ListFilter `json:"-"`
+}
+
+// listSpec describes how to search and page through one entity. Columns must
+// be a SELECT list without a trailing comma; the id column and sort key are
+// appended to it for keyset pagination.
+type listSpec struct {
+	columns    string
+	from       string
+	where      string
+	id         string
+	search     []string
+	bloodType  string
+	dateColumn string
+	status     string
+	donor      string
+	recipient  string
+	camp       string
+	sorts      map[string]sortSpec
+}
+
+// sortSpec orders a list by column, falling back to the id column to break
+// ties. An empty column sorts by id alone.
+type sortSpec struct {
+	column string
+	desc   bool
+}
+
+// pageCursor is the position of the last row on a page.
+type pageCursor struct {
+	Key string `json:"k,omitempty"`
+	ID  int    `json:"id"`
+}
+
+var defaultSorts = map[string]sortSpec{
+	"newest": {desc: true},
+	"oldest": {},
+}
+
+var donorList = listSpec{
+	columns:    "d.id, COALESCE(d.donor_number, ''), d.name, bt.type, d.phone, d.city, COALESCE(d.email, ''), COALESCE(d.date_of_birth, ''), d.created_at",
+	from:       "donors d JOIN blood_types bt ON bt.id = d.blood_type_id",
+	where:      "d.deleted_at IS NULL",
+	id:         "d.id",
+	search:     []string{"d.donor_number", "d.name", "d.phone", "d.city", "d.email"},
+	bloodType:  "bt.type",
+	dateColumn: "d.created_at",
+	sorts:      withSorts(map[string]sortSpec{"name": {column: "d.name"}, "city": {column: "d.city"}}),
+}
+
+var recipientList = listSpec{
+	columns:    "r.id, r.name, bt.type, r.phone, r.hospital, r.created_at",
+	from:       "recipients r JOIN blood_types bt ON bt.id = r.blood_type_id",
+	where:      "r.deleted_at IS NULL",
+	id:         "r.id",
+	search:     []string{"r.name", "r.phone", "r.hospital"},
+	bloodType:  "bt.type",
+	dateColumn: "r.created_at",
+	sorts:      withSorts(map[string]sortSpec{"name": {column: "r.name"}, "hospital": {column: "r.hospital"}}),
+}
+
+var donationList = listSpec{
+	columns: "d.id, COALESCE(d.din, ''), d.donor_id, donors.name, bt.type, c.name, d.units, COALESCE(d.remaining_units, 0), d.donation_date, d.expiry_date, COALESCE(d.camp_id, 0), COALESCE(camps.name, '')",
+	from: `donations d
+		JOIN donors ON donors.id = d.donor_id
+		JOIN blood_types bt ON bt.id = donors.blood_type_id
+		JOIN components c ON c.id = d.component_id
+		LEFT JOIN camps ON camps.id = d.camp_id`,
+	where:      "d.deleted_at IS NULL",
+	id:         "d.id",
+	search:     []string{"d.din", "donors.donor_number", "donors.name", "donors.phone", "donors.city"},
+	bloodType:  "bt.type",
+	dateColumn: "d.donation_date",
+	donor:      "d.donor_id",
+	camp:       "d.camp_id",
+	sorts:      withSorts(map[string]sortSpec{"expiry": {column: "d.expiry_date"}, "donor": {column: "donors.name"}}),
+}
+
+var requestList = listSpec{
+	columns: "r.id, r.recipient_id, recipients.name, bt.type, r.units, COALESCE(r.issued_units, 0), r.status, r.request_date",
+	from: `requests r
+		JOIN recipients ON recipients.id = r.recipient_id
+		JOIN blood_types bt ON bt.id = recipients.blood_type_id`,
+	where:      "r.deleted_at IS NULL",
+	id:         "r.id",
+	search:     []string{"recipients.name", "recipients.phone", "recipients.hospital"},
+	bloodType:  "bt.type",
+	dateColumn: "r.request_date",
+	status:     "r.status",
+	recipient:  "r.recipient_id",
+	sorts:      withSorts(map[string]sortSpec{"recipient": {column: "recipients.name"}}),
+}
+
+func withSorts(extra map[string]sortSpec) map[string]sortSpec {
+	sorts := map[string]sortSpec{}
+	for name, s := range defaultSorts {
+		sorts[name] = s
+	}
+	for name, s := range extra {
+		sorts[name] = s
+	}
+	return sorts
+}
+
+// likeEscaper escapes the LIKE wildcards, with \ as the escape character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// parseListFilter reads list options from query values.
+func parseListFilter(values url.Values) ListFilter {
+	get := func(key string) string {
+		return strings.TrimSpace(values.Get(key))
+	}
+	f := ListFilter{
+		Query:     get("q"),
+		BloodType: normalizeBloodType(get("blood_type")),
+		Status:    get("status"),
+		From:      validDate(get("from")),
+		To:        validDate(get("to")),
+		Sort:      get("sort"),
+		After:     get("after"),
+		Limit:     defaultPageSize,
+	}
+	f.DonorID, _ = strconv.Atoi(get("donor_id"))
+	f.RecipientID, _ = strconv.Atoi(get("recipient_id"))
+	f.CampID, _ = strconv.Atoi(get("camp_id"))
+	if limit, err := strconv.Atoi(get("limit")); err == nil && limit > 0 {
+		f.Limit = min(limit, maxPageSize)
+	}
+	return f
+}
+
+func validDate(value string) string {
+	if _, err := parseDate(value); err != nil {
+		return ""
+	}
+	return value
+}
+
+// listQuery builds the filtered and sorted query of a list, after the
+// cursor if there is one and with no limit. The id column and sort key
+// follow the spec's columns.
+func listQuery(spec listSpec, f ListFilter) (string, []any, error) {
+	sort, ok := spec.sorts[f.Sort]
+	if !ok {
+		sort = spec.sorts["newest"]
+	}
+	key := "''"
+	if sort.column != "" {
+		key = "COALESCE(" + sort.column + ", '')"
+	}
+
+	var where []string
+	if spec.where != "" {
+		where = append(where, spec.where)
+	}
+	var args []any
+	if f.Query != "" {
+		// The search is literal: % and _ in it match only themselves.
+		pattern := "%" + likeEscaper.Replace(f.Query) + "%"
+		var like []string
+		for _, col := range spec.search {
+			like = append(like, col+` LIKE ? ESCAPE '\'`)
+			args = append(args, pattern)
+		}
+		where = append(where, "("+strings.Join(like, " OR ")+")")
+	}
+	if f.BloodType != "" && spec.bloodType != "" {
+		where = append(where, spec.bloodType+" = ?")
+		args = append(args, f.BloodType)
+	}
+	if f.Status != "" && spec.status != "" {
+		where = append(where, spec.status+" = ?")
+		args = append(args, f.Status)
+	}
+	if f.DonorID != 0 && spec.donor != "" {
+		where = append(where, spec.donor+" = ?")
+		args = append(args, f.DonorID)
+	}
+	if f.RecipientID != 0 && spec.recipient != "" {
+		where = append(where, spec.recipient+" = ?")
+		args = append(args, f.RecipientID)
+	}
+	if f.CampID != 0 && spec.camp != "" {
+		where = append(where, spec.camp+" = ?")
+		args = append(args, f.CampID)
+	}
+	if f.From != "" && spec.dateColumn != "" {
+		where = append(where, spec.dateColumn+" >= ?")
+		args = append(args, f.From)
+	}
+	if f.To != "" && spec.dateColumn != "" {
+		where = append(where, spec.dateColumn+" < date(?, '+1 day')")
+		args = append(args, f.To)
+	}
+	if f.After != "" {
+		cursor, err := decodeCursor(f.After)
+		if err != nil {
+			return "", nil, err
+		}
+		op := ">"
+		if sort.desc {
+			op = "<"
+		}
+		if sort.column == "" {
+			where = append(where, fmt.Sprintf("%s %s ?", spec.id, op))
+			args = append(args, cursor.ID)
+		} else {
+			where = append(where, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND %[3]s %[2]s ?))", key, op, spec.id))
+			args = append(args, cursor.Key, cursor.Key, cursor.ID)
+		}
+	}
+
+	dir := "ASC"
+	if sort.desc {
+		dir = "DESC"
+	}
+	order := fmt.Sprintf("%s %s", spec.id, dir)
+	if sort.column != "" {
+		order = fmt.Sprintf("%s %s, %s", key, dir, order)
+	}
+	if len(where) == 0 {
+		where = append(where, "1 = 1")
+	}
+	query := fmt.Sprintf("SELECT %s, %s, %s FROM %s WHERE %s ORDER BY %s",
+		spec.columns, spec.id, key, spec.from, strings.Join(where, " AND "), order)
+	return query, args, nil
+}
+
+// queryPage runs a filtered, keyset-paginated query. scan reads one row into
+// an item and must also scan the two trailing cursor columns.
+func queryPage[T any](db *sql.DB, spec listSpec, f ListFilter, scan func(*sql.Rows, *pageCursor) (T, error)) (Page[T], error) {
+	page := Page[T]{Filter: f}
+	query, args, err := listQuery(spec, f)
+	if err != nil {
+		return page, err
+	}
+	query += fmt.Sprintf(" LIMIT %d", f.Limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	var last pageCursor
+	for rows.Next() {
+		if len(page.Items) == f.Limit {
+			page.NextCursor = encodeCursor(last)
+			break
+		}
+		var cursor pageCursor
+		item, err := scan(rows, &cursor)
+		if err != nil {
+			return page, err
+		}
+		page.Items = append(page.Items, item)
+		last = cursor
+	}
+	return page, rows.Err()
+}
+
+func encodeCursor(c pageCursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(value string) (pageCursor, error) {
+	var c pageCursor
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return c, errInvalidCursor
+	}
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return c, errInvalidCursor
+	}
+	return c, nil
+}
+
+// nextPageURL links to the page after the current one, keeping every other
+// query parameter as it is.
+func nextPageURL(values url.Values, cursor string) string {
+	if cursor == "" {
+		return ""
+	}
+	next := url.Values{}
+	for k, v := range values {
+		next[k] = v
+	}
+	next.Set("after", cursor)
+	return "?" + next.Encode()
+}
+
+func loadDonorPage(db *sql.DB, f ListFilter) (Page[Donor], error) {
+	return queryPage(db, donorList, f, func(rows *sql.Rows, c *pageCursor) (Donor, error) {
+		var d Donor
+		err := rows.Scan(&d.ID, &d.DonorNumber, &d.Name, &d.BloodType, &d.Phone, &d.City, &d.Email, &d.DateOfBirth, &d.CreatedAt, &c.ID, &c.Key)
+		return d, err
+	})
+}
+
+func loadRecipientPage(db *sql.DB, f ListFilter) (Page[Recipient], error) {
+	return queryPage(db, recipientList, f, func(rows *sql.Rows, c *pageCursor) (Recipient, error) {
+		var r Recipient
+		err := rows.Scan(&r.ID, &r.Name, &r.BloodType, &r.Phone, &r.Hospital, &r.CreatedAt, &c.ID, &c.Key)
+		return r, err
+	})
+}
+
+func loadDonationPage(db *sql.DB, f ListFilter) (Page[Donation], error) {
+	return queryPage(db, donationList, f, func(rows *sql.Rows, c *pageCursor) (Donation, error) {
+		var d Donation
+		err := rows.Scan(&d.ID, &d.DIN, &d.DonorID, &d.DonorName, &d.BloodType, &d.Component, &d.Units, &d.RemainingUnits,
+			&d.DonationDate, &d.ExpiryDate, &d.CampID, &d.CampName, &c.ID, &c.Key)
+		return d, err
+	})
+}
+
+func loadRequestPage(db *sql.DB, f ListFilter) (Page[Request], error) {
+	return queryPage(db, requestList, f, func(rows *sql.Rows, c *pageCursor) (Request, error) {
+		var r Request
+		err := rows.Scan(&r.ID, &r.RecipientID, &r.Recipient, &r.BloodType, &r.Units, &r.IssuedUnits,
+			&r.Status, &r.RequestDate, &c.ID, &c.Key)
+		return r, err
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// TraceRow is one link in a look-back trace: a donation, the units issued
+// from it, and the request and recipient that received them. Donations with
+// nothing issued yet have zero RequestID.
+type TraceRow struct {
+	DonorID        int
+	DonorName      string
+	BloodType      string
+	DonorPhone     string
+	DonationID     int
+	DonationDate   string
+	ExpiryDate     string
+	DonationUnits  int
+	RemainingUnits int
+	IssuedUnits    int
+	IssueDate      string
+	RequestID      int
+	RequestStatus  string
+	RecipientID    int
+	RecipientName  string
+	RecipientPhone string
+	Hospital       string
+}
+
+type LookbackData struct {
+	DonorID     int
+	RecipientID int
+	Rows        []TraceRow
+	Message     string
+}
+
+const traceColumns = `
+	SELECT dn.id, dn.name, bt.type, COALESCE(dn.phone, ''),
+		d.id, d.donation_date, d.expiry_date, d.units, COALESCE(d.remaining_units, 0),
+		COALESCE(i.units, 0), COALESCE(i.issue_date, ''),
+		COALESCE(r.id, 0), COALESCE(r.status, ''),
+		COALESCE(rc.id, 0), COALESCE(rc.name, ''), COALESCE(rc.phone, ''), COALESCE(rc.hospital, '')
+`
+
+func registerLookbackRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/lookback", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		donorID, _ := strconv.Atoi(r.FormValue("donor_id"))
+		recipientID, _ := strconv.Atoi(r.FormValue("recipient_id"))
+		data := LookbackData{DonorID: donorID, RecipientID: recipientID}
+
+		var err error
+		var filename string
+		switch {
+		case donorID != 0:
+			data.Rows, err = traceDonor(db, donorID)
+			filename = fmt.Sprintf("lookback-donor-%d.csv", donorID)
+		case recipientID != 0:
+			data.Rows, err = traceRecipient(db, recipientID)
+			filename = fmt.Sprintf("lookback-recipient-%d.csv", recipientID)
+		}
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+
+		if !isAdmin(r) {
+			for i := range data.Rows {
+				data.Rows[i].DonorPhone = maskPhone(data.Rows[i].DonorPhone)
+				data.Rows[i].RecipientPhone = maskPhone(data.Rows[i].RecipientPhone)
+			}
+		}
+
+		if r.FormValue("format") == "csv" && filename != "" {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+			if err := writeTraceCSV(w, data.Rows); err != nil {
+				log.Println("csv error:", err)
+			}
+			return
+		}
+
+		if filename != "" && len(data.Rows) == 0 {
+			data.Message = "No donations or issued units found for this look-back."
+		}
+		if err := tmpl.ExecuteTemplate(w, "lookback.html", data); err != nil {
+			log.Println("template error:", err)
+		}
+	})
+}
+
+// traceDonor walks every donation of a donor, including deleted records, to
+// the requests and recipients that were issued units from it.
+func traceDonor(db *sql.DB, donorID int) ([]TraceRow, error) {
+	return queryTrace(db, traceColumns+`
+		FROM donations d
+		JOIN donors dn ON dn.id = d.donor_id
+		JOIN blood_types bt ON bt.id = dn.blood_type_id
+		LEFT JOIN issues i ON i.donation_id = d.id
+		LEFT JOIN requests r ON r.id = i.request_id
+		LEFT JOIN recipients rc ON rc.id = r.recipient_id
+		WHERE dn.id = ?
+		ORDER BY d.donation_date, d.id, i.id
+	`, donorID)
+}
+
+// traceRecipient lists every donation a recipient received units from,
+// together with the donor who gave it.
+func traceRecipient(db *sql.DB, recipientID int) ([]TraceRow, error) {
+	return queryTrace(db, traceColumns+`
+		FROM issues i
+		JOIN requests r ON r.id = i.request_id
+		JOIN recipients rc ON rc.id = r.recipient_id
+		JOIN donations d ON d.id = i.donation_id
+		JOIN donors dn ON dn.id = d.donor_id
+		JOIN blood_types bt ON bt.id = dn.blood_type_id
+		WHERE rc.id = ?
+		ORDER BY i.issue_date, i.id
+	`, recipientID)
+}
+
+func queryTrace(db *sql.DB, query string, id int) ([]TraceRow, error) {
+	rows, err := db.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var trace []TraceRow
+	for rows.Next() {
+		var t TraceRow
+		if err := rows.Scan(
+			&t.DonorID, &t.DonorName, &t.BloodType, &t.DonorPhone,
+			&t.DonationID, &t.DonationDate, &t.ExpiryDate, &t.DonationUnits, &t.RemainingUnits,
+			&t.IssuedUnits, &t.IssueDate,
+			&t.RequestID, &t.RequestStatus,
+			&t.RecipientID, &t.RecipientName, &t.RecipientPhone, &t.Hospital,
+		); err != nil {
+			return nil, err
+		}
+		trace = append(trace, t)
+	}
+	return trace, rows.Err()
+}
+
+func writeTraceCSV(w http.ResponseWriter, trace []TraceRow) error {
+	out := &csvExportWriter{csv.NewWriter(w)}
+	if err := out.Write([]string{
+		"donor_id", "donor_name", "blood_type", "donor_phone",
+		"donation_id", "donation_date", "expiry_date", "donation_units", "units_in_stock",
+		"issued_units", "issue_date", "request_id", "request_status",
+		"recipient_id", "recipient_name", "recipient_phone", "hospital",
+	}); err != nil {
+		return err
+	}
+	for _, t := range trace {
+		if err := out.Write([]string{
+			strconv.Itoa(t.DonorID), t.DonorName, t.BloodType, t.DonorPhone,
+			strconv.Itoa(t.DonationID), t.DonationDate, t.ExpiryDate, strconv.Itoa(t.DonationUnits), strconv.Itoa(t.RemainingUnits),
+			strconv.Itoa(t.IssuedUnits), t.IssueDate, strconv.Itoa(t.RequestID), t.RequestStatus,
+			strconv.Itoa(t.RecipientID), t.RecipientName, t.RecipientPhone, t.Hospital,
+		}); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -7,9 +7,10 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
-	"time"
 
 	_ "modernc.org/sqlite"
 )
@@ -25,14 +26,25 @@ CREATE TABLE IF NOT EXISTS blood_types (
 	type TEXT NOT NULL UNIQUE
 );
 
+CREATE TABLE IF NOT EXISTS components (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	shelf_life_days INTEGER NOT NULL,
+	isbt_code TEXT
+);
+
 CREATE TABLE IF NOT EXISTS donors (
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	name TEXT NOT NULL,
 	blood_type_id INTEGER NOT NULL,
 	phone TEXT,
 	city TEXT,
+	email TEXT,
+	date_of_birth TEXT,
+	donor_number TEXT,
 	created_at TEXT NOT NULL,
 	deleted_at TEXT,
+	merged_into INTEGER REFERENCES donors(id),
 	FOREIGN KEY(blood_type_id) REFERENCES blood_types(id)
 );
 
@@ -53,6 +65,10 @@ CREATE TABLE IF NOT EXISTS donations (
 	units INTEGER NOT NULL,
 	donation_date TEXT NOT NULL,
 	expiry_date TEXT NOT NULL,
+	remaining_units INTEGER,
+	component_id INTEGER REFERENCES components(id),
+	camp_id INTEGER REFERENCES camps(id),
+	units_out_at_import INTEGER NOT NULL DEFAULT 0,
 	deleted_at TEXT,
 	FOREIGN KEY(donor_id) REFERENCES donors(id)
 );
@@ -71,247 +87,456 @@ CREATE TABLE IF NOT EXISTS requests (
 	units INTEGER NOT NULL,
 	status TEXT NOT NULL,
 	request_date TEXT NOT NULL,
+	issued_units INTEGER,
 	deleted_at TEXT,
 	FOREIGN KEY(recipient_id) REFERENCES recipients(id)
 );
+
+CREATE TABLE IF NOT EXISTS issues (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	request_id INTEGER NOT NULL,
+	donation_id INTEGER NOT NULL,
+	units INTEGER NOT NULL,
+	issue_date TEXT NOT NULL,
+	FOREIGN KEY(request_id) REFERENCES requests(id),
+	FOREIGN KEY(donation_id) REFERENCES donations(id)
+);
+
+CREATE TABLE IF NOT EXISTS returns (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	request_id INTEGER NOT NULL,
+	donation_id INTEGER NOT NULL,
+	units INTEGER NOT NULL,
+	minutes_out INTEGER NOT NULL,
+	temperature REAL NOT NULL,
+	outcome TEXT NOT NULL,
+	reason TEXT,
+	return_date TEXT NOT NULL,
+	FOREIGN KEY(request_id) REFERENCES requests(id),
+	FOREIGN KEY(donation_id) REFERENCES donations(id)
+);
+
+CREATE TABLE IF NOT EXISTS discards (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	donation_id INTEGER NOT NULL,
+	units INTEGER NOT NULL,
+	reason TEXT NOT NULL,
+	staff TEXT NOT NULL,
+	discard_date TEXT NOT NULL,
+	FOREIGN KEY(donation_id) REFERENCES donations(id)
+);
+
+CREATE TABLE IF NOT EXISTS donation_revisions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	donation_id INTEGER NOT NULL,
+	action TEXT NOT NULL,
+	old_units INTEGER NOT NULL,
+	new_units INTEGER NOT NULL,
+	old_expiry_date TEXT NOT NULL,
+	new_expiry_date TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	revised_at TEXT NOT NULL,
+	FOREIGN KEY(donation_id) REFERENCES donations(id)
+);
+
+CREATE TABLE IF NOT EXISTS camps (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	location TEXT NOT NULL,
+	camp_date TEXT NOT NULL,
+	organizer TEXT,
+	target_units INTEGER NOT NULL,
+	created_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS camp_donors (
+	camp_id INTEGER NOT NULL,
+	donor_id INTEGER NOT NULL,
+	registered_at TEXT NOT NULL,
+	PRIMARY KEY(camp_id, donor_id),
+	FOREIGN KEY(camp_id) REFERENCES camps(id),
+	FOREIGN KEY(donor_id) REFERENCES donors(id)
+);
+
+CREATE TABLE IF NOT EXISTS deferrals (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	donor_id INTEGER NOT NULL,
+	camp_id INTEGER REFERENCES camps(id),
+	reason TEXT NOT NULL,
+	deferred_until TEXT,
+	deferral_date TEXT NOT NULL,
+	FOREIGN KEY(donor_id) REFERENCES donors(id)
+);
+
+CREATE TABLE IF NOT EXISTS appointment_slots (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	site TEXT NOT NULL,
+	slot_date TEXT NOT NULL,
+	start_time TEXT NOT NULL,
+	end_time TEXT NOT NULL,
+	capacity INTEGER NOT NULL,
+	UNIQUE(site, slot_date, start_time)
+);
+
+CREATE TABLE IF NOT EXISTS appointments (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	slot_id INTEGER NOT NULL,
+	donor_id INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	booked_at TEXT NOT NULL,
+	reminded_at TEXT,
+	checked_in_at TEXT,
+	donation_id INTEGER REFERENCES donations(id),
+	FOREIGN KEY(slot_id) REFERENCES appointment_slots(id),
+	FOREIGN KEY(donor_id) REFERENCES donors(id)
+);
+
+CREATE TABLE IF NOT EXISTS recall_campaigns (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	blood_type_id INTEGER NOT NULL,
+	stock_units INTEGER NOT NULL,
+	target_units INTEGER NOT NULL,
+	city TEXT,
+	include_compatible INTEGER NOT NULL,
+	message TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	closed_at TEXT,
+	FOREIGN KEY(blood_type_id) REFERENCES blood_types(id)
+);
+
+CREATE TABLE IF NOT EXISTS recall_contacts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	campaign_id INTEGER NOT NULL,
+	donor_id INTEGER NOT NULL,
+	rank INTEGER NOT NULL,
+	response TEXT NOT NULL,
+	note TEXT,
+	responded_at TEXT,
+	messaged_at TEXT,
+	UNIQUE(campaign_id, donor_id),
+	FOREIGN KEY(campaign_id) REFERENCES recall_campaigns(id),
+	FOREIGN KEY(donor_id) REFERENCES donors(id)
+);
+
+CREATE TABLE IF NOT EXISTS stock_levels (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	blood_type_id INTEGER NOT NULL,
+	component_id INTEGER REFERENCES components(id),
+	minimum_units INTEGER NOT NULL,
+	target_units INTEGER NOT NULL,
+	alerted_at TEXT,
+	FOREIGN KEY(blood_type_id) REFERENCES blood_types(id)
+);
+
+CREATE TABLE IF NOT EXISTS inventory_snapshots (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	snapshot_date TEXT NOT NULL,
+	blood_type_id INTEGER NOT NULL,
+	component_id INTEGER REFERENCES components(id),
+	units INTEGER NOT NULL,
+	expired_units INTEGER NOT NULL DEFAULT 0,
+	taken_at TEXT NOT NULL,
+	FOREIGN KEY(blood_type_id) REFERENCES blood_types(id)
+);
+
+CREATE TABLE IF NOT EXISTS notifications (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind TEXT NOT NULL,
+	channel TEXT NOT NULL,
+	recipient TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	body TEXT NOT NULL,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL,
+	last_error TEXT,
+	dedupe_key TEXT UNIQUE,
+	created_at TEXT NOT NULL,
+	next_attempt_at TEXT NOT NULL,
+	sent_at TEXT
+);
 `
 
 type Donor struct {
-	ID        int
-	Name      string
-	BloodType string
-	Phone     string
-	City      string
-	CreatedAt string
+	ID          int    `json:"id"`
+	DonorNumber string `json:"donor_number"`
+	Name        string `json:"name"`
+	BloodType   string `json:"blood_type"`
+	Phone       string `json:"phone"`
+	City        string `json:"city"`
+	Email       string `json:"email"`
+	DateOfBirth string `json:"date_of_birth"`
+	CreatedAt   string `json:"created_at"`
 }
 
 type Recipient struct {
-	ID        int
-	Name      string
-	BloodType string
-	Phone     string
-	Hospital  string
-	CreatedAt string
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	BloodType string `json:"blood_type"`
+	Phone     string `json:"phone"`
+	Hospital  string `json:"hospital"`
+	CreatedAt string `json:"created_at"`
 }
 
 type Donation struct {
-	ID           int
-	DonorID      int
-	DonorName    string
-	BloodType    string
-	Units        int
-	DonationDate string
-	ExpiryDate   string
+	ID             int    `json:"id"`
+	DIN            string `json:"din"`
+	DonorID        int    `json:"donor_id"`
+	DonorName      string `json:"donor_name"`
+	BloodType      string `json:"blood_type"`
+	Component      string `json:"component"`
+	Units          int    `json:"units"`
+	RemainingUnits int    `json:"remaining_units"`
+	DonationDate   string `json:"donation_date"`
+	ExpiryDate     string `json:"expiry_date"`
+	CampID         int    `json:"camp_id,omitempty"`
+	CampName       string `json:"camp_name,omitempty"`
 }
 
 type Inventory struct {
-	BloodType string
-	Units     int
+	BloodType string `json:"blood_type"`
+	Units     int    `json:"units"`
 }
 
 type Request struct {
-	ID           int
-	RecipientID  int
-	Recipient    string
-	BloodType    string
-	Units        int
-	Status       string
-	RequestDate  string
+	ID          int    `json:"id"`
+	RecipientID int    `json:"recipient_id"`
+	Recipient   string `json:"recipient"`
+	BloodType   string `json:"blood_type"`
+	Units       int    `json:"units"`
+	IssuedUnits int    `json:"issued_units"`
+	Status      string `json:"status"`
+	RequestDate string `json:"request_date"`
 }
 
-type PageData struct {
-	Donors     []Donor
-	Recipients []Recipient
-	Donations  []Donation
-	Inventory  []Inventory
-	Requests   []Request
-	Message    string
+// querier is satisfied by both *sql.DB and *sql.Tx so helpers can run inside
+// or outside a transaction.
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
 }
 
 func main() {
-	db, err := sql.Open("sqlite", "file:bloodbank.db?_pragma=foreign_keys(1)")
+	// Restoring replaces the database file, so it runs before the file is
+	// opened.
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Exit(restoreCommand(os.Args[2:]))
+	}
+
+	// Backups and checks open the database read-only and skip the
+	// migrations, so they copy or check the data as it is.
+	readOnly := len(os.Args) > 1 && readOnlyCommands[os.Args[1]]
+	dsn := "file:" + dbFile + dbPragmas
+	if readOnly {
+		dsn += "&mode=ro"
+	}
+	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
-	if err := initDB(db); err != nil {
-		log.Fatal(err)
+	if !readOnly {
+		if err := initDB(db); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(os.Args) > 1 {
+		code := runCommand(db, os.Args[1:])
+		db.Close()
+		os.Exit(code)
 	}
 
-	tmpl := template.Must(template.ParseFS(assets, "templates/index.html"))
+	tmpl := template.Must(template.New("").Funcs(templateFuncs).ParseFS(assets, "templates/*.html"))
 
 	mux := http.NewServeMux()
 	mux.Handle("/static/", http.FileServer(http.FS(assets)))
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
 			return
 		}
-		data, err := loadPageData(db, "")
-		if err != nil {
-			http.Error(w, "server error", http.StatusInternalServerError)
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		if err := tmpl.Execute(w, data); err != nil {
-			log.Println("template error:", err)
-		}
+		renderDashboard(w, tmpl, db)
 	})
 
 	mux.HandleFunc("/donors", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			renderDonorList(w, tmpl, r, db, r.URL.Query(), Form{}, nil, "")
+			return
+		}
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		name := strings.TrimSpace(r.FormValue("name"))
-		bloodType := normalizeBloodType(r.FormValue("blood_type"))
-		phone := strings.TrimSpace(r.FormValue("phone"))
-		city := strings.TrimSpace(r.FormValue("city"))
-		if name == "" || bloodType == "" {
-			renderWithMessage(w, tmpl, db, "Donor name and blood type are required.")
+		in, form := donorForm(r)
+		form.Merge(in.Validate())
+		if !form.Valid() {
+			renderDonorList(w, tmpl, r, db, nil, form, nil, "Please correct the highlighted fields.")
 			return
 		}
-		bloodTypeID, err := getOrCreateBloodTypeID(db, bloodType)
-		if err != nil {
-			renderWithMessage(w, tmpl, db, "Could not add donor.")
+		if !in.AllowDuplicate {
+			duplicates, err := findDuplicateDonors(db, in, 0)
+			if err != nil {
+				renderDonorList(w, tmpl, r, db, nil, form, nil, "Could not add donor.")
+				return
+			}
+			if len(duplicates) > 0 {
+				renderDonorList(w, tmpl, r, db, nil, form, duplicates, "This donor may already be registered.")
+				return
+			}
+		}
+		if _, err := createDonor(db, in); err != nil {
+			renderDonorList(w, tmpl, r, db, nil, form, nil, "Could not add donor.")
 			return
 		}
-		_, err = db.Exec(
-			"INSERT INTO donors (name, blood_type_id, phone, city, created_at) VALUES (?, ?, ?, ?, ?)",
-			name, bloodTypeID, phone, city, time.Now().Format("2006-01-02"),
-		)
-		if err != nil {
-			renderWithMessage(w, tmpl, db, "Could not add donor.")
+		http.Redirect(w, r, "/donors", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/donors/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		renderDonor(w, tmpl, r, db, id, Form{}, "")
+	})
+
+	mux.HandleFunc("/donors/{id}/edit", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		renderDonorEdit(w, tmpl, r, db, id, Form{}, "")
 	})
 
 	mux.HandleFunc("/recipients", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			renderRecipientList(w, tmpl, r, db, r.URL.Query(), Form{}, "")
+			return
+		}
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		name := strings.TrimSpace(r.FormValue("name"))
-		bloodType := normalizeBloodType(r.FormValue("blood_type"))
-		phone := strings.TrimSpace(r.FormValue("phone"))
-		hospital := strings.TrimSpace(r.FormValue("hospital"))
-		if name == "" || bloodType == "" {
-			renderWithMessage(w, tmpl, db, "Recipient name and blood type are required.")
+		in, form := recipientForm(r)
+		form.Merge(in.Validate())
+		if !form.Valid() {
+			renderRecipientList(w, tmpl, r, db, nil, form, "Please correct the highlighted fields.")
 			return
 		}
-		bloodTypeID, err := getOrCreateBloodTypeID(db, bloodType)
-		if err != nil {
-			renderWithMessage(w, tmpl, db, "Could not add recipient.")
+		if _, err := createRecipient(db, in); err != nil {
+			renderRecipientList(w, tmpl, r, db, nil, form, "Could not add recipient.")
 			return
 		}
-		_, err = db.Exec(
-			"INSERT INTO recipients (name, blood_type_id, phone, hospital, created_at) VALUES (?, ?, ?, ?, ?)",
-			name, bloodTypeID, phone, hospital, time.Now().Format("2006-01-02"),
-		)
-		if err != nil {
-			renderWithMessage(w, tmpl, db, "Could not add recipient.")
+		http.Redirect(w, r, "/recipients", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/recipients/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		renderRecipient(w, tmpl, r, db, id, "")
+	})
+
+	mux.HandleFunc("/recipients/{id}/edit", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		renderRecipientEdit(w, tmpl, r, db, id, Form{}, "")
 	})
 
 	mux.HandleFunc("/donations", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			renderDonationList(w, tmpl, db, r.URL.Query(), Form{}, "")
+			return
+		}
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		donorID, _ := strconv.Atoi(r.FormValue("donor_id"))
-		units, _ := strconv.Atoi(r.FormValue("units"))
-		expiry := strings.TrimSpace(r.FormValue("expiry_date"))
-		if donorID == 0 || units <= 0 || expiry == "" {
-			renderWithMessage(w, tmpl, db, "Donation requires donor, units, and expiry date.")
+		in, form := donationForm(r)
+		errs, err := in.Validate(db)
+		if err != nil {
+			renderDonationList(w, tmpl, db, nil, form, "Could not add donation.")
 			return
 		}
-		bloodTypeID, err := getDonorBloodTypeID(db, donorID)
-		if err != nil {
-			renderWithMessage(w, tmpl, db, "Donation requires a valid donor with blood type.")
+		form.Merge(errs)
+		if !form.Valid() {
+			renderDonationList(w, tmpl, db, nil, form, "Please correct the highlighted fields.")
 			return
 		}
-		_, err = db.Exec(
-			"INSERT INTO donations (donor_id, units, donation_date, expiry_date) VALUES (?, ?, ?, ?)",
-			donorID, units, time.Now().Format("2006-01-02"), expiry,
-		)
-		if err != nil {
-			renderWithMessage(w, tmpl, db, "Could not add donation.")
+		if _, err := createDonation(db, in); err != nil {
+			renderDonationList(w, tmpl, db, nil, form, "Could not add donation.")
 			return
 		}
-		if err := upsertInventoryByTypeID(db, bloodTypeID, units); err != nil {
-			renderWithMessage(w, tmpl, db, "Donation saved, but inventory update failed.")
+		if in.CampID != 0 {
+			http.Redirect(w, r, fmt.Sprintf("/camps/%d", in.CampID), http.StatusSeeOther)
 			return
 		}
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		http.Redirect(w, r, "/donations", http.StatusSeeOther)
 	})
 
-	mux.HandleFunc("/donations/delete", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
+	mux.HandleFunc("/donations/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		id, _ := strconv.Atoi(r.FormValue("id"))
-		if id == 0 {
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		renderDonation(w, tmpl, db, id, Form{}, "")
+	})
+
+	mux.HandleFunc("/requests", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			renderRequestList(w, tmpl, db, r.URL.Query(), Form{}, "")
 			return
 		}
-		var units int
-		var bloodTypeID int
-		err := db.QueryRow(`
-			SELECT donors.blood_type_id, d.units
-			FROM donations d
-			JOIN donors ON donors.id = d.donor_id
-			WHERE d.id = ? AND d.deleted_at IS NULL
-		`, id).Scan(&bloodTypeID, &units)
-		if err != nil {
-			renderWithMessage(w, tmpl, db, "Donation not found.")
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		ok, err := consumeInventoryByTypeID(db, bloodTypeID, units)
+		in, form := requestForm(r)
+		errs, err := in.Validate(db)
 		if err != nil {
-			renderWithMessage(w, tmpl, db, "Inventory update failed.")
+			renderRequestList(w, tmpl, db, nil, form, "Could not add request.")
 			return
 		}
-		if !ok {
-			renderWithMessage(w, tmpl, db, "Cannot delete donation because inventory is already used.")
+		form.Merge(errs)
+		if !form.Valid() {
+			renderRequestList(w, tmpl, db, nil, form, "Please correct the highlighted fields.")
 			return
 		}
-		_, err = db.Exec("UPDATE donations SET deleted_at = ? WHERE id = ?", time.Now().Format("2006-01-02"), id)
-		if err != nil {
-			renderWithMessage(w, tmpl, db, "Could not delete donation.")
+		if _, err := createRequest(db, in); err != nil {
+			renderRequestList(w, tmpl, db, nil, form, "Could not add request.")
 			return
 		}
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		http.Redirect(w, r, "/requests", http.StatusSeeOther)
 	})
 
-	mux.HandleFunc("/requests", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
+	mux.HandleFunc("/requests/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		recipientID, _ := strconv.Atoi(r.FormValue("recipient_id"))
-		units, _ := strconv.Atoi(r.FormValue("units"))
-		if recipientID == 0 || units <= 0 {
-			renderWithMessage(w, tmpl, db, "Request requires recipient and units.")
-			return
-		}
-		if _, err := getRecipientBloodTypeID(db, recipientID); err != nil {
-			renderWithMessage(w, tmpl, db, "Request requires a valid recipient with blood type.")
-			return
-		}
-		_, err := db.Exec(
-			"INSERT INTO requests (recipient_id, units, status, request_date) VALUES (?, ?, ?, ?)",
-			recipientID, units, "Pending", time.Now().Format("2006-01-02"),
-		)
-		if err != nil {
-			renderWithMessage(w, tmpl, db, "Could not add request.")
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		renderRequest(w, tmpl, db, id, Form{}, "")
+	})
+
+	mux.HandleFunc("/inventory", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		renderInventory(w, tmpl, db, Form{}, "")
 	})
 
 	mux.HandleFunc("/donors/update", func(w http.ResponseWriter, r *http.Request) {
@@ -320,25 +545,24 @@ func main() {
 			return
 		}
 		id, _ := strconv.Atoi(r.FormValue("id"))
-		name := strings.TrimSpace(r.FormValue("name"))
-		bloodType := normalizeBloodType(r.FormValue("blood_type"))
-		phone := strings.TrimSpace(r.FormValue("phone"))
-		city := strings.TrimSpace(r.FormValue("city"))
-		if id == 0 || name == "" || bloodType == "" {
-			renderWithMessage(w, tmpl, db, "Donor update requires id, name, and blood type.")
-			return
+		in, form := donorForm(r)
+		if !isAdmin(r) {
+			stored, ok := loadDonorData(w, db, id, "")
+			if !ok {
+				return
+			}
+			unmaskDonorInput(stored.Donor, &in)
 		}
-		bloodTypeID, err := getOrCreateBloodTypeID(db, bloodType)
-		if err != nil {
-			renderWithMessage(w, tmpl, db, "Could not update donor.")
+		form.Merge(in.Validate())
+		if !form.Valid() {
+			renderDonorEdit(w, tmpl, r, db, id, form, "Please correct the highlighted fields.")
 			return
 		}
-		_, err = db.Exec("UPDATE donors SET name = ?, blood_type_id = ?, phone = ?, city = ? WHERE id = ?", name, bloodTypeID, phone, city, id)
-		if err != nil {
-			renderWithMessage(w, tmpl, db, "Could not update donor.")
+		if err := updateDonor(db, id, in); err != nil {
+			renderDonorEdit(w, tmpl, r, db, id, form, "Could not update donor.")
 			return
 		}
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		http.Redirect(w, r, fmt.Sprintf("/donors/%d", id), http.StatusSeeOther)
 	})
 
 	mux.HandleFunc("/donors/delete", func(w http.ResponseWriter, r *http.Request) {
@@ -348,15 +572,19 @@ func main() {
 		}
 		id, _ := strconv.Atoi(r.FormValue("id"))
 		if id == 0 {
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+			http.Redirect(w, r, "/donors", http.StatusSeeOther)
 			return
 		}
-		_, err := db.Exec("UPDATE donors SET deleted_at = ? WHERE id = ?", time.Now().Format("2006-01-02"), id)
+		problem, err := deleteDonor(db, id, r.FormValue("mode"))
 		if err != nil {
-			renderWithMessage(w, tmpl, db, "Could not delete donor.")
+			renderDonor(w, tmpl, r, db, id, Form{}, "Could not delete donor.")
+			return
+		}
+		if problem != "" {
+			renderDonor(w, tmpl, r, db, id, Form{}, problem)
 			return
 		}
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		http.Redirect(w, r, "/donors", http.StatusSeeOther)
 	})
 
 	mux.HandleFunc("/recipients/update", func(w http.ResponseWriter, r *http.Request) {
@@ -365,25 +593,24 @@ func main() {
 			return
 		}
 		id, _ := strconv.Atoi(r.FormValue("id"))
-		name := strings.TrimSpace(r.FormValue("name"))
-		bloodType := normalizeBloodType(r.FormValue("blood_type"))
-		phone := strings.TrimSpace(r.FormValue("phone"))
-		hospital := strings.TrimSpace(r.FormValue("hospital"))
-		if id == 0 || name == "" || bloodType == "" {
-			renderWithMessage(w, tmpl, db, "Recipient update requires id, name, and blood type.")
-			return
+		in, form := recipientForm(r)
+		if !isAdmin(r) {
+			stored, ok := loadRecipientData(w, db, id, "")
+			if !ok {
+				return
+			}
+			unmaskRecipientInput(stored.Recipient, &in)
 		}
-		bloodTypeID, err := getOrCreateBloodTypeID(db, bloodType)
-		if err != nil {
-			renderWithMessage(w, tmpl, db, "Could not update recipient.")
+		form.Merge(in.Validate())
+		if !form.Valid() {
+			renderRecipientEdit(w, tmpl, r, db, id, form, "Please correct the highlighted fields.")
 			return
 		}
-		_, err = db.Exec("UPDATE recipients SET name = ?, blood_type_id = ?, phone = ?, hospital = ? WHERE id = ?", name, bloodTypeID, phone, hospital, id)
-		if err != nil {
-			renderWithMessage(w, tmpl, db, "Could not update recipient.")
+		if err := updateRecipient(db, id, in); err != nil {
+			renderRecipientEdit(w, tmpl, r, db, id, form, "Could not update recipient.")
 			return
 		}
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		http.Redirect(w, r, fmt.Sprintf("/recipients/%d", id), http.StatusSeeOther)
 	})
 
 	mux.HandleFunc("/recipients/delete", func(w http.ResponseWriter, r *http.Request) {
@@ -393,15 +620,19 @@ func main() {
 		}
 		id, _ := strconv.Atoi(r.FormValue("id"))
 		if id == 0 {
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+			http.Redirect(w, r, "/recipients", http.StatusSeeOther)
 			return
 		}
-		_, err := db.Exec("UPDATE recipients SET deleted_at = ? WHERE id = ?", time.Now().Format("2006-01-02"), id)
+		problem, err := deleteRecipient(db, id, r.FormValue("mode"))
 		if err != nil {
-			renderWithMessage(w, tmpl, db, "Could not delete recipient.")
+			renderRecipient(w, tmpl, r, db, id, "Could not delete recipient.")
+			return
+		}
+		if problem != "" {
+			renderRecipient(w, tmpl, r, db, id, problem)
 			return
 		}
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		http.Redirect(w, r, "/recipients", http.StatusSeeOther)
 	})
 
 	mux.HandleFunc("/fulfill", func(w http.ResponseWriter, r *http.Request) {
@@ -411,7 +642,7 @@ func main() {
 		}
 		id, _ := strconv.Atoi(r.FormValue("id"))
 		if id == 0 {
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+			http.Redirect(w, r, "/requests", http.StatusSeeOther)
 			return
 		}
 		var units int
@@ -420,27 +651,44 @@ func main() {
 			SELECT recipients.blood_type_id, r.units
 			FROM requests r
 			JOIN recipients ON recipients.id = r.recipient_id
-			WHERE r.id = ?
+			WHERE r.id = ? AND r.deleted_at IS NULL AND r.status = 'Pending'
 		`, id).Scan(&bloodTypeID, &units)
 		if err != nil {
-			renderWithMessage(w, tmpl, db, "Request not found.")
+			renderRequest(w, tmpl, db, id, Form{}, "Request not found.")
 			return
 		}
-		ok, err := consumeInventoryByTypeID(db, bloodTypeID, units)
-		if err != nil {
-			renderWithMessage(w, tmpl, db, "Inventory update failed.")
+		if scanned := scannedLines(r.FormValue("scanned")); len(scanned) > 0 {
+			donationIDs, problem, err := scanDonations(db, scanned)
+			if err != nil {
+				renderRequest(w, tmpl, db, id, Form{}, "Inventory update failed.")
+				return
+			}
+			if problem != "" {
+				renderRequest(w, tmpl, db, id, Form{}, problem)
+				return
+			}
+			problem, err = fulfillRequestFromUnits(db, id, bloodTypeID, units, donationIDs)
+			if err != nil {
+				renderRequest(w, tmpl, db, id, Form{}, "Inventory update failed.")
+				return
+			}
+			if problem != "" {
+				renderRequest(w, tmpl, db, id, Form{}, problem)
+				return
+			}
+			http.Redirect(w, r, fmt.Sprintf("/requests/%d", id), http.StatusSeeOther)
 			return
 		}
-		if !ok {
-			renderWithMessage(w, tmpl, db, "Not enough inventory to fulfill request.")
+		ok, err := fulfillRequest(db, id, bloodTypeID, units)
+		if err != nil {
+			renderRequest(w, tmpl, db, id, Form{}, "Inventory update failed.")
 			return
 		}
-		_, err = db.Exec("UPDATE requests SET status = ? WHERE id = ?", "Fulfilled", id)
-		if err != nil {
-			renderWithMessage(w, tmpl, db, "Could not update request.")
+		if !ok {
+			renderRequest(w, tmpl, db, id, Form{}, "Not enough inventory to fulfill request.")
 			return
 		}
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		http.Redirect(w, r, fmt.Sprintf("/requests/%d", id), http.StatusSeeOther)
 	})
 
 	mux.HandleFunc("/requests/update", func(w http.ResponseWriter, r *http.Request) {
@@ -449,24 +697,25 @@ func main() {
 			return
 		}
 		id, _ := strconv.Atoi(r.FormValue("id"))
-		units, _ := strconv.Atoi(r.FormValue("units"))
-		status := strings.TrimSpace(r.FormValue("status"))
-		if id == 0 || units <= 0 || status == "" {
-			renderWithMessage(w, tmpl, db, "Request update requires id, units, and status.")
+		in, form := requestUpdateForm(r)
+		form.Merge(in.Validate())
+		if !form.Valid() {
+			renderRequest(w, tmpl, db, id, form, "Please correct the highlighted fields.")
 			return
 		}
+		units, status := in.Units, in.Status
 
 		var oldUnits int
 		var oldStatus string
 		err := db.QueryRow("SELECT units, status FROM requests WHERE id = ? AND deleted_at IS NULL", id).Scan(&oldUnits, &oldStatus)
 		if err != nil {
-			renderWithMessage(w, tmpl, db, "Request not found.")
+			renderRequest(w, tmpl, db, id, form, "Request not found.")
 			return
 		}
 
 		if oldStatus == "Fulfilled" {
 			if status != "Fulfilled" || oldUnits != units {
-				renderWithMessage(w, tmpl, db, "Cannot modify a fulfilled request.")
+				renderRequest(w, tmpl, db, id, form, "Cannot modify a fulfilled request.")
 				return
 			}
 		}
@@ -474,26 +723,26 @@ func main() {
 		if oldStatus != "Fulfilled" && status == "Fulfilled" {
 			bloodTypeID, err := getRequestBloodTypeID(db, id)
 			if err != nil {
-				renderWithMessage(w, tmpl, db, "Request is missing blood type.")
+				renderRequest(w, tmpl, db, id, form, "Request is missing blood type.")
 				return
 			}
-			ok, err := consumeInventoryByTypeID(db, bloodTypeID, units)
+			ok, err := fulfillRequest(db, id, bloodTypeID, units)
 			if err != nil {
-				renderWithMessage(w, tmpl, db, "Inventory update failed.")
+				renderRequest(w, tmpl, db, id, form, "Inventory update failed.")
 				return
 			}
 			if !ok {
-				renderWithMessage(w, tmpl, db, "Not enough inventory to fulfill request.")
+				renderRequest(w, tmpl, db, id, form, "Not enough inventory to fulfill request.")
+				return
+			}
+		} else {
+			_, err = db.Exec("UPDATE requests SET units = ?, status = ? WHERE id = ?", units, status, id)
+			if err != nil {
+				renderRequest(w, tmpl, db, id, form, "Could not update request.")
 				return
 			}
 		}
-
-		_, err = db.Exec("UPDATE requests SET units = ?, status = ? WHERE id = ?", units, status, id)
-		if err != nil {
-			renderWithMessage(w, tmpl, db, "Could not update request.")
-			return
-		}
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		http.Redirect(w, r, fmt.Sprintf("/requests/%d", id), http.StatusSeeOther)
 	})
 
 	mux.HandleFunc("/requests/delete", func(w http.ResponseWriter, r *http.Request) {
@@ -503,27 +752,59 @@ func main() {
 		}
 		id, _ := strconv.Atoi(r.FormValue("id"))
 		if id == 0 {
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+			http.Redirect(w, r, "/requests", http.StatusSeeOther)
 			return
 		}
 		var status string
 		err := db.QueryRow("SELECT status FROM requests WHERE id = ? AND deleted_at IS NULL", id).Scan(&status)
 		if err != nil {
-			renderWithMessage(w, tmpl, db, "Request not found.")
+			renderRequest(w, tmpl, db, id, Form{}, "Request not found.")
 			return
 		}
 		if status == "Fulfilled" {
-			renderWithMessage(w, tmpl, db, "Cannot delete a fulfilled request.")
+			renderRequest(w, tmpl, db, id, Form{}, "Cannot delete a fulfilled request.")
 			return
 		}
-		_, err = db.Exec("UPDATE requests SET status = ?, deleted_at = ? WHERE id = ?", "Cancelled", time.Now().Format("2006-01-02"), id)
+		_, err = db.Exec("UPDATE requests SET status = ?, deleted_at = ? WHERE id = ?", "Cancelled", nowTimestamp(), id)
 		if err != nil {
-			renderWithMessage(w, tmpl, db, "Could not delete request.")
+			renderRequest(w, tmpl, db, id, Form{}, "Could not delete request.")
 			return
 		}
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		http.Redirect(w, r, "/requests", http.StatusSeeOther)
 	})
 
+	registerLookbackRoutes(mux, tmpl, db)
+	registerReturnRoutes(mux, tmpl, db)
+	registerDiscardRoutes(mux, tmpl, db)
+	registerRevisionRoutes(mux, tmpl, db)
+	registerTrashRoutes(mux, tmpl, db)
+	registerMergeRoutes(mux, tmpl, db)
+	registerDonorCardRoutes(mux, tmpl, db)
+	registerLabelRoutes(mux, tmpl, db)
+	registerCodeRoutes(mux, tmpl, db)
+	registerCampRoutes(mux, tmpl, db)
+	registerDeferralRoutes(mux, tmpl, db)
+	registerAppointmentRoutes(mux, tmpl, db)
+	registerRecallRoutes(mux, tmpl, db)
+	registerStockLevelRoutes(mux, tmpl, db)
+	registerForecastRoutes(mux, tmpl, db)
+	registerReportRoutes(mux, tmpl, db)
+	registerSnapshotRoutes(mux, tmpl, db)
+	registerImportRoutes(mux, tmpl, db)
+	registerExportRoutes(mux, db)
+	registerAPIRoutes(mux, db)
+
+	notify := notifyConfigFromEnv()
+	notifiers := notify.notifiers()
+	registerNotificationRoutes(mux, tmpl, db, notifiers, notify)
+	backups := backupConfigFromEnv()
+	registerAdminRoutes(mux, tmpl, db, backups)
+
+	go runPurgeJob(db)
+	go runNotificationJob(db, notifiers, notify)
+	go runSnapshotJob(db)
+	go runBackupJob(db, backups)
+
 	addr := ":8080"
 	log.Println("Blood Bank DBMS running on", addr)
 	if err := http.ListenAndServe(addr, mux); err != nil {
@@ -553,10 +834,84 @@ func initDB(db *sql.DB) error {
 	if err := ensureColumn(db, "requests", "deleted_at", "TEXT"); err != nil {
 		return err
 	}
+	if err := ensureColumn(db, "donors", "email", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "donors", "date_of_birth", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "donors", "merged_into", "INTEGER REFERENCES donors(id)"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "donors", "donor_number", "TEXT"); err != nil {
+		return err
+	}
+	if err := assignDonorNumbers(db); err != nil {
+		return err
+	}
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_donors_donor_number ON donors(donor_number)"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "donations", "remaining_units", "INTEGER"); err != nil {
+		return err
+	}
+	if err := backfillRemainingUnits(db); err != nil {
+		return err
+	}
+	if err := seedComponents(db); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "donations", "component_id", "INTEGER REFERENCES components(id)"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE donations SET component_id = (SELECT id FROM components WHERE name = ?) WHERE component_id IS NULL", defaultComponent); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "components", "isbt_code", "TEXT"); err != nil {
+		return err
+	}
+	if err := seedComponentCodes(db); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "requests", "issued_units", "INTEGER"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE requests SET issued_units = CASE WHEN status = 'Fulfilled' THEN units ELSE 0 END WHERE issued_units IS NULL"); err != nil {
+		return err
+	}
 	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_inventory_blood_type_id ON inventory(blood_type_id)"); err != nil {
 		return err
 	}
-	return nil
+	if err := normalizeDates(db); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "donations", "din", "TEXT"); err != nil {
+		return err
+	}
+	if err := assignMissingDINs(db); err != nil {
+		return err
+	}
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_donations_din ON donations(din)"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "donations", "camp_id", "INTEGER REFERENCES camps(id)"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "donations", "units_out_at_import", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "recall_contacts", "messaged_at", "TEXT"); err != nil {
+		return err
+	}
+	// A level without a component covers all components of a blood type.
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_stock_levels_type_component ON stock_levels(blood_type_id, COALESCE(component_id, 0))"); err != nil {
+		return err
+	}
+	// A snapshot without a component is the total of its blood type.
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_inventory_snapshots_day ON inventory_snapshots(snapshot_date, blood_type_id, COALESCE(component_id, 0))"); err != nil {
+		return err
+	}
+	return normalizeStoredPhones(db)
 }
 
 func ensureColumn(db *sql.DB, table string, column string, colType string) error {
@@ -588,11 +943,89 @@ func ensureColumn(db *sql.DB, table string, column string, colType string) error
 	return err
 }
 
+// backfillRemainingUnits fills remaining_units for donations recorded before
+// it existed. Each blood type's current inventory is spread over its newest
+// donations, assuming older units were issued first.
+func backfillRemainingUnits(db *sql.DB) error {
+	if _, err := db.Exec("UPDATE donations SET remaining_units = 0 WHERE remaining_units IS NULL AND deleted_at IS NOT NULL"); err != nil {
+		return err
+	}
+	rows, err := db.Query(`
+		SELECT d.id, d.units, donors.blood_type_id
+		FROM donations d
+		JOIN donors ON donors.id = d.donor_id
+		WHERE d.remaining_units IS NULL
+		ORDER BY d.expiry_date DESC, d.id DESC
+	`)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id          int
+		units       int
+		bloodTypeID int
+	}
+	var donations []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.units, &p.bloodTypeID); err != nil {
+			rows.Close()
+			return err
+		}
+		donations = append(donations, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	left := map[int]int{}
+	for _, p := range donations {
+		if _, seen := left[p.bloodTypeID]; !seen {
+			var stock int
+			err := db.QueryRow(`
+				SELECT COALESCE((SELECT units FROM inventory WHERE blood_type_id = ? AND deleted_at IS NULL), 0)
+					- COALESCE((SELECT SUM(d.remaining_units) FROM donations d JOIN donors ON donors.id = d.donor_id
+						WHERE donors.blood_type_id = ? AND d.remaining_units IS NOT NULL), 0)
+			`, p.bloodTypeID, p.bloodTypeID).Scan(&stock)
+			if err != nil {
+				return err
+			}
+			left[p.bloodTypeID] = max(stock, 0)
+		}
+		remaining := min(p.units, left[p.bloodTypeID])
+		left[p.bloodTypeID] -= remaining
+		if _, err := db.Exec("UPDATE donations SET remaining_units = ? WHERE id = ?", remaining, p.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bloodTypeSigns spells out the Rh sign as spreadsheets often write it,
+// longest first.
+var bloodTypeSigns = []struct{ suffix, sign string }{
+	{"POSITIVE", "+"}, {"NEGATIVE", "-"}, {"POS", "+"}, {"NEG", "-"}, {"+VE", "+"}, {"-VE", "-"},
+}
+
+// normalizeBloodType upper-cases a blood type and writes variants such as
+// "a pos", "O -ve" or "AB Negative" as A+, O- and AB-.
 func normalizeBloodType(value string) string {
-	return strings.ToUpper(strings.TrimSpace(value))
+	value = strings.ToUpper(strings.TrimSpace(value))
+	compact := strings.Join(strings.Fields(value), "")
+	for _, s := range bloodTypeSigns {
+		group, ok := strings.CutSuffix(compact, s.suffix)
+		if ok && (group == "A" || group == "B" || group == "AB" || group == "O") {
+			return group + s.sign
+		}
+	}
+	if slices.Contains(bloodTypes, compact) {
+		return compact
+	}
+	return value
 }
 
-func getOrCreateBloodTypeID(db *sql.DB, bloodType string) (int, error) {
+func getOrCreateBloodTypeID(db querier, bloodType string) (int, error) {
 	bloodType = normalizeBloodType(bloodType)
 	if bloodType == "" {
 		return 0, fmt.Errorf("blood type required")
@@ -874,107 +1307,97 @@ func migrateTo3NF(db *sql.DB) error {
 	return nil
 }
 
-func renderWithMessage(w http.ResponseWriter, tmpl *template.Template, db *sql.DB, msg string) {
-	data, err := loadPageData(db, msg)
-	if err != nil {
-		http.Error(w, "server error", http.StatusInternalServerError)
-		return
-	}
-	if err := tmpl.Execute(w, data); err != nil {
-		log.Println("template error:", err)
-	}
+// loadDonor loads an active donor, or reports sql.ErrNoRows.
+func loadDonor(db *sql.DB, id int) (Donor, error) {
+	var d Donor
+	err := db.QueryRow(`
+		SELECT d.id, COALESCE(d.donor_number, ''), d.name, bt.type, d.phone, d.city, COALESCE(d.email, ''), COALESCE(d.date_of_birth, ''), d.created_at
+		FROM donors d
+		JOIN blood_types bt ON bt.id = d.blood_type_id
+		WHERE d.id = ? AND d.deleted_at IS NULL
+	`, id).Scan(&d.ID, &d.DonorNumber, &d.Name, &d.BloodType, &d.Phone, &d.City, &d.Email, &d.DateOfBirth, &d.CreatedAt)
+	return d, err
 }
 
-func loadPageData(db *sql.DB, msg string) (PageData, error) {
-	data := PageData{Message: msg}
+// loadRecipient loads an active recipient, or reports sql.ErrNoRows.
+func loadRecipient(db *sql.DB, id int) (Recipient, error) {
+	var r Recipient
+	err := db.QueryRow(`
+		SELECT r.id, r.name, bt.type, r.phone, r.hospital, r.created_at
+		FROM recipients r
+		JOIN blood_types bt ON bt.id = r.blood_type_id
+		WHERE r.id = ? AND r.deleted_at IS NULL
+	`, id).Scan(&r.ID, &r.Name, &r.BloodType, &r.Phone, &r.Hospital, &r.CreatedAt)
+	return r, err
+}
 
-	donors, err := loadDonors(db)
-	if err != nil {
-		return data, err
-	}
-	data.Donors = donors
+// pickerSize caps the matches a donor or recipient picker offers; staff
+// narrow the search rather than scroll through every record.
+const pickerSize = 20
 
-	recipients, err := loadRecipients(db)
-	if err != nil {
-		return data, err
+// pickDonors loads the options of a donor picker: the donor already chosen,
+// if any, then the first donors matching the search. Without a search only
+// the chosen donor is offered, so a form never loads the whole table.
+func pickDonors(db *sql.DB, chosen int, query string) ([]Donor, error) {
+	var donors []Donor
+	if chosen != 0 {
+		d, err := loadDonor(db, chosen)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if err == nil {
+			donors = append(donors, d)
+		}
 	}
-	data.Recipients = recipients
-
-	donations, err := loadDonations(db)
-	if err != nil {
-		return data, err
+	if query == "" {
+		return donors, nil
 	}
-	data.Donations = donations
-
-	inventory, err := loadInventory(db)
+	page, err := loadDonorPage(db, ListFilter{Query: query, Sort: "name", Limit: pickerSize})
 	if err != nil {
-		return data, err
+		return nil, err
 	}
-	data.Inventory = inventory
-
-	requests, err := loadRequests(db)
-	if err != nil {
-		return data, err
+	for _, d := range page.Items {
+		if d.ID != chosen {
+			donors = append(donors, d)
+		}
 	}
-	data.Requests = requests
-
-	return data, nil
+	return donors, nil
 }
 
-func loadDonors(db *sql.DB) ([]Donor, error) {
-	rows, err := db.Query(`
-		SELECT d.id, d.name, bt.type, d.phone, d.city, d.created_at
-		FROM donors d
-		JOIN blood_types bt ON bt.id = d.blood_type_id
-		WHERE d.deleted_at IS NULL
-		ORDER BY d.id DESC
-	`)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var donors []Donor
-	for rows.Next() {
-		var d Donor
-		if err := rows.Scan(&d.ID, &d.Name, &d.BloodType, &d.Phone, &d.City, &d.CreatedAt); err != nil {
+// pickRecipients is pickDonors for recipients.
+func pickRecipients(db *sql.DB, chosen int, query string) ([]Recipient, error) {
+	var recipients []Recipient
+	if chosen != 0 {
+		r, err := loadRecipient(db, chosen)
+		if err != nil && err != sql.ErrNoRows {
 			return nil, err
 		}
-		donors = append(donors, d)
+		if err == nil {
+			recipients = append(recipients, r)
+		}
 	}
-	return donors, rows.Err()
-}
-
-func loadRecipients(db *sql.DB) ([]Recipient, error) {
-	rows, err := db.Query(`
-		SELECT r.id, r.name, bt.type, r.phone, r.hospital, r.created_at
-		FROM recipients r
-		JOIN blood_types bt ON bt.id = r.blood_type_id
-		WHERE r.deleted_at IS NULL
-		ORDER BY r.id DESC
-	`)
+	if query == "" {
+		return recipients, nil
+	}
+	page, err := loadRecipientPage(db, ListFilter{Query: query, Sort: "name", Limit: pickerSize})
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var recipients []Recipient
-	for rows.Next() {
-		var r Recipient
-		if err := rows.Scan(&r.ID, &r.Name, &r.BloodType, &r.Phone, &r.Hospital, &r.CreatedAt); err != nil {
-			return nil, err
+	for _, r := range page.Items {
+		if r.ID != chosen {
+			recipients = append(recipients, r)
 		}
-		recipients = append(recipients, r)
 	}
-	return recipients, rows.Err()
+	return recipients, nil
 }
 
 func loadDonations(db *sql.DB) ([]Donation, error) {
 	rows, err := db.Query(`
-		SELECT d.id, d.donor_id, donors.name, bt.type, d.units, d.donation_date, d.expiry_date
+		SELECT d.id, COALESCE(d.din, ''), d.donor_id, donors.name, bt.type, c.name, d.units, COALESCE(d.remaining_units, 0), d.donation_date, d.expiry_date
 		FROM donations d
 		JOIN donors ON donors.id = d.donor_id
 		JOIN blood_types bt ON bt.id = donors.blood_type_id
+		JOIN components c ON c.id = d.component_id
 		WHERE d.deleted_at IS NULL
 		ORDER BY d.id DESC
 	`)
@@ -986,7 +1409,7 @@ func loadDonations(db *sql.DB) ([]Donation, error) {
 	var donations []Donation
 	for rows.Next() {
 		var d Donation
-		if err := rows.Scan(&d.ID, &d.DonorID, &d.DonorName, &d.BloodType, &d.Units, &d.DonationDate, &d.ExpiryDate); err != nil {
+		if err := rows.Scan(&d.ID, &d.DIN, &d.DonorID, &d.DonorName, &d.BloodType, &d.Component, &d.Units, &d.RemainingUnits, &d.DonationDate, &d.ExpiryDate); err != nil {
 			return nil, err
 		}
 		donations = append(donations, d)
@@ -1018,32 +1441,7 @@ func loadInventory(db *sql.DB) ([]Inventory, error) {
 	return inv, rows.Err()
 }
 
-func loadRequests(db *sql.DB) ([]Request, error) {
-	rows, err := db.Query(`
-		SELECT r.id, r.recipient_id, recipients.name, bt.type, r.units, r.status, r.request_date
-		FROM requests r
-		JOIN recipients ON recipients.id = r.recipient_id
-		JOIN blood_types bt ON bt.id = recipients.blood_type_id
-		WHERE r.deleted_at IS NULL
-		ORDER BY r.id DESC
-	`)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var requests []Request
-	for rows.Next() {
-		var r Request
-		if err := rows.Scan(&r.ID, &r.RecipientID, &r.Recipient, &r.BloodType, &r.Units, &r.Status, &r.RequestDate); err != nil {
-			return nil, err
-		}
-		requests = append(requests, r)
-	}
-	return requests, rows.Err()
-}
-
-func upsertInventoryByTypeID(db *sql.DB, bloodTypeID int, units int) error {
+func upsertInventoryByTypeID(db querier, bloodTypeID int, units int) error {
 	res, err := db.Exec("UPDATE inventory SET units = units + ?, deleted_at = NULL WHERE blood_type_id = ?", units, bloodTypeID)
 	if err != nil {
 		return err
@@ -1054,12 +1452,14 @@ func upsertInventoryByTypeID(db *sql.DB, bloodTypeID int, units int) error {
 	}
 	if affected == 0 {
 		_, err = db.Exec("INSERT INTO inventory (blood_type_id, units, deleted_at) VALUES (?, ?, NULL)", bloodTypeID, units)
-		return err
+		if err != nil {
+			return err
+		}
 	}
-	return nil
+	return checkStockLevels(db, bloodTypeID)
 }
 
-func consumeInventoryByTypeID(db *sql.DB, bloodTypeID int, units int) (bool, error) {
+func consumeInventoryByTypeID(db querier, bloodTypeID int, units int) (bool, error) {
 	var current int
 	err := db.QueryRow("SELECT units FROM inventory WHERE blood_type_id = ? AND deleted_at IS NULL", bloodTypeID).Scan(&current)
 	if err == sql.ErrNoRows {
@@ -1075,5 +1475,310 @@ func consumeInventoryByTypeID(db *sql.DB, bloodTypeID int, units int) (bool, err
 	if err != nil {
 		return false, err
 	}
-	return true, nil
+	return true, checkStockLevels(db, bloodTypeID)
+}
+
+// fulfillRequest takes units of the request's blood type out of inventory,
+// records which donations they were issued from, so the units stay traceable,
+// and marks the request fulfilled, all in one transaction. It reports false,
+// changing nothing, when inventory or the donations in stock cannot cover
+// the request.
+func fulfillRequest(db *sql.DB, requestID int, bloodTypeID int, units int) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Units are taken from donations first so the stock level check in
+	// consumeInventoryByTypeID sees them gone; a shortfall rolls both back.
+	ok, err := issueFromDonations(tx, requestID, bloodTypeID, units)
+	if err != nil || !ok {
+		return false, err
+	}
+	ok, err = consumeInventoryByTypeID(tx, bloodTypeID, units)
+	if err != nil || !ok {
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE requests SET units = ?, issued_units = ?, status = 'Fulfilled' WHERE id = ?", units, units, requestID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// issueFromDonations allocates units to a request from the donations of the
+// given blood type that still have unexpired stock, earliest expiry first.
+// It reports false when those donations hold fewer units than the request
+// needs, since every unit issued must be traceable to its donor and in date.
+func issueFromDonations(db querier, requestID int, bloodTypeID int, units int) (bool, error) {
+	rows, err := db.Query(`
+		SELECT d.id, d.remaining_units
+		FROM donations d
+		JOIN donors ON donors.id = d.donor_id
+		WHERE donors.blood_type_id = ? AND d.deleted_at IS NULL AND d.remaining_units > 0 AND d.expiry_date >= ?
+		ORDER BY d.expiry_date, d.id
+	`, bloodTypeID, todayDate())
+	if err != nil {
+		return false, err
+	}
+	type stock struct {
+		donationID int
+		units      int
+	}
+	var available []stock
+	for rows.Next() {
+		var s stock
+		if err := rows.Scan(&s.donationID, &s.units); err != nil {
+			rows.Close()
+			return false, err
+		}
+		available = append(available, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	issuedAt := nowTimestamp()
+	for _, s := range available {
+		if units == 0 {
+			break
+		}
+		take := min(s.units, units)
+		if err := issueUnits(db, requestID, s.donationID, take, issuedAt); err != nil {
+			return false, err
+		}
+		units -= take
+	}
+	return units == 0, nil
+}
+
+func issueUnits(db querier, requestID int, donationID int, units int, issuedAt string) error {
+	if _, err := db.Exec(
+		"INSERT INTO issues (request_id, donation_id, units, issue_date) VALUES (?, ?, ?, ?)",
+		requestID, donationID, units, issuedAt,
+	); err != nil {
+		return err
+	}
+	_, err := db.Exec("UPDATE donations SET remaining_units = remaining_units - ? WHERE id = ?", units, donationID)
+	return err
+}
+
+// fulfillRequestFromUnits issues a request from the units scanned at the
+// fridge, in scan order, rather than picking units by expiry. A non-empty
+// problem explains why the scanned units cannot be issued and nothing was
+// changed.
+func fulfillRequestFromUnits(db *sql.DB, requestID int, bloodTypeID int, units int, donationIDs []int) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	issuedAt := nowTimestamp()
+	needed := units
+	for _, id := range donationIDs {
+		var din, expiry string
+		var unitType, remaining int
+		err := tx.QueryRow(`
+			SELECT d.din, d.expiry_date, donors.blood_type_id, COALESCE(d.remaining_units, 0)
+			FROM donations d
+			JOIN donors ON donors.id = d.donor_id
+			WHERE d.id = ? AND d.deleted_at IS NULL
+		`, id).Scan(&din, &expiry, &unitType, &remaining)
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case needed == 0:
+			return fmt.Sprintf("Unit %s is not needed; the units scanned before it cover the request.", din), nil
+		case unitType != bloodTypeID:
+			return fmt.Sprintf("Unit %s is a different blood type from the request.", din), nil
+		case expiry < todayDate():
+			return fmt.Sprintf("Unit %s expired on %s.", din, expiry), nil
+		case remaining == 0:
+			return fmt.Sprintf("Unit %s has no units left in stock.", din), nil
+		}
+		take := min(remaining, needed)
+		if err := issueUnits(tx, requestID, id, take, issuedAt); err != nil {
+			return "", err
+		}
+		needed -= take
+	}
+	if needed > 0 {
+		return fmt.Sprintf("The scanned units cover %d of the %d units requested; scan more units.", units-needed, units), nil
+	}
+	ok, err := consumeInventoryByTypeID(tx, bloodTypeID, units)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "Not enough inventory to fulfill request.", nil
+	}
+	if _, err := tx.Exec("UPDATE requests SET issued_units = ?, status = 'Fulfilled' WHERE id = ?", units, requestID); err != nil {
+		return "", err
+	}
+	return "", tx.Commit()
+}
+
+// removeInventoryByTypeID takes units out of inventory without requiring them
+// to be available, stopping at zero. It is used when correcting records, where
+// refusing would leave a known-bad entry in place.
+func removeInventoryByTypeID(db querier, bloodTypeID int, units int) error {
+	_, err := db.Exec("UPDATE inventory SET units = MAX(units - ?, 0) WHERE blood_type_id = ?", units, bloodTypeID)
+	if err != nil {
+		return err
+	}
+	return checkStockLevels(db, bloodTypeID)
+}
+
+func createDonor(db *sql.DB, in DonorInput) (int, error) {
+	bloodTypeID, err := getOrCreateBloodTypeID(db, in.BloodType)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := insertDonor(tx, bloodTypeID, in)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// insertDonor adds a donor and gives them a donor number.
+func insertDonor(db querier, bloodTypeID int, in DonorInput) (int, error) {
+	res, err := db.Exec(
+		"INSERT INTO donors (name, blood_type_id, phone, city, email, date_of_birth, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		in.Name, bloodTypeID, in.Phone, in.City, in.Email, nullIfEmpty(in.DateOfBirth), nowTimestamp(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := db.Exec("UPDATE donors SET donor_number = ? WHERE id = ?", formatDonorNumber(int(id)), id); err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+func updateDonor(db *sql.DB, id int, in DonorInput) error {
+	bloodTypeID, err := getOrCreateBloodTypeID(db, in.BloodType)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		"UPDATE donors SET name = ?, blood_type_id = ?, phone = ?, city = ?, email = ?, date_of_birth = ? WHERE id = ?",
+		in.Name, bloodTypeID, in.Phone, in.City, in.Email, nullIfEmpty(in.DateOfBirth), id,
+	)
+	return err
+}
+
+func createRecipient(db *sql.DB, in RecipientInput) (int, error) {
+	bloodTypeID, err := getOrCreateBloodTypeID(db, in.BloodType)
+	if err != nil {
+		return 0, err
+	}
+	return insertRecipient(db, bloodTypeID, in)
+}
+
+func insertRecipient(db querier, bloodTypeID int, in RecipientInput) (int, error) {
+	res, err := db.Exec(
+		"INSERT INTO recipients (name, blood_type_id, phone, hospital, created_at) VALUES (?, ?, ?, ?, ?)",
+		in.Name, bloodTypeID, in.Phone, in.Hospital, nowTimestamp(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func updateRecipient(db *sql.DB, id int, in RecipientInput) error {
+	bloodTypeID, err := getOrCreateBloodTypeID(db, in.BloodType)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE recipients SET name = ?, blood_type_id = ?, phone = ?, hospital = ? WHERE id = ?", in.Name, bloodTypeID, in.Phone, in.Hospital, id)
+	return err
+}
+
+// createDonation records a donation and adds its units to inventory.
+func createDonation(db *sql.DB, in DonationInput) (int, error) {
+	bloodTypeID, err := getDonorBloodTypeID(db, in.DonorID)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"INSERT INTO donations (donor_id, component_id, camp_id, units, donation_date, expiry_date, remaining_units) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		in.DonorID, in.ComponentID, nullIfZero(in.CampID), in.Units, in.DonationDate, in.ExpiryDate, in.Units,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := assignDIN(tx, int(id), in.DonationDate); err != nil {
+		return 0, err
+	}
+	if in.CampID != 0 {
+		if err := registerCampDonor(tx, in.CampID, in.DonorID, nowTimestamp()); err != nil {
+			return 0, err
+		}
+	}
+	if in.AppointmentID != 0 {
+		if _, err := tx.Exec("UPDATE appointments SET status = ?, donation_id = ? WHERE id = ?", appointmentDonated, id, in.AppointmentID); err != nil {
+			return 0, err
+		}
+	}
+	if err := upsertInventoryByTypeID(tx, bloodTypeID, in.Units); err != nil {
+		return 0, err
+	}
+	key := fmt.Sprintf("thank_you:%d", id)
+	if err := notifyDonor(tx, in.DonorID, "thank_you", key, map[string]any{"Date": in.DonationDate}); err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+func createRequest(db *sql.DB, in RequestInput) (int, error) {
+	res, err := db.Exec(
+		"INSERT INTO requests (recipient_id, units, status, request_date) VALUES (?, ?, ?, ?)",
+		in.RecipientID, in.Units, "Pending", nowTimestamp(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	// The request is recorded either way; a failed alert is only logged.
+	if err := notifyUnmetRequest(db, int(id)); err != nil {
+		log.Println("notification error:", err)
+	}
+	return int(id), nil
+}
+
+// nullIfEmpty stores an optional value as NULL rather than an empty string.
+func nullIfEmpty(value string) any {
+	if value == "" {
+		return nil
+	}
+	return value
 }
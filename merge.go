@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+type DonorMergeData struct {
+	Target     Donor
+	Candidates []Donor
+	Duplicates []Donor
+	Query      string
+	Message    string
+}
+
+func registerMergeRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/donors/{id}/merge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		renderDonorMerge(w, tmpl, r, db, id, "")
+	})
+
+	mux.HandleFunc("/donors/merge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		targetID, _ := strconv.Atoi(r.FormValue("target_id"))
+		sourceID, _ := strconv.Atoi(r.FormValue("source_id"))
+		if targetID == 0 || sourceID == 0 {
+			renderDonorMerge(w, tmpl, r, db, targetID, "Choose the donor record to merge.")
+			return
+		}
+		problem, err := mergeDonors(db, sourceID, targetID)
+		if err != nil {
+			renderDonorMerge(w, tmpl, r, db, targetID, "Could not merge donors.")
+			return
+		}
+		if problem != "" {
+			renderDonorMerge(w, tmpl, r, db, targetID, problem)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/donors/%d", targetID), http.StatusSeeOther)
+	})
+}
+
+func renderDonorMerge(w http.ResponseWriter, tmpl *template.Template, r *http.Request, db *sql.DB, id int, msg string) {
+	donor, ok := loadDonorData(w, db, id, msg)
+	if !ok {
+		return
+	}
+	data := DonorMergeData{Target: donor.Donor, Query: r.FormValue("q"), Message: msg}
+	t := donor.Donor
+	var err error
+	data.Duplicates, err = findDuplicateDonors(db, DonorInput{Name: t.Name, Phone: t.Phone, DateOfBirth: t.DateOfBirth}, id)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	// Only a donor of the same blood type can be merged in: the likely
+	// duplicates, then whoever matches the search.
+	for _, d := range data.Duplicates {
+		if d.BloodType == t.BloodType {
+			data.Candidates = append(data.Candidates, d)
+		}
+	}
+	if data.Query != "" {
+		page, err := loadDonorPage(db, ListFilter{Query: data.Query, BloodType: t.BloodType, Sort: "name", Limit: pickerSize})
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		for _, d := range page.Items {
+			if d.ID != id && !slices.ContainsFunc(data.Candidates, func(c Donor) bool { return c.ID == d.ID }) {
+				data.Candidates = append(data.Candidates, d)
+			}
+		}
+	}
+	if !isAdmin(r) {
+		data.Target = data.Target.Masked()
+	}
+	maskFor(r, data.Candidates)
+	maskFor(r, data.Duplicates)
+	renderPage(w, tmpl, "donor_merge.html", data)
+}
+
+// findDuplicateDonors returns active donors that look like the same person:
+// the same name, ignoring case, and the same phone number or date of birth.
+func findDuplicateDonors(db *sql.DB, in DonorInput, excludeID int) ([]Donor, error) {
+	if in.Phone == "" && in.DateOfBirth == "" {
+		return nil, nil
+	}
+	rows, err := db.Query(`
+		SELECT d.id, COALESCE(d.donor_number, ''), d.name, bt.type, d.phone, d.city, COALESCE(d.email, ''), COALESCE(d.date_of_birth, ''), d.created_at
+		FROM donors d
+		JOIN blood_types bt ON bt.id = d.blood_type_id
+		WHERE d.deleted_at IS NULL AND d.id != ?
+			AND lower(trim(d.name)) = lower(?)
+			AND ((? != '' AND d.phone = ?) OR (? != '' AND d.date_of_birth = ?))
+		ORDER BY d.id
+	`, excludeID, in.Name, in.Phone, in.Phone, in.DateOfBirth, in.DateOfBirth)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var donors []Donor
+	for rows.Next() {
+		var d Donor
+		if err := rows.Scan(&d.ID, &d.DonorNumber, &d.Name, &d.BloodType, &d.Phone, &d.City, &d.Email, &d.DateOfBirth, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		donors = append(donors, d)
+	}
+	return donors, rows.Err()
+}
+
+// mergeDonors folds the source donor into the target: donations, deferrals,
+// appointments, camp attendance and recall calls move to the target, contact details the target lacks are copied over, and the source
+// is soft-deleted with merged_into pointing at the target. A non-empty
+// problem explains why the merge was refused.
+func mergeDonors(db *sql.DB, sourceID int, targetID int) (string, error) {
+	if sourceID == targetID {
+		return "Choose two different donors to merge.", nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var sourceType, targetType int
+	err = tx.QueryRow("SELECT blood_type_id FROM donors WHERE id = ? AND deleted_at IS NULL", sourceID).Scan(&sourceType)
+	if err == sql.ErrNoRows {
+		return "Donor to merge not found.", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	err = tx.QueryRow("SELECT blood_type_id FROM donors WHERE id = ? AND deleted_at IS NULL", targetID).Scan(&targetType)
+	if err == sql.ErrNoRows {
+		return "Donor not found.", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if sourceType != targetType {
+		return "Donors with different blood types cannot be merged.", nil
+	}
+
+	if _, err := tx.Exec("UPDATE donations SET donor_id = ? WHERE donor_id = ?", targetID, sourceID); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("UPDATE deferrals SET donor_id = ? WHERE donor_id = ?", targetID, sourceID); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("UPDATE appointments SET donor_id = ? WHERE donor_id = ?", targetID, sourceID); err != nil {
+		return "", err
+	}
+	// Both records may be signed in at the same camp or listed in the same
+	// recall; the target's entry wins.
+	for _, table := range []string{"camp_donors", "recall_contacts"} {
+		if _, err := tx.Exec("UPDATE OR IGNORE "+table+" SET donor_id = ? WHERE donor_id = ?", targetID, sourceID); err != nil {
+			return "", err
+		}
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE donor_id = ?", sourceID); err != nil {
+			return "", err
+		}
+	}
+	if _, err := tx.Exec(`
+		UPDATE donors SET
+			phone = COALESCE(NULLIF(phone, ''), (SELECT phone FROM donors WHERE id = ?)),
+			city = COALESCE(NULLIF(city, ''), (SELECT city FROM donors WHERE id = ?)),
+			email = COALESCE(NULLIF(email, ''), (SELECT email FROM donors WHERE id = ?)),
+			date_of_birth = COALESCE(date_of_birth, (SELECT date_of_birth FROM donors WHERE id = ?))
+		WHERE id = ?
+	`, sourceID, sourceID, sourceID, sourceID, targetID); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("UPDATE donors SET deleted_at = ?, merged_into = ? WHERE id = ?", nowTimestamp(), targetID, sourceID); err != nil {
+		return "", err
+	}
+	return "", tx.Commit()
+}
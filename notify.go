@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification channels. Messages on the log channel are only ever written
+// to the log sink; they are used for staff alerts when no staff contact is
+// configured. Messages on the staff channel are copied to each staff
+// contact when they are delivered.
+const (
+	channelEmail = "email"
+	channelSMS   = "sms"
+	channelLog   = "log"
+	channelStaff = "staff"
+)
+
+// Message is one notification ready to deliver.
+type Message struct {
+	Channel string `json:"channel"`
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Notifier delivers messages on one channel.
+type Notifier interface {
+	Send(m Message) error
+}
+
+// notifyConfig is read from the environment. Channels without settings are
+// delivered to the log sink, so development needs no mail or SMS service.
+type notifyConfig struct {
+	SMTPAddr     string // host:port
+	SMTPUser     string
+	SMTPPassword string
+	SMTPFrom     string
+	SMSURL       string
+	SMSToken     string
+	SMSSender    string
+	LogPath      string
+	StaffEmails  []string
+	StaffPhones  []string
+}
+
+func notifyConfigFromEnv() notifyConfig {
+	cfg := notifyConfig{
+		SMTPAddr:     os.Getenv("BLOODBANK_SMTP_ADDR"),
+		SMTPUser:     os.Getenv("BLOODBANK_SMTP_USER"),
+		SMTPPassword: os.Getenv("BLOODBANK_SMTP_PASSWORD"),
+		SMTPFrom:     os.Getenv("BLOODBANK_SMTP_FROM"),
+		SMSURL:       os.Getenv("BLOODBANK_SMS_URL"),
+		SMSToken:     os.Getenv("BLOODBANK_SMS_TOKEN"),
+		SMSSender:    os.Getenv("BLOODBANK_SMS_SENDER"),
+		LogPath:      os.Getenv("BLOODBANK_NOTIFY_LOG"),
+		StaffEmails:  splitList(os.Getenv("BLOODBANK_STAFF_EMAILS")),
+		StaffPhones:  splitList(os.Getenv("BLOODBANK_STAFF_PHONES")),
+	}
+	if cfg.LogPath == "" {
+		cfg.LogPath = "notifications.log"
+	}
+	return cfg
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// notifiers returns the notifier for each channel.
+func (cfg notifyConfig) notifiers() map[string]Notifier {
+	sink := &logSink{path: cfg.LogPath}
+	notifiers := map[string]Notifier{channelEmail: sink, channelSMS: sink, channelLog: sink}
+	if cfg.SMTPAddr != "" {
+		notifiers[channelEmail] = &smtpNotifier{addr: cfg.SMTPAddr, user: cfg.SMTPUser, password: cfg.SMTPPassword, from: cfg.SMTPFrom}
+	}
+	if cfg.SMSURL != "" {
+		notifiers[channelSMS] = &smsGateway{
+			url: cfg.SMSURL, token: cfg.SMSToken, sender: cfg.SMSSender,
+			client: &http.Client{Timeout: 15 * time.Second},
+		}
+	}
+	return notifiers
+}
+
+// smtpNotifier sends plain-text email through an SMTP server, using STARTTLS
+// when the server offers it.
+type smtpNotifier struct {
+	addr     string
+	user     string
+	password string
+	from     string
+}
+
+func (n *smtpNotifier) Send(m Message) error {
+	var auth smtp.Auth
+	if n.user != "" {
+		host, _, _ := strings.Cut(n.addr, ":")
+		auth = smtp.PlainAuth("", n.user, n.password, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", m.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return smtp.SendMail(n.addr, auth, n.from, []string{m.To}, msg.Bytes())
+}
+
+// smsGateway posts each text to an HTTP SMS gateway as JSON:
+// {"from": ..., "to": ..., "message": ...}, with the token as a bearer
+// token. Any 2xx response counts as accepted.
+type smsGateway struct {
+	url    string
+	token  string
+	sender string
+	client *http.Client
+}
+
+func (g *smsGateway) Send(m Message) error {
+	body, err := json.Marshal(map[string]string{"from": g.sender, "to": m.To, "message": m.Body})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, g.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.token)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("sms gateway returned %s", resp.Status)
+	}
+	return nil
+}
+
+// logSink appends each message to a file as a line of JSON, standing in for
+// real delivery in development and tests.
+type logSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (s *logSink) Send(m Message) error {
+	if s.path == "" {
+		return errors.New("no notification log configured")
+	}
+	line, err := json.Marshal(struct {
+		Time string `json:"time"`
+		Message
+	}{nowTimestamp(), m})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
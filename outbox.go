@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	texttemplate "text/template"
+	"time"
+)
+
+// Outbox statuses. Pending messages are retried with a growing delay until
+// outboxMaxAttempts is reached, when they are marked failed. A message is
+// marked sending while one delivery run holds it, so no other run sends it
+// too.
+const (
+	outboxPending = "pending"
+	outboxSending = "sending"
+	outboxSent    = "sent"
+	outboxFailed  = "failed"
+)
+
+const (
+	outboxMaxAttempts = 5
+	outboxBatchSize   = 100
+	outboxInterval    = time.Minute
+	// outboxClaimTimeout is how long a message stays sending before it is
+	// taken to be left over from a run that stopped, and is sent again.
+	outboxClaimTimeout = 5 * time.Minute
+)
+
+// messageTemplates are the subject and body of each kind of notification,
+// filled in from the data the message was queued with.
+var messageTemplates = map[string][2]string{
+	"thank_you": {
+		"Thank you for donating",
+		"Dear {{.Name}}, thank you for giving blood on {{.Date}}. Your donation can help save up to three lives.",
+	},
+	"eligible": {
+		"You can donate again",
+		"Dear {{.Name}}, you can give blood again from {{.Date}}. Book an appointment whenever it suits you.",
+	},
+	"appointment_reminder": {
+		"Donation appointment reminder",
+		"Dear {{.Name}}, this is a reminder of your blood donation appointment at {{.Site}} on {{.Date}} at {{.Time}}.",
+	},
+	"recall": {
+		"{{.BloodType}} blood needed",
+		"{{.Text}}",
+	},
+	"low_stock": {
+		"Low stock: {{.BloodType}}",
+		"{{.BloodType}} stock is down to {{.Units}} units, below the threshold of {{.Threshold}}.",
+	},
+	"expiring_units": {
+		"Units expiring by {{.Until}}",
+		"Units in stock that expire by {{.Until}}:{{range .Rows}}\n{{.BloodType}} {{.Component}}: {{.Units}} units, first expiring {{.ExpiryDate}}{{end}}",
+	},
+	"emergency_request": {
+		"Request #{{.RequestID}} cannot be met from stock",
+		"Request #{{.RequestID}} for {{.Recipient}} needs {{.Units}} units of {{.BloodType}}, but only {{.Stock}} are in stock.",
+	},
+}
+
+var parsedMessageTemplates = parseMessageTemplates()
+
+func parseMessageTemplates() map[string][2]*texttemplate.Template {
+	parsed := map[string][2]*texttemplate.Template{}
+	for kind, t := range messageTemplates {
+		parsed[kind] = [2]*texttemplate.Template{
+			texttemplate.Must(texttemplate.New(kind + " subject").Parse(t[0])),
+			texttemplate.Must(texttemplate.New(kind + " body").Parse(t[1])),
+		}
+	}
+	return parsed
+}
+
+// Notification is a message in the outbox.
+type Notification struct {
+	ID            int
+	Kind          string
+	Channel       string
+	Recipient     string
+	Subject       string
+	Body          string
+	Status        string
+	Attempts      int
+	LastError     string
+	CreatedAt     string
+	NextAttemptAt string
+	SentAt        string
+}
+
+var outboxStatuses = []string{outboxPending, outboxSending, outboxSent, outboxFailed}
+
+type NotificationsData struct {
+	Status        string
+	Statuses      []string
+	Counts        map[string]int
+	Notifications []Notification
+	Message       string
+}
+
+func registerNotificationRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB, notifiers map[string]Notifier, cfg notifyConfig) {
+	mux.HandleFunc("/notifications", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		renderNotifications(w, tmpl, r, db, r.FormValue("status"), "")
+	})
+
+	mux.HandleFunc("/notifications/send", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		sent, failed, err := deliverPending(db, notifiers, cfg)
+		if err != nil {
+			renderNotifications(w, tmpl, r, db, "", "Could not send notifications.")
+			return
+		}
+		renderNotifications(w, tmpl, r, db, "", fmt.Sprintf("Sent %d notifications; %d attempts failed.", sent, failed))
+	})
+
+	mux.HandleFunc("/notifications/retry", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		if _, err := db.Exec(
+			"UPDATE notifications SET status = ?, attempts = 0, next_attempt_at = ? WHERE id = ? AND status = ?",
+			outboxPending, nowTimestamp(), id, outboxFailed,
+		); err != nil {
+			renderNotifications(w, tmpl, r, db, "", "Could not retry notification.")
+			return
+		}
+		http.Redirect(w, r, "/notifications?status="+outboxPending, http.StatusSeeOther)
+	})
+}
+
+func renderNotifications(w http.ResponseWriter, tmpl *template.Template, r *http.Request, db *sql.DB, status string, msg string) {
+	data := NotificationsData{Status: status, Statuses: outboxStatuses, Counts: map[string]int{}, Message: msg}
+	rows, err := db.Query("SELECT status, COUNT(*) FROM notifications GROUP BY status")
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s string
+		var n int
+		if err := rows.Scan(&s, &n); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		data.Counts[s] = n
+	}
+	if data.Notifications, err = loadNotifications(db, status); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !isAdmin(r) {
+		for i := range data.Notifications {
+			n := &data.Notifications[i]
+			if n.Channel == channelEmail {
+				n.Recipient = maskEmail(n.Recipient)
+			} else {
+				n.Recipient = maskPhone(n.Recipient)
+			}
+		}
+	}
+	renderPage(w, tmpl, "notifications.html", data)
+}
+
+// loadNotifications returns the latest notifications, optionally of one
+// status.
+func loadNotifications(db *sql.DB, status string) ([]Notification, error) {
+	rows, err := db.Query(`
+		SELECT id, kind, channel, recipient, subject, body, status, attempts, COALESCE(last_error, ''),
+			created_at, next_attempt_at, COALESCE(sent_at, '')
+		FROM notifications
+		WHERE ? = '' OR status = ?
+		ORDER BY id DESC
+		LIMIT 200
+	`, status, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []Notification
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Kind, &n.Channel, &n.Recipient, &n.Subject, &n.Body, &n.Status, &n.Attempts,
+			&n.LastError, &n.CreatedAt, &n.NextAttemptAt, &n.SentAt); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// queueNotification renders a message and adds it to the outbox. A message
+// with the same non-empty key is only ever queued once, so jobs that run
+// again after a restart do not send it twice.
+func queueNotification(db querier, kind string, channel string, to string, key string, data any) error {
+	t, ok := parsedMessageTemplates[kind]
+	if !ok {
+		return fmt.Errorf("unknown notification kind %q", kind)
+	}
+	var subject, body bytes.Buffer
+	if err := t[0].Execute(&subject, data); err != nil {
+		return err
+	}
+	if err := t[1].Execute(&body, data); err != nil {
+		return err
+	}
+	return insertNotification(db, kind, channel, to, subject.String(), body.String(), key)
+}
+
+func insertNotification(db querier, kind string, channel string, to string, subject string, body string, key string) error {
+	now := nowTimestamp()
+	_, err := db.Exec(`
+		INSERT OR IGNORE INTO notifications (kind, channel, recipient, subject, body, status, attempts, dedupe_key, created_at, next_attempt_at)
+		VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?, ?)
+	`, kind, channel, to, subject, body, outboxPending, nullIfEmpty(key), now, now)
+	return err
+}
+
+// notifyDonor queues a message to a donor by SMS, or by email if they have
+// no phone number. Donors with neither are skipped. The donor's name is
+// added to the data as Name.
+func notifyDonor(db querier, donorID int, kind string, key string, data map[string]any) error {
+	var name, phone, email string
+	err := db.QueryRow(
+		"SELECT name, COALESCE(phone, ''), COALESCE(email, '') FROM donors WHERE id = ? AND deleted_at IS NULL", donorID,
+	).Scan(&name, &phone, &email)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data["Name"] = name
+	switch {
+	case phone != "":
+		return queueNotification(db, kind, channelSMS, phone, key, data)
+	case email != "":
+		return queueNotification(db, kind, channelEmail, email, key, data)
+	}
+	return nil
+}
+
+// notifyStaff queues a message to staff. It is copied to each staff contact
+// when it is delivered; see forwardToStaff.
+func notifyStaff(db querier, kind string, key string, data any) error {
+	return queueNotification(db, kind, channelStaff, "staff", key, data)
+}
+
+// forwardToStaff copies a staff message to every staff contact in the
+// config, or to the log if there are none, and marks it sent. Each copy is
+// then delivered and retried on its own.
+func forwardToStaff(db *sql.DB, n Notification, cfg notifyConfig) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	key := fmt.Sprintf("staff:%d", n.ID)
+	if len(cfg.StaffEmails) == 0 && len(cfg.StaffPhones) == 0 {
+		if err := insertNotification(tx, n.Kind, channelLog, "staff", n.Subject, n.Body, key); err != nil {
+			return err
+		}
+	}
+	for _, email := range cfg.StaffEmails {
+		if err := insertNotification(tx, n.Kind, channelEmail, email, n.Subject, n.Body, key+":"+email); err != nil {
+			return err
+		}
+	}
+	for _, phone := range cfg.StaffPhones {
+		if err := insertNotification(tx, n.Kind, channelSMS, phone, n.Subject, n.Body, key+":"+phone); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE notifications SET status = ?, attempts = ?, last_error = NULL, sent_at = ? WHERE id = ?",
+		outboxSent, n.Attempts+1, nowTimestamp(), n.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// claimNotification marks a due message as sending, reporting false if
+// another run claimed it first.
+func claimNotification(db *sql.DB, n Notification) (bool, error) {
+	until := time.Now().Add(outboxClaimTimeout).Format(time.RFC3339)
+	res, err := db.Exec("UPDATE notifications SET status = ?, next_attempt_at = ? WHERE id = ? AND status = ? AND next_attempt_at = ?",
+		outboxSending, until, n.ID, n.Status, n.NextAttemptAt)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+// deliverPending sends outbox messages that are due, claiming each one
+// first so that runs at the same time never send a message twice. A failed
+// message is tried again after attempts² minutes.
+func deliverPending(db *sql.DB, notifiers map[string]Notifier, cfg notifyConfig) (sent int, failed int, err error) {
+	pending, err := loadDueNotifications(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, n := range pending {
+		claimed, err := claimNotification(db, n)
+		if err != nil {
+			return sent, failed, err
+		}
+		if !claimed {
+			continue
+		}
+		if n.Channel == channelStaff {
+			if err := forwardToStaff(db, n, cfg); err != nil {
+				return sent, failed, err
+			}
+			continue
+		}
+		attempts := n.Attempts + 1
+		notifier, ok := notifiers[n.Channel]
+		if !ok {
+			err = fmt.Errorf("no notifier for channel %q", n.Channel)
+		} else {
+			err = notifier.Send(Message{Channel: n.Channel, To: n.Recipient, Subject: n.Subject, Body: n.Body})
+		}
+		if err == nil {
+			sent++
+			_, err = db.Exec("UPDATE notifications SET status = ?, attempts = ?, last_error = NULL, sent_at = ? WHERE id = ?",
+				outboxSent, attempts, nowTimestamp(), n.ID)
+			if err != nil {
+				return sent, failed, err
+			}
+			continue
+		}
+		failed++
+		status := outboxPending
+		if attempts >= outboxMaxAttempts {
+			status = outboxFailed
+		}
+		next := time.Now().Add(time.Duration(attempts*attempts) * time.Minute).Format(time.RFC3339)
+		if _, err := db.Exec("UPDATE notifications SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ?",
+			status, attempts, err.Error(), next, n.ID); err != nil {
+			return sent, failed, err
+		}
+	}
+	return sent, failed, nil
+}
+
+// loadDueNotifications lists pending messages that are due, and messages
+// whose claim has run out.
+func loadDueNotifications(db *sql.DB) ([]Notification, error) {
+	rows, err := db.Query(`
+		SELECT id, kind, channel, recipient, subject, body, status, attempts, next_attempt_at
+		FROM notifications
+		WHERE status IN (?, ?) AND next_attempt_at <= ?
+		ORDER BY id
+		LIMIT ?
+	`, outboxPending, outboxSending, nowTimestamp(), outboxBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []Notification
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Kind, &n.Channel, &n.Recipient, &n.Subject, &n.Body, &n.Status, &n.Attempts, &n.NextAttemptAt); err != nil {
+			return nil, err
+		}
+		due = append(due, n)
+	}
+	return due, rows.Err()
+}
+
+// runNotificationJob delivers the outbox every minute and, once a day,
+// queues eligibility reminders, the expiring units alert and alerts for
+// stock that expiries have left below its minimum.
+func runNotificationJob(db *sql.DB, notifiers map[string]Notifier, cfg notifyConfig) {
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
+	lastDay := ""
+	for {
+		if today := todayDate(); today != lastDay {
+			if err := queueDailyNotifications(db, today); err != nil {
+				log.Println("notification error:", err)
+			} else {
+				lastDay = today
+			}
+		}
+		if sent, failed, err := deliverPending(db, notifiers, cfg); err != nil {
+			log.Println("notification error:", err)
+		} else if sent+failed > 0 {
+			log.Printf("sent %d notifications, %d failed", sent, failed)
+		}
+		<-ticker.C
+	}
+}
+
+// ExpiringRow is the stock of one blood type and component expiring soon.
+type ExpiringRow struct {
+	BloodType  string
+	Component  string
+	Units      int
+	ExpiryDate string
+}
+
+func queueDailyNotifications(db *sql.DB, today string) error {
+	if err := queueEligibilityReminders(db, today); err != nil {
+		return err
+	}
+	if err := checkStockLevels(db, 0); err != nil {
+		return err
+	}
+	return queueExpiryAlert(db, today)
+}
+
+// queueEligibilityReminders tells donors who became eligible again in the
+// last week, so a few days of downtime do not lose any reminders.
+func queueEligibilityReminders(db *sql.DB, today string) error {
+	t, err := parseDate(today)
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query(`
+		SELECT d.id, MAX(x.donation_date)
+		FROM donors d
+		JOIN donations x ON x.donor_id = d.id AND x.deleted_at IS NULL
+		WHERE d.deleted_at IS NULL
+		GROUP BY d.id
+		HAVING MAX(x.donation_date) BETWEEN ? AND ?
+	`, t.AddDate(0, 0, -minDonationIntervalDays-7).Format(dateLayout), t.AddDate(0, 0, -minDonationIntervalDays).Format(dateLayout))
+	if err != nil {
+		return err
+	}
+	type due struct {
+		donorID int
+		last    string
+	}
+	var donors []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.donorID, &d.last); err != nil {
+			rows.Close()
+			return err
+		}
+		donors = append(donors, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range donors {
+		next, err := nextEligibleDate(db, d.donorID)
+		if err != nil {
+			return err
+		}
+		problem, err := donorEligibility(db, d.donorID, today)
+		if err != nil {
+			return err
+		}
+		if problem != "" {
+			continue
+		}
+		key := fmt.Sprintf("eligible:%d:%s", d.donorID, next)
+		if err := notifyDonor(db, d.donorID, "eligible", key, map[string]any{"Date": next}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueExpiryAlert tells staff about units in stock that expire within
+// expiringSoonDays.
+func queueExpiryAlert(db *sql.DB, today string) error {
+	t, err := parseDate(today)
+	if err != nil {
+		return err
+	}
+	until := t.AddDate(0, 0, expiringSoonDays).Format(dateLayout)
+	rows, err := db.Query(`
+		SELECT bt.type, c.name, SUM(d.remaining_units), MIN(d.expiry_date)
+		FROM donations d
+		JOIN donors ON donors.id = d.donor_id
+		JOIN blood_types bt ON bt.id = donors.blood_type_id
+		JOIN components c ON c.id = d.component_id
+		WHERE d.deleted_at IS NULL AND d.remaining_units > 0 AND d.expiry_date BETWEEN ? AND ?
+		GROUP BY bt.type, c.name
+		ORDER BY MIN(d.expiry_date), bt.type
+	`, today, until)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var expiring []ExpiringRow
+	for rows.Next() {
+		var e ExpiringRow
+		if err := rows.Scan(&e.BloodType, &e.Component, &e.Units, &e.ExpiryDate); err != nil {
+			return err
+		}
+		expiring = append(expiring, e)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(expiring) == 0 {
+		return nil
+	}
+	return notifyStaff(db, "expiring_units", "expiring:"+today, map[string]any{"Until": until, "Rows": expiring})
+}
+
+// notifyUnmetRequest alerts staff when a new request needs more units than
+// are in stock for the recipient's blood type.
+func notifyUnmetRequest(db *sql.DB, requestID int) error {
+	var recipient, bloodType string
+	var units int
+	err := db.QueryRow(`
+		SELECT rec.name, bt.type, r.units
+		FROM requests r
+		JOIN recipients rec ON rec.id = r.recipient_id
+		JOIN blood_types bt ON bt.id = rec.blood_type_id
+		WHERE r.id = ?
+	`, requestID).Scan(&recipient, &bloodType, &units)
+	if err != nil {
+		return err
+	}
+	stock, err := stockOf(db, bloodType)
+	if err != nil || stock >= units {
+		return err
+	}
+	return notifyStaff(db, "emergency_request", fmt.Sprintf("request:%d", requestID), map[string]any{
+		"RequestID": requestID, "Recipient": recipient, "BloodType": bloodType, "Units": units, "Stock": stock,
+	})
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type DashboardData struct {
+	Donors          int
+	Recipients      int
+	UnitsInStock    int
+	ExpiringSoon    int
+	PendingRequests int
+	Inventory       []Inventory
+	Forecasts       []Forecast
+	Message         string
+}
+
+type DonorListData struct {
+	Page       Page[Donor]
+	Form       Form
+	Duplicates []Donor
+	Message    string
+}
+
+type DonorData struct {
+	Donor           Donor
+	Donations       Page[Donation]
+	TotalUnits      int
+	LastDonation    string
+	Deferrals       []Deferral
+	ActiveDeferral  *Deferral
+	Appointments    []Appointment
+	NextEligible    string
+	DeferralReasons []string
+	Form            Form
+	Message         string
+}
+
+type RecipientListData struct {
+	Page    Page[Recipient]
+	Form    Form
+	Message string
+}
+
+type RecipientData struct {
+	Recipient Recipient
+	Requests  Page[Request]
+	Form      Form
+	Message   string
+}
+
+type DonationListData struct {
+	Page        Page[Donation]
+	Donors      []Donor
+	DonorQuery  string
+	Components  []Component
+	Camps       []Camp
+	Appointment *Appointment
+	DonorID     int
+	CampID      int
+	Form        Form
+	Message     string
+}
+
+type DonationData struct {
+	Donation  Donation
+	Voided    bool
+	Revisions []DonationRevision
+	Form      Form
+	Message   string
+}
+
+type RequestListData struct {
+	Page           Page[Request]
+	Recipients     []Recipient
+	RecipientQuery string
+	RecipientID    int
+	Form           Form
+	Message        string
+}
+
+type RequestData struct {
+	Request Request
+	Issued  []IssuedUnit
+	Form    Form
+	Message string
+}
+
+type InventoryData struct {
+	Rows            []InventoryRow
+	ComponentLevels []StockLevel
+	BloodTypes      []string
+	Components      []Component
+	Form            Form
+	Message         string
+}
+
+// expiringSoonDays is the window for the dashboard's expiring units count.
+const expiringSoonDays = 7
+
+func renderPage(w http.ResponseWriter, tmpl *template.Template, name string, data any) {
+	if err := tmpl.ExecuteTemplate(w, name, data); err != nil {
+		log.Println("template error:", err)
+	}
+}
+
+// listError reports a failed list query, separating bad page cursors from
+// server errors.
+func listError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errInvalidCursor) {
+		http.Error(w, "invalid page cursor", http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "server error", http.StatusInternalServerError)
+}
+
+func renderDashboard(w http.ResponseWriter, tmpl *template.Template, db *sql.DB) {
+	var data DashboardData
+	soon := time.Now().AddDate(0, 0, expiringSoonDays).Format(dateLayout)
+	err := db.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM donors WHERE deleted_at IS NULL),
+			(SELECT COUNT(*) FROM recipients WHERE deleted_at IS NULL),
+			(SELECT COALESCE(SUM(units), 0) FROM inventory WHERE deleted_at IS NULL),
+			(SELECT COALESCE(SUM(remaining_units), 0) FROM donations
+				WHERE deleted_at IS NULL AND remaining_units > 0 AND expiry_date >= ? AND expiry_date <= ?),
+			(SELECT COUNT(*) FROM requests WHERE deleted_at IS NULL AND status = 'Pending')
+	`, todayDate(), soon).Scan(&data.Donors, &data.Recipients, &data.UnitsInStock, &data.ExpiringSoon, &data.PendingRequests)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if data.Inventory, err = loadInventory(db); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if data.Forecasts, err = loadForecasts(db, time.Now()); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	renderPage(w, tmpl, "index.html", data)
+}
+
+// renderDonorList shows the donor list and registration form. Duplicates are
+// existing donors the submitted form may match, shown for confirmation.
+func renderDonorList(w http.ResponseWriter, tmpl *template.Template, r *http.Request, db *sql.DB, values url.Values, form Form, duplicates []Donor, msg string) {
+	page, err := loadDonorPage(db, parseListFilter(values))
+	if err != nil {
+		listError(w, err)
+		return
+	}
+	page.NextURL = nextPageURL(values, page.NextCursor)
+	maskFor(r, page.Items)
+	maskFor(r, duplicates)
+	renderPage(w, tmpl, "donors.html", DonorListData{Page: page, Form: form, Duplicates: duplicates, Message: msg})
+}
+
+func renderDonor(w http.ResponseWriter, tmpl *template.Template, r *http.Request, db *sql.DB, id int, form Form, msg string) {
+	data, ok := loadDonorData(w, db, id, msg)
+	if !ok {
+		return
+	}
+	if !isAdmin(r) {
+		data.Donor = data.Donor.Masked()
+	}
+	data.Form = form
+	data.DeferralReasons = deferralReasons
+	var err error
+	if data.Donations, err = loadDonationPage(db, ListFilter{DonorID: id, Limit: defaultPageSize}); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if data.Donations.NextCursor != "" {
+		data.Donations.NextURL = "/donations?donor_id=" + strconv.Itoa(id)
+	}
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(units), 0), COALESCE(MAX(donation_date), '')
+		FROM donations
+		WHERE donor_id = ? AND deleted_at IS NULL
+	`, id).Scan(&data.TotalUnits, &data.LastDonation)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if data.Deferrals, err = loadDonorDeferrals(db, id); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if data.ActiveDeferral, err = activeDeferral(db, id, todayDate()); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if data.Appointments, err = loadAppointments(db, "a.donor_id = ?", id); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if data.NextEligible, err = nextEligibleDate(db, id); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	renderPage(w, tmpl, "donor.html", data)
+}
+
+func renderDonorEdit(w http.ResponseWriter, tmpl *template.Template, r *http.Request, db *sql.DB, id int, form Form, msg string) {
+	data, ok := loadDonorData(w, db, id, msg)
+	if !ok {
+		return
+	}
+	// Non-admins edit the masked values; unmaskDonorInput keeps the stored
+	// ones when they are sent back unchanged.
+	if !isAdmin(r) {
+		data.Donor = data.Donor.Masked()
+	}
+	data.Form = form
+	if form.Values == nil {
+		d := data.Donor
+		data.Form = newForm(map[string]string{
+			"name": d.Name, "blood_type": d.BloodType, "phone": d.Phone, "city": d.City,
+			"email": d.Email, "date_of_birth": d.DateOfBirth,
+		})
+	}
+	renderPage(w, tmpl, "donor_edit.html", data)
+}
+
+// loadDonorData loads an active donor, writing a 404 or 500 and reporting
+// false if it cannot.
+func loadDonorData(w http.ResponseWriter, db *sql.DB, id int, msg string) (DonorData, bool) {
+	data := DonorData{Message: msg}
+	var err error
+	data.Donor, err = loadDonor(db, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "donor not found", http.StatusNotFound)
+		return data, false
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return data, false
+	}
+	return data, true
+}
+
+func renderRecipientList(w http.ResponseWriter, tmpl *template.Template, r *http.Request, db *sql.DB, values url.Values, form Form, msg string) {
+	page, err := loadRecipientPage(db, parseListFilter(values))
+	if err != nil {
+		listError(w, err)
+		return
+	}
+	page.NextURL = nextPageURL(values, page.NextCursor)
+	maskFor(r, page.Items)
+	renderPage(w, tmpl, "recipients.html", RecipientListData{Page: page, Form: form, Message: msg})
+}
+
+func renderRecipient(w http.ResponseWriter, tmpl *template.Template, r *http.Request, db *sql.DB, id int, msg string) {
+	data, ok := loadRecipientData(w, db, id, msg)
+	if !ok {
+		return
+	}
+	if !isAdmin(r) {
+		data.Recipient = data.Recipient.Masked()
+	}
+	var err error
+	if data.Requests, err = loadRequestPage(db, ListFilter{RecipientID: id, Limit: defaultPageSize}); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if data.Requests.NextCursor != "" {
+		data.Requests.NextURL = "/requests?recipient_id=" + strconv.Itoa(id)
+	}
+	renderPage(w, tmpl, "recipient.html", data)
+}
+
+func renderRecipientEdit(w http.ResponseWriter, tmpl *template.Template, r *http.Request, db *sql.DB, id int, form Form, msg string) {
+	data, ok := loadRecipientData(w, db, id, msg)
+	if !ok {
+		return
+	}
+	if !isAdmin(r) {
+		data.Recipient = data.Recipient.Masked()
+	}
+	data.Form = form
+	if form.Values == nil {
+		rc := data.Recipient
+		data.Form = newForm(map[string]string{"name": rc.Name, "blood_type": rc.BloodType, "phone": rc.Phone, "hospital": rc.Hospital})
+	}
+	renderPage(w, tmpl, "recipient_edit.html", data)
+}
+
+// loadRecipientData loads an active recipient, writing a 404 or 500 and
+// reporting false if it cannot.
+func loadRecipientData(w http.ResponseWriter, db *sql.DB, id int, msg string) (RecipientData, bool) {
+	data := RecipientData{Message: msg}
+	var err error
+	data.Recipient, err = loadRecipient(db, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "recipient not found", http.StatusNotFound)
+		return data, false
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return data, false
+	}
+	return data, true
+}
+
+func renderDonationList(w http.ResponseWriter, tmpl *template.Template, db *sql.DB, values url.Values, form Form, msg string) {
+	filter := parseListFilter(values)
+	page, err := loadDonationPage(db, filter)
+	if err != nil {
+		listError(w, err)
+		return
+	}
+	page.NextURL = nextPageURL(values, page.NextCursor)
+	data := DonationListData{Page: page, DonorID: filter.DonorID, CampID: filter.CampID, Form: form, Message: msg}
+	if form.Values == nil {
+		data.Form = newForm(map[string]string{"donor_id": values.Get("donor_id"), "camp_id": values.Get("camp_id")})
+		// A checked-in appointment fills in the donor it was booked for.
+		if id, _ := strconv.Atoi(values.Get("appointment_id")); id != 0 {
+			appointment, err := loadAppointment(db, id)
+			if err != nil && err != sql.ErrNoRows {
+				http.Error(w, "server error", http.StatusInternalServerError)
+				return
+			}
+			if err == nil && appointment.Status == appointmentCheckedIn {
+				data.Appointment = &appointment
+				data.Form.Values["appointment_id"] = strconv.Itoa(id)
+				data.Form.Values["donor_id"] = strconv.Itoa(appointment.DonorID)
+				data.Form.Values["donation_date"] = appointment.SlotDate
+			}
+		}
+	}
+	data.DonorQuery = values.Get("donor_q")
+	donorID, _ := strconv.Atoi(data.Form.Get("donor_id"))
+	if data.Donors, err = pickDonors(db, donorID, data.DonorQuery); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if data.Components, err = loadComponents(db); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if data.Camps, err = loadCamps(db); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	renderPage(w, tmpl, "donations.html", data)
+}
+
+func renderDonation(w http.ResponseWriter, tmpl *template.Template, db *sql.DB, id int, form Form, msg string) {
+	data := DonationData{Form: form, Message: msg}
+	var deletedAt sql.NullString
+	d := &data.Donation
+	err := db.QueryRow(`
+		SELECT d.id, COALESCE(d.din, ''), d.donor_id, donors.name, bt.type, c.name, d.units, COALESCE(d.remaining_units, 0),
+			d.donation_date, d.expiry_date, COALESCE(d.camp_id, 0), COALESCE(camps.name, ''), d.deleted_at
+		FROM donations d
+		JOIN donors ON donors.id = d.donor_id
+		JOIN blood_types bt ON bt.id = donors.blood_type_id
+		JOIN components c ON c.id = d.component_id
+		LEFT JOIN camps ON camps.id = d.camp_id
+		WHERE d.id = ?
+	`, id).Scan(&d.ID, &d.DIN, &d.DonorID, &d.DonorName, &d.BloodType, &d.Component, &d.Units, &d.RemainingUnits,
+		&d.DonationDate, &d.ExpiryDate, &d.CampID, &d.CampName, &deletedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "donation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	data.Voided = deletedAt.Valid
+	if form.Values == nil {
+		data.Form = newForm(map[string]string{"units": strconv.Itoa(d.Units), "expiry_date": d.ExpiryDate})
+	}
+	if data.Revisions, err = loadDonationRevisions(db, id); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	renderPage(w, tmpl, "donation.html", data)
+}
+
+func renderRequestList(w http.ResponseWriter, tmpl *template.Template, db *sql.DB, values url.Values, form Form, msg string) {
+	filter := parseListFilter(values)
+	page, err := loadRequestPage(db, filter)
+	if err != nil {
+		listError(w, err)
+		return
+	}
+	page.NextURL = nextPageURL(values, page.NextCursor)
+	data := RequestListData{Page: page, RecipientID: filter.RecipientID, Form: form, Message: msg}
+	if form.Values == nil {
+		data.Form = newForm(map[string]string{"recipient_id": values.Get("recipient_id")})
+	}
+	data.RecipientQuery = values.Get("recipient_q")
+	recipientID, _ := strconv.Atoi(data.Form.Get("recipient_id"))
+	if data.Recipients, err = pickRecipients(db, recipientID, data.RecipientQuery); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	renderPage(w, tmpl, "requests.html", data)
+}
+
+func renderRequest(w http.ResponseWriter, tmpl *template.Template, db *sql.DB, id int, form Form, msg string) {
+	data := RequestData{Form: form, Message: msg}
+	var err error
+	data.Request, err = loadRequest(db, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "request not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if form.Values == nil {
+		data.Form = newForm(map[string]string{"units": strconv.Itoa(data.Request.Units), "status": data.Request.Status})
+	}
+	if data.Issued, err = loadIssuedUnits(db, id); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	renderPage(w, tmpl, "request.html", data)
+}
+
+func renderInventory(w http.ResponseWriter, tmpl *template.Template, db *sql.DB, form Form, msg string) {
+	data := InventoryData{BloodTypes: bloodTypes, Form: form, Message: msg}
+	var err error
+	if data.Rows, data.ComponentLevels, err = loadInventoryRows(db); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if data.Components, err = loadComponents(db); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	renderPage(w, tmpl, "inventory.html", data)
+}
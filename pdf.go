@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// mm converts millimetres to PDF points.
+const mm = 72 / 25.4
+
+// pdfDoc builds a simple PDF with text, filled rectangles and lines on pages
+// of one size. Coordinates are in points from the top-left corner of the
+// page. Text uses the standard Helvetica fonts, so only characters in
+// WinAnsi encoding print; others become "?".
+type pdfDoc struct {
+	width, height float64
+	pages         []*bytes.Buffer
+}
+
+func newPDF(width, height float64) *pdfDoc {
+	return &pdfDoc{width: width, height: height}
+}
+
+func (d *pdfDoc) AddPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+}
+
+func (d *pdfDoc) page() *bytes.Buffer {
+	if len(d.pages) == 0 {
+		d.AddPage()
+	}
+	return d.pages[len(d.pages)-1]
+}
+
+// Text draws s with its baseline at y.
+func (d *pdfDoc) Text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.page(), "BT /%s %.2f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, d.height-y, pdfString(s))
+}
+
+// TextWidth estimates the width of s, for right-aligning or centring text.
+func (d *pdfDoc) TextWidth(size float64, s string) float64 {
+	return float64(len([]rune(s))) * size * 0.5
+}
+
+// Rect fills a black rectangle whose top-left corner is at x, y.
+func (d *pdfDoc) Rect(x, y, w, h float64) {
+	fmt.Fprintf(d.page(), "%.3f %.3f %.3f %.3f re f\n", x, d.height-y-h, w, h)
+}
+
+// Line strokes a thin line from x1, y1 to x2, y2.
+func (d *pdfDoc) Line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(d.page(), "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, d.height-y1, x2, d.height-y2)
+}
+
+// Barcode draws data as Code 128 filling the box at x, y, quiet zones
+// included.
+func (d *pdfDoc) Barcode(x, y, w, h float64, data string) error {
+	widths, err := code128(data)
+	if err != nil {
+		return err
+	}
+	const quiet = 10
+	modules := 2 * quiet
+	for _, n := range widths {
+		modules += n
+	}
+	unit := w / float64(modules)
+	pos := x + quiet*unit
+	for i, n := range widths {
+		if i%2 == 0 {
+			d.Rect(pos, y, float64(n)*unit, h)
+		}
+		pos += float64(n) * unit
+	}
+	return nil
+}
+
+// WriteTo writes the finished document.
+func (d *pdfDoc) WriteTo(w io.Writer) (int64, error) {
+	if len(d.pages) == 0 {
+		d.AddPage()
+	}
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// Objects 1-4 are the catalog, page tree and fonts; each page then
+	// takes a page object followed by its content stream.
+	out.WriteString("%PDF-1.4\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, content := range d.pages {
+		object(fmt.Sprintf(
+			"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			d.width, d.height, 6+2*i,
+		))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.WriteTo(w)
+}
+
+// pdfString escapes s for a PDF string literal in WinAnsi encoding.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '—' || r == '–':
+			b.WriteByte('-')
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		case r >= 160 && r <= 255:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestGFMultiply(t *testing.T) {
+	tests := []struct {
+		x, y, want byte
+	}{
+		{0, 7, 0},
+		{1, 7, 7},
+		{2, 0x80, 0x1D},
+		{0x53, 0xCA, 0x8F},
+		{0xFF, 0xFF, 0xE2},
+	}
+	for _, tt := range tests {
+		if got := gfMultiply(tt.x, tt.y); got != tt.want {
+			t.Errorf("gfMultiply(%#x, %#x) = %#x, want %#x", tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestRSDivisor(t *testing.T) {
+	// Generator polynomials from the QR code specification, Annex A, as
+	// integers: α^87 = 127 and so on.
+	tests := []struct {
+		degree int
+		want   []byte
+	}{
+		{7, []byte{127, 122, 154, 164, 11, 68, 117}},
+		{10, []byte{216, 194, 159, 111, 199, 94, 95, 113, 157, 193}},
+	}
+	for _, tt := range tests {
+		if got := rsDivisor(tt.degree); !slices.Equal(got, tt.want) {
+			t.Errorf("rsDivisor(%d) = %v, want %v", tt.degree, got, tt.want)
+		}
+	}
+}
+
+func TestRSRemainder(t *testing.T) {
+	// "HELLO WORLD" as a version 1-M symbol and its ten error correction
+	// codewords.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(10)); !slices.Equal(got, want) {
+		t.Errorf("rsRemainder = %v, want %v", got, want)
+	}
+}
+
+func TestQRCodewords(t *testing.T) {
+	// Byte mode, a count of 1, "A", the terminator, then pad codewords.
+	got := qrCodewords([]byte("A"), 1)
+	wantData := []byte{0x40, 0x14, 0x10, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC}
+	if len(got) != 26 || !slices.Equal(got[:16], wantData) {
+		t.Fatalf("qrCodewords(A, 1) = %v, want data %v and 10 error correction codewords", got, wantData)
+	}
+	if ec := rsRemainder(wantData, rsDivisor(10)); !slices.Equal(got[16:], ec) {
+		t.Errorf("error correction codewords = %v, want %v", got[16:], ec)
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// recallCallsPerUnit is how many donors a campaign lists for each unit short,
+// since not everyone called will agree or turn up.
+const recallCallsPerUnit = 3
+
+// errRecallClosed is returned when messaging a campaign that has been closed.
+var errRecallClosed = errors.New("recall campaign is closed")
+
+// Responses recorded against each donor on a call list.
+const (
+	recallNotContacted = "Not contacted"
+	recallNoAnswer     = "No answer"
+	recallAgreed       = "Agreed"
+	recallDeclined     = "Declined"
+	recallIneligible   = "Not eligible"
+)
+
+var recallResponses = []string{recallNotContacted, recallNoAnswer, recallAgreed, recallDeclined, recallIneligible}
+
+// redCellDonors lists, for each blood type, the donor types whose red cells
+// it can safely receive, its own type first.
+var redCellDonors = map[string][]string{
+	"O-":  {"O-"},
+	"O+":  {"O+", "O-"},
+	"A-":  {"A-", "O-"},
+	"A+":  {"A+", "A-", "O+", "O-"},
+	"B-":  {"B-", "O-"},
+	"B+":  {"B+", "B-", "O+", "O-"},
+	"AB-": {"AB-", "A-", "B-", "O-"},
+	"AB+": {"AB+", "AB-", "A+", "A-", "B+", "B-", "O+", "O-"},
+}
+
+// defaultRecallMessage is offered as the message sent to listed donors.
+// {name} and {blood_type} are filled in for each donor.
+const defaultRecallMessage = "Dear {name}, our {blood_type} blood stock is running low. Please book an appointment to donate as soon as you can. Thank you."
+
+// RecallCampaign asks eligible donors to come in when a blood type runs
+// short. Donations counts units given by listed donors since it started.
+type RecallCampaign struct {
+	ID                int    `json:"id"`
+	BloodType         string `json:"blood_type"`
+	StockUnits        int    `json:"stock_units"`
+	TargetUnits       int    `json:"target_units"`
+	City              string `json:"city"`
+	IncludeCompatible bool   `json:"include_compatible"`
+	Message           string `json:"message"`
+	CreatedAt         string `json:"created_at"`
+	ClosedAt          string `json:"closed_at"`
+	Contacts          int    `json:"contacts"`
+	Agreed            int    `json:"agreed"`
+	Declined          int    `json:"declined"`
+	Donations         int    `json:"donations"`
+}
+
+func (c RecallCampaign) Shortage() int {
+	return c.TargetUnits - c.StockUnits
+}
+
+// MessageFor fills in the campaign message for one donor.
+func (c RecallCampaign) MessageFor(name string) string {
+	return strings.NewReplacer("{name}", name, "{blood_type}", c.BloodType).Replace(c.Message)
+}
+
+// RecallContact is one donor on a campaign's call list.
+type RecallContact struct {
+	ID           int
+	Rank         int
+	DonorID      int
+	DonorNumber  string
+	Name         string
+	BloodType    string
+	Phone        string
+	City         string
+	LastDonation string
+	Response     string
+	Note         string
+	RespondedAt  string
+	MessagedAt   string
+	Donated      bool
+}
+
+type RecallListData struct {
+	Campaigns  []RecallCampaign
+	Inventory  []Inventory
+	BloodTypes []string
+	Form       Form
+	Message    string
+}
+
+type RecallData struct {
+	Campaign  RecallCampaign
+	Contacts  []RecallContact
+	Responses []string
+	Message   string
+}
+
+const recallColumns = `
+	SELECT c.id, bt.type, c.stock_units, c.target_units, COALESCE(c.city, ''), c.include_compatible, c.message,
+		c.created_at, COALESCE(c.closed_at, ''),
+		(SELECT COUNT(*) FROM recall_contacts rc WHERE rc.campaign_id = c.id),
+		(SELECT COUNT(*) FROM recall_contacts rc WHERE rc.campaign_id = c.id AND rc.response = ?),
+		(SELECT COUNT(*) FROM recall_contacts rc WHERE rc.campaign_id = c.id AND rc.response = ?),
+		(SELECT COALESCE(SUM(x.units), 0) FROM donations x
+			JOIN recall_contacts rc ON rc.donor_id = x.donor_id
+			WHERE rc.campaign_id = c.id AND x.deleted_at IS NULL AND x.donation_date >= substr(c.created_at, 1, 10))
+	FROM recall_campaigns c
+	JOIN blood_types bt ON bt.id = c.blood_type_id
+`
+
+func registerRecallRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/recalls", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			renderRecallList(w, tmpl, db, Form{}, "")
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		in, form := recallForm(r)
+		errs, stock, err := in.Validate(db)
+		if err != nil {
+			renderRecallList(w, tmpl, db, form, "Could not start campaign.")
+			return
+		}
+		form.Merge(errs)
+		if !form.Valid() {
+			renderRecallList(w, tmpl, db, form, "Please correct the highlighted fields.")
+			return
+		}
+		id, err := createRecall(db, in, stock)
+		if err != nil {
+			renderRecallList(w, tmpl, db, form, "Could not start campaign.")
+			return
+		}
+		if id == 0 {
+			renderRecallList(w, tmpl, db, form, "No eligible donors with a phone number were found for "+in.BloodType+".")
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/recalls/%d", id), http.StatusSeeOther)
+	})
+
+	// A campaign's page is its call list; format=csv downloads the message
+	// batch for donors not yet reached, ready for an SMS gateway.
+	mux.HandleFunc("/recalls/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		if r.FormValue("format") != "csv" {
+			renderRecall(w, tmpl, r, db, id, "")
+			return
+		}
+		campaign, err := loadRecall(db, id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "campaign not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		contacts, err := loadRecallContacts(db, campaign)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=recall-%d-messages.csv", id))
+		if !isAdmin(r) {
+			for i := range contacts {
+				contacts[i].Phone = maskPhone(contacts[i].Phone)
+			}
+		}
+		if err := writeRecallCSV(w, campaign, contacts); err != nil {
+			log.Println("csv error:", err)
+		}
+	})
+
+	mux.HandleFunc("/recalls/contacts", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		var campaignID int
+		err := db.QueryRow("SELECT campaign_id FROM recall_contacts WHERE id = ?", id).Scan(&campaignID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "contact not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		response := r.FormValue("response")
+		if !slices.Contains(recallResponses, response) {
+			renderRecall(w, tmpl, r, db, campaignID, "Choose a response.")
+			return
+		}
+		// Responses are only taken while the campaign is open.
+		res, err := db.Exec(`
+			UPDATE recall_contacts SET response = ?, note = ?, responded_at = ?
+			WHERE id = ? AND campaign_id IN (SELECT id FROM recall_campaigns WHERE closed_at IS NULL)
+		`, response, nullIfEmpty(strings.TrimSpace(r.FormValue("note"))), nowTimestamp(), id)
+		if err != nil {
+			renderRecall(w, tmpl, r, db, campaignID, "Could not record response.")
+			return
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			renderRecall(w, tmpl, r, db, campaignID, "Could not record response.")
+			return
+		} else if n == 0 {
+			renderRecall(w, tmpl, r, db, campaignID, "This campaign is closed.")
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/recalls/%d", campaignID), http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/recalls/messages", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		campaign, err := loadRecall(db, id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "campaign not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		n, err := sendRecallMessages(db, campaign)
+		if errors.Is(err, errRecallClosed) {
+			renderRecall(w, tmpl, r, db, id, "This campaign is closed.")
+			return
+		}
+		if err != nil {
+			renderRecall(w, tmpl, r, db, id, "Could not send messages.")
+			return
+		}
+		renderRecall(w, tmpl, r, db, id, fmt.Sprintf("Queued messages to %d donors.", n))
+	})
+
+	mux.HandleFunc("/recalls/close", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		if _, err := db.Exec("UPDATE recall_campaigns SET closed_at = ? WHERE id = ? AND closed_at IS NULL", nowTimestamp(), id); err != nil {
+			renderRecall(w, tmpl, r, db, id, "Could not close campaign.")
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/recalls/%d", id), http.StatusSeeOther)
+	})
+}
+
+func renderRecallList(w http.ResponseWriter, tmpl *template.Template, db *sql.DB, form Form, msg string) {
+	data := RecallListData{BloodTypes: bloodTypes, Form: form, Message: msg}
+	if form.Values == nil {
+		data.Form = newForm(map[string]string{"message": defaultRecallMessage, "include_compatible": "1"})
+	}
+	var err error
+	if data.Inventory, err = loadInventory(db); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if data.Campaigns, err = loadRecalls(db); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	renderPage(w, tmpl, "recalls.html", data)
+}
+
+func renderRecall(w http.ResponseWriter, tmpl *template.Template, r *http.Request, db *sql.DB, id int, msg string) {
+	campaign, err := loadRecall(db, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "campaign not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	data := RecallData{Campaign: campaign, Responses: recallResponses, Message: msg}
+	if data.Contacts, err = loadRecallContacts(db, campaign); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !isAdmin(r) {
+		for i := range data.Contacts {
+			data.Contacts[i].Phone = maskPhone(data.Contacts[i].Phone)
+		}
+	}
+	renderPage(w, tmpl, "recall.html", data)
+}
+
+// stockOf returns the units in stock of one blood type.
+func stockOf(db *sql.DB, bloodType string) (int, error) {
+	inventory, err := loadInventory(db)
+	if err != nil {
+		return 0, err
+	}
+	for _, i := range inventory {
+		if i.BloodType == bloodType {
+			return i.Units, nil
+		}
+	}
+	return 0, nil
+}
+
+func scanRecall(row interface{ Scan(...any) error }) (RecallCampaign, error) {
+	var c RecallCampaign
+	err := row.Scan(&c.ID, &c.BloodType, &c.StockUnits, &c.TargetUnits, &c.City, &c.IncludeCompatible, &c.Message,
+		&c.CreatedAt, &c.ClosedAt, &c.Contacts, &c.Agreed, &c.Declined, &c.Donations)
+	return c, err
+}
+
+func loadRecall(db *sql.DB, id int) (RecallCampaign, error) {
+	return scanRecall(db.QueryRow(recallColumns+" WHERE c.id = ?", recallAgreed, recallDeclined, id))
+}
+
+func loadRecalls(db *sql.DB) ([]RecallCampaign, error) {
+	rows, err := db.Query(recallColumns+" ORDER BY c.closed_at IS NULL DESC, c.id DESC", recallAgreed, recallDeclined)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var campaigns []RecallCampaign
+	for rows.Next() {
+		c, err := scanRecall(rows)
+		if err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, c)
+	}
+	return campaigns, rows.Err()
+}
+
+func loadRecallContacts(db *sql.DB, c RecallCampaign) ([]RecallContact, error) {
+	rows, err := db.Query(`
+		SELECT rc.id, rc.rank, d.id, COALESCE(d.donor_number, ''), d.name, bt.type, d.phone, d.city,
+			COALESCE((SELECT MAX(x.donation_date) FROM donations x WHERE x.donor_id = d.id AND x.deleted_at IS NULL), ''),
+			rc.response, COALESCE(rc.note, ''), COALESCE(rc.responded_at, ''), COALESCE(rc.messaged_at, ''),
+			EXISTS (SELECT 1 FROM donations x WHERE x.donor_id = d.id AND x.deleted_at IS NULL AND x.donation_date >= ?)
+		FROM recall_contacts rc
+		JOIN donors d ON d.id = rc.donor_id
+		JOIN blood_types bt ON bt.id = d.blood_type_id
+		WHERE rc.campaign_id = ?
+		ORDER BY rc.rank
+	`, c.CreatedAt[:len(dateLayout)], c.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var contacts []RecallContact
+	for rows.Next() {
+		var rc RecallContact
+		if err := rows.Scan(&rc.ID, &rc.Rank, &rc.DonorID, &rc.DonorNumber, &rc.Name, &rc.BloodType, &rc.Phone, &rc.City,
+			&rc.LastDonation, &rc.Response, &rc.Note, &rc.RespondedAt, &rc.MessagedAt, &rc.Donated); err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, rc)
+	}
+	return contacts, rows.Err()
+}
+
+// selectRecallDonors ranks donors who can be called for a campaign: those of
+// the short type before compatible types, then those in the campaign's city,
+// then by most recent donation, since regular donors are the likeliest to
+// come back. Donors without a phone number, deferred donors and donors still
+// inside the minimum interval are left out.
+func selectRecallDonors(db *sql.DB, in RecallInput, limit int) ([]int, error) {
+	types := []string{in.BloodType}
+	if in.IncludeCompatible {
+		types = redCellDonors[in.BloodType]
+	}
+	args := []any{}
+	for _, t := range types {
+		args = append(args, t)
+	}
+	args = append(args, in.BloodType, in.City, in.City)
+	candidates, err := queryIDs(db, `
+		SELECT d.id
+		FROM donors d
+		JOIN blood_types bt ON bt.id = d.blood_type_id
+		LEFT JOIN donations x ON x.donor_id = d.id AND x.deleted_at IS NULL
+		WHERE d.deleted_at IS NULL AND COALESCE(d.phone, '') != ''
+			AND bt.type IN (?`+strings.Repeat(", ?", len(types)-1)+`)
+		GROUP BY d.id
+		ORDER BY bt.type = ? DESC, (? != '' AND lower(d.city) = lower(?)) DESC,
+			MAX(x.donation_date) IS NULL, MAX(x.donation_date) DESC, d.id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	today := todayDate()
+	var ids []int
+	for _, id := range candidates {
+		if len(ids) == limit {
+			break
+		}
+		problem, err := donorEligibility(db, id, today)
+		if err != nil {
+			return nil, err
+		}
+		if problem == "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// createRecall starts a campaign with its ranked call list. It returns zero
+// if no donor could be listed.
+func createRecall(db *sql.DB, in RecallInput, stock int) (int, error) {
+	donors, err := selectRecallDonors(db, in, (in.TargetUnits-stock)*recallCallsPerUnit)
+	if err != nil || len(donors) == 0 {
+		return 0, err
+	}
+	bloodTypeID, err := getOrCreateBloodTypeID(db, in.BloodType)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO recall_campaigns (blood_type_id, stock_units, target_units, city, include_compatible, message, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, bloodTypeID, stock, in.TargetUnits, nullIfEmpty(in.City), in.IncludeCompatible, in.Message, nowTimestamp())
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for i, donorID := range donors {
+		if _, err := tx.Exec(
+			"INSERT INTO recall_contacts (campaign_id, donor_id, rank, response) VALUES (?, ?, ?, ?)",
+			id, donorID, i+1, recallNotContacted,
+		); err != nil {
+			return 0, err
+		}
+	}
+	return int(id), tx.Commit()
+}
+
+// sendRecallMessages queues the campaign message by SMS to each donor not
+// yet reached who has not been messaged already. A closed campaign sends
+// nothing and reports errRecallClosed.
+func sendRecallMessages(db *sql.DB, c RecallCampaign) (int, error) {
+	contacts, err := loadRecallContacts(db, c)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var closed bool
+	if err := tx.QueryRow("SELECT closed_at IS NOT NULL FROM recall_campaigns WHERE id = ?", c.ID).Scan(&closed); err != nil {
+		return 0, err
+	}
+	if closed {
+		return 0, errRecallClosed
+	}
+	now := nowTimestamp()
+	sent := 0
+	for _, rc := range contacts {
+		if rc.MessagedAt != "" || rc.Phone == "" || (rc.Response != recallNotContacted && rc.Response != recallNoAnswer) {
+			continue
+		}
+		key := fmt.Sprintf("recall:%d", rc.ID)
+		data := map[string]any{"BloodType": c.BloodType, "Text": c.MessageFor(rc.Name)}
+		if err := queueNotification(tx, "recall", channelSMS, rc.Phone, key, data); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE recall_contacts SET messaged_at = ? WHERE id = ?", now, rc.ID); err != nil {
+			return 0, err
+		}
+		sent++
+	}
+	return sent, tx.Commit()
+}
+
+// writeRecallCSV writes one message per donor not yet reached.
+func writeRecallCSV(w http.ResponseWriter, c RecallCampaign, contacts []RecallContact) error {
+	cw := &csvExportWriter{csv.NewWriter(w)}
+	if err := cw.Write([]string{"donor_number", "name", "phone", "message"}); err != nil {
+		return err
+	}
+	for _, rc := range contacts {
+		if rc.Response != recallNotContacted && rc.Response != recallNoAnswer {
+			continue
+		}
+		if err := cw.Write([]string{rc.DonorNumber, rc.Name, rc.Phone, c.MessageFor(rc.Name)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
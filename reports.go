@@ -0,0 +1,488 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxStockCloses limits how many day closes the stock position report
+// computes; longer ranges are reported by month.
+const maxStockCloses = 62
+
+// Report is one table of an operational report, rendered as HTML, CSV or
+// PDF from the same rows.
+type Report struct {
+	Name    string
+	Title   string
+	Note    string
+	Columns []string
+	Rows    [][]string
+}
+
+type ReportsData struct {
+	From    string
+	To      string
+	Group   string
+	Report  string
+	Names   []string
+	Reports []Report
+	Query   string
+	Message string
+}
+
+// reportBuilder builds one report for a date range, grouping by "day" or
+// "month" where the report has periods.
+type reportBuilder struct {
+	name  string
+	build func(db *sql.DB, from string, to string, group string) (Report, error)
+}
+
+var reportBuilders = []reportBuilder{
+	{"donations", donationsReport},
+	{"requests", requestsReport},
+	{"turnaround", turnaroundReport},
+	{"stock", stockReport},
+	{"hospitals", hospitalsReport},
+}
+
+func registerReportRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/reports", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data := reportParams(r)
+		for _, b := range reportBuilders {
+			data.Names = append(data.Names, b.name)
+			if data.Report != "" && data.Report != b.name {
+				continue
+			}
+			report, err := b.build(db, data.From, data.To, data.Group)
+			if err != nil {
+				http.Error(w, "server error", http.StatusInternalServerError)
+				return
+			}
+			report.Name = b.name
+			data.Reports = append(data.Reports, report)
+		}
+
+		filename := fmt.Sprintf("report-%s-%s", data.From, data.To)
+		if data.Report != "" {
+			filename = data.Report + "-" + filename
+		}
+		switch r.FormValue("format") {
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", "attachment; filename="+filename+".csv")
+			if err := writeReportsCSV(w, data.Reports); err != nil {
+				log.Println("csv error:", err)
+			}
+		case "pdf":
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Header().Set("Content-Disposition", "inline; filename="+filename+".pdf")
+			if _, err := reportsPDF(data).WriteTo(w); err != nil {
+				log.Println("pdf error:", err)
+			}
+		default:
+			renderPage(w, tmpl, "reports.html", data)
+		}
+	})
+}
+
+// reportParams reads the date range, defaulting to the month so far, and
+// the grouping.
+func reportParams(r *http.Request) ReportsData {
+	data := ReportsData{
+		From:   validDate(strings.TrimSpace(r.FormValue("from"))),
+		To:     validDate(strings.TrimSpace(r.FormValue("to"))),
+		Group:  r.FormValue("group"),
+		Report: r.FormValue("report"),
+	}
+	if data.To == "" {
+		data.To = todayDate()
+	}
+	if data.From == "" {
+		data.From = data.To[:8] + "01"
+	}
+	if data.From > data.To {
+		data.From, data.To = data.To, data.From
+		data.Message = "The dates were swapped so the range runs forwards."
+	}
+	if data.Group != "month" {
+		data.Group = "day"
+	}
+	if !slices.ContainsFunc(reportBuilders, func(b reportBuilder) bool { return b.name == data.Report }) {
+		data.Report = ""
+	}
+	data.Query = fmt.Sprintf("from=%s&to=%s&group=%s", data.From, data.To, data.Group)
+	return data
+}
+
+// periodExpr is the SQL expression grouping a date column by day or month.
+func periodExpr(column string, group string) string {
+	if group == "month" {
+		return "substr(" + column + ", 1, 7)"
+	}
+	return "substr(" + column + ", 1, 10)"
+}
+
+// donationsReport counts units collected per period and blood type.
+func donationsReport(db *sql.DB, from string, to string, group string) (Report, error) {
+	rows, err := db.Query(`
+		SELECT `+periodExpr("d.donation_date", group)+`, bt.type, COUNT(*), SUM(d.units)
+		FROM donations d
+		JOIN donors ON donors.id = d.donor_id
+		JOIN blood_types bt ON bt.id = donors.blood_type_id
+		WHERE d.deleted_at IS NULL AND d.donation_date BETWEEN ? AND ?
+		GROUP BY 1, 2
+		ORDER BY 1
+	`, from, to)
+	if err != nil {
+		return Report{}, err
+	}
+	defer rows.Close()
+
+	report := Report{
+		Title:   "Donations by Blood Type",
+		Note:    "Units collected per " + group + ".",
+		Columns: append(append([]string{"Period"}, bloodTypes...), "Donations", "Total Units"),
+	}
+	// Each period's counts follow the columns after Period: units per blood
+	// type, then donations and total units.
+	var periods []string
+	counts := map[string][]int{}
+	for rows.Next() {
+		var period, bt string
+		var donations, units int
+		if err := rows.Scan(&period, &bt, &donations, &units); err != nil {
+			return Report{}, err
+		}
+		c, ok := counts[period]
+		if !ok {
+			periods = append(periods, period)
+			c = make([]int, len(report.Columns)-1)
+			counts[period] = c
+		}
+		if col := slices.Index(bloodTypes, bt); col >= 0 {
+			c[col] += units
+		}
+		c[len(c)-2] += donations
+		c[len(c)-1] += units
+	}
+	if err := rows.Err(); err != nil {
+		return Report{}, err
+	}
+	for _, period := range periods {
+		row := []string{period}
+		for _, n := range counts[period] {
+			row = append(row, strconv.Itoa(n))
+		}
+		report.Rows = append(report.Rows, row)
+	}
+	return report, nil
+}
+
+// requestsReport compares requests received per period with how they
+// ended. Cancelled requests are included although they are deleted.
+func requestsReport(db *sql.DB, from string, to string, group string) (Report, error) {
+	rows, err := db.Query(`
+		SELECT `+periodExpr("r.request_date", group)+`,
+			COUNT(*),
+			SUM(r.status = 'Fulfilled'),
+			SUM(r.status = 'Cancelled'),
+			SUM(r.status = 'Pending'),
+			SUM(r.units),
+			SUM(COALESCE(r.issued_units, 0))
+		FROM requests r
+		WHERE (r.deleted_at IS NULL OR r.status = 'Cancelled')
+			AND substr(r.request_date, 1, 10) BETWEEN ? AND ?
+		GROUP BY 1
+		ORDER BY 1
+	`, from, to)
+	if err != nil {
+		return Report{}, err
+	}
+	defer rows.Close()
+
+	report := Report{
+		Title:   "Requests Received and Fulfilled",
+		Note:    "Requests received per " + group + " and their status now.",
+		Columns: []string{"Period", "Received", "Fulfilled", "Cancelled", "Pending", "Units Requested", "Units Issued"},
+	}
+	for rows.Next() {
+		row := make([]string, len(report.Columns))
+		values := make([]any, len(row))
+		for i := range row {
+			values[i] = &row[i]
+		}
+		if err := rows.Scan(values...); err != nil {
+			return Report{}, err
+		}
+		report.Rows = append(report.Rows, row)
+	}
+	return report, rows.Err()
+}
+
+// turnaroundReport averages the time from a request being received to its
+// last unit being issued, per blood type, for requests received in range.
+func turnaroundReport(db *sql.DB, from string, to string, group string) (Report, error) {
+	rows, err := db.Query(`
+		SELECT bt.type, COUNT(*),
+			AVG((julianday(t.issued_at) - julianday(t.request_date)) * 24),
+			MAX((julianday(t.issued_at) - julianday(t.request_date)) * 24)
+		FROM (
+			SELECT r.id, r.recipient_id, r.request_date, MAX(i.issue_date) AS issued_at
+			FROM requests r
+			JOIN issues i ON i.request_id = r.id
+			WHERE r.deleted_at IS NULL AND r.status = 'Fulfilled'
+				AND substr(r.request_date, 1, 10) BETWEEN ? AND ?
+			GROUP BY r.id
+		) t
+		JOIN recipients rec ON rec.id = t.recipient_id
+		JOIN blood_types bt ON bt.id = rec.blood_type_id
+		GROUP BY bt.type
+		ORDER BY bt.type
+	`, from, to)
+	if err != nil {
+		return Report{}, err
+	}
+	defer rows.Close()
+
+	report := Report{
+		Title:   "Request Turnaround",
+		Note:    "Hours from a request being received to its units being issued, for fulfilled requests.",
+		Columns: []string{"Blood Type", "Fulfilled", "Average Hours", "Longest Hours"},
+	}
+	var count, total int
+	var weighted float64
+	for rows.Next() {
+		var bt string
+		var n int
+		var avg, longest sql.NullFloat64
+		if err := rows.Scan(&bt, &n, &avg, &longest); err != nil {
+			return Report{}, err
+		}
+		report.Rows = append(report.Rows, []string{bt, strconv.Itoa(n), formatHours(avg.Float64), formatHours(longest.Float64)})
+		count++
+		total += n
+		weighted += avg.Float64 * float64(n)
+	}
+	if err := rows.Err(); err != nil {
+		return Report{}, err
+	}
+	if count > 1 {
+		report.Rows = append(report.Rows, []string{"All", strconv.Itoa(total), formatHours(weighted / float64(total)), ""})
+	}
+	return report, nil
+}
+
+func formatHours(hours float64) string {
+	return strconv.FormatFloat(hours, 'f', 1, 64)
+}
+
+// stockReport rebuilds the units on hand per blood type at the close of
+// each day, or of each month when grouping by month or when the range has
+// more than maxStockCloses days. Units are counted from the donation
+// ledger by stockAt.
+func stockReport(db *sql.DB, from string, to string, group string) (Report, error) {
+	closes, err := closeDates(from, to, group)
+	if err != nil {
+		return Report{}, err
+	}
+	report := Report{
+		Title:   "Stock Position at Close",
+		Note:    "Units on hand at the end of each day; expired units are those on hand past their expiry date.",
+		Columns: append(append([]string{"Close"}, bloodTypes...), "Total", "Expired"),
+	}
+	if group == "month" || len(closes) > maxStockCloses {
+		report.Note = "Units on hand at the end of each month; expired units are those on hand past their expiry date."
+	}
+	for _, day := range closes {
+		t, err := parseDate(day)
+		if err != nil {
+			return Report{}, err
+		}
+		positions, err := stockAt(db, endOfDay(t))
+		if err != nil {
+			return Report{}, err
+		}
+		row := make([]string, len(report.Columns))
+		row[0] = day
+		units := map[string]int{}
+		var total, expired int
+		for _, p := range positions {
+			units[p.BloodType] += p.Units
+			total += p.Units
+			expired += p.Expired
+		}
+		for i, bt := range bloodTypes {
+			row[i+1] = strconv.Itoa(units[bt])
+		}
+		row[len(row)-2] = strconv.Itoa(total)
+		row[len(row)-1] = strconv.Itoa(expired)
+		report.Rows = append(report.Rows, row)
+	}
+	return report, nil
+}
+
+// closeDates lists each day of the range, or the last day of each month
+// (the end of the range for the current month).
+func closeDates(from string, to string, group string) ([]string, error) {
+	start, err := parseDate(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseDate(to)
+	if err != nil {
+		return nil, err
+	}
+	if today, _ := parseDate(todayDate()); end.After(today) {
+		end = today
+	}
+	var days []string
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		days = append(days, d.Format(dateLayout))
+	}
+	if group != "month" && len(days) <= maxStockCloses {
+		return days, nil
+	}
+	var months []string
+	for d := start; !d.After(end); d = time.Date(d.Year(), d.Month()+1, 1, 0, 0, 0, 0, d.Location()) {
+		last := time.Date(d.Year(), d.Month()+1, 0, 0, 0, 0, 0, d.Location())
+		if last.After(end) {
+			last = end
+		}
+		months = append(months, last.Format(dateLayout))
+	}
+	return months, nil
+}
+
+// hospitalsReport ranks hospitals by units requested in the range.
+func hospitalsReport(db *sql.DB, from string, to string, group string) (Report, error) {
+	rows, err := db.Query(`
+		SELECT COALESCE(NULLIF(rec.hospital, ''), 'Not recorded'), COUNT(*), SUM(r.units), SUM(COALESCE(r.issued_units, 0))
+		FROM requests r
+		JOIN recipients rec ON rec.id = r.recipient_id
+		WHERE (r.deleted_at IS NULL OR r.status = 'Cancelled')
+			AND substr(r.request_date, 1, 10) BETWEEN ? AND ?
+		GROUP BY 1
+		ORDER BY 3 DESC, 1
+		LIMIT 10
+	`, from, to)
+	if err != nil {
+		return Report{}, err
+	}
+	defer rows.Close()
+
+	report := Report{
+		Title:   "Top Hospitals by Demand",
+		Note:    "The ten hospitals requesting the most units.",
+		Columns: []string{"Hospital", "Requests", "Units Requested", "Units Issued"},
+	}
+	for rows.Next() {
+		row := make([]string, len(report.Columns))
+		if err := rows.Scan(&row[0], &row[1], &row[2], &row[3]); err != nil {
+			return Report{}, err
+		}
+		report.Rows = append(report.Rows, row)
+	}
+	return report, rows.Err()
+}
+
+// writeReportsCSV writes each report as a title line, its header and rows,
+// with a blank line between reports.
+func writeReportsCSV(w http.ResponseWriter, reports []Report) error {
+	cw := &csvExportWriter{csv.NewWriter(w)}
+	for i, report := range reports {
+		if i > 0 {
+			if err := cw.Write(nil); err != nil {
+				return err
+			}
+		}
+		if len(reports) > 1 {
+			if err := cw.Write([]string{report.Title}); err != nil {
+				return err
+			}
+		}
+		if err := cw.Write(report.Columns); err != nil {
+			return err
+		}
+		for _, row := range report.Rows {
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// reportsPDF lays the reports out as tables on A4 pages, starting a new
+// page when a table runs past the bottom margin.
+func reportsPDF(data ReportsData) *pdfDoc {
+	const (
+		pageWidth  = 210 * mm
+		pageHeight = 297 * mm
+		margin     = 15 * mm
+		lineHeight = 5 * mm
+	)
+	doc := newPDF(pageWidth, pageHeight)
+	doc.AddPage()
+	y := margin + 6
+	doc.Text(margin, y, 14, true, "Blood Bank Operational Report")
+	y += lineHeight
+	doc.Text(margin, y, 9, false, fmt.Sprintf("%s to %s, by %s. Printed %s.", data.From, data.To, data.Group, todayDate()))
+	y += 2 * lineHeight
+
+	newPage := func() {
+		doc.AddPage()
+		y = margin + 6
+	}
+	for _, report := range data.Reports {
+		if y+4*lineHeight > pageHeight-margin {
+			newPage()
+		}
+		doc.Text(margin, y, 11, true, report.Title)
+		y += lineHeight
+		doc.Text(margin, y, 8, false, report.Note)
+		y += lineHeight
+
+		width := (pageWidth - 2*margin) / float64(len(report.Columns))
+		size := 8.0
+		if len(report.Columns) > 8 {
+			size = 7
+		}
+		header := func() {
+			for i, col := range report.Columns {
+				doc.Text(margin+float64(i)*width, y, size, true, col)
+			}
+			doc.Line(margin, y+1.5*mm, pageWidth-margin, y+1.5*mm)
+			y += lineHeight
+		}
+		header()
+		for _, row := range report.Rows {
+			if y > pageHeight-margin {
+				newPage()
+				header()
+			}
+			for i, cell := range row {
+				doc.Text(margin+float64(i)*width, y, size, false, cell)
+			}
+			y += lineHeight
+		}
+		if len(report.Rows) == 0 {
+			doc.Text(margin, y, size, false, "No records in this range.")
+			y += lineHeight
+		}
+		y += lineHeight
+	}
+	return doc
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// coldChain is how long an issued unit may have been out of storage, and
+// the temperatures it must have been kept between, to go back into stock.
+type coldChain struct {
+	maxMinutesOut  int
+	minTemperature float64
+	maxTemperature float64
+}
+
+// returnLimits are the cold-chain limits for returns, by component name. Red
+// cells are kept cold, platelets at room temperature and plasma frozen; a
+// component without limits here is never restocked.
+var returnLimits = map[string]coldChain{
+	"Whole Blood":         {maxMinutesOut: 30, minTemperature: 1, maxTemperature: 10},
+	"Packed Red Cells":    {maxMinutesOut: 30, minTemperature: 1, maxTemperature: 10},
+	"Platelets":           {maxMinutesOut: 30, minTemperature: 20, maxTemperature: 24},
+	"Fresh Frozen Plasma": {maxMinutesOut: 30, minTemperature: -80, maxTemperature: -18},
+	"Cryoprecipitate":     {maxMinutesOut: 30, minTemperature: -80, maxTemperature: -18},
+}
+
+// IssuedUnit is the part of a fulfilled request that came from one donation.
+type IssuedUnit struct {
+	DonationID int
+	DIN        string
+	DonorName  string
+	Component  string
+	ExpiryDate string
+	Voided     bool
+	Issued     int
+	Returned   int
+}
+
+func (u IssuedUnit) Outstanding() int {
+	return u.Issued - u.Returned
+}
+
+type Return struct {
+	ID          int
+	RequestID   int
+	DonationID  int
+	Recipient   string
+	BloodType   string
+	Units       int
+	MinutesOut  int
+	Temperature float64
+	Outcome     string
+	Reason      string
+	ReturnDate  string
+}
+
+type ReturnsData struct {
+	Request *Request
+	Issued  []IssuedUnit
+	Returns []Return
+	Message string
+}
+
+func registerReturnRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/returns", func(w http.ResponseWriter, r *http.Request) {
+		requestID, _ := strconv.Atoi(r.FormValue("request_id"))
+
+		if r.Method == http.MethodGet {
+			renderReturns(w, tmpl, db, requestID, "")
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		donationID, _ := strconv.Atoi(r.FormValue("donation_id"))
+		// A scanned unit label takes the place of choosing the unit.
+		if din := strings.TrimSpace(r.FormValue("din")); din != "" {
+			id, problem, err := scanDonation(db, din)
+			if err != nil {
+				renderReturns(w, tmpl, db, requestID, "Could not record return.")
+				return
+			}
+			if problem != "" {
+				renderReturns(w, tmpl, db, requestID, problem)
+				return
+			}
+			donationID = id
+		}
+		units, _ := strconv.Atoi(r.FormValue("units"))
+		minutesOut, errMinutes := strconv.Atoi(strings.TrimSpace(r.FormValue("minutes_out")))
+		temperature, errTemp := strconv.ParseFloat(strings.TrimSpace(r.FormValue("temperature")), 64)
+		sealIntact := r.FormValue("seal_intact") == "on"
+		staff := strings.TrimSpace(r.FormValue("staff"))
+		if requestID == 0 || donationID == 0 || units <= 0 || errMinutes != nil || minutesOut < 0 || errTemp != nil || staff == "" {
+			renderReturns(w, tmpl, db, requestID, "Return requires unit, units, time out of storage, temperature, and staff name.")
+			return
+		}
+
+		issued, err := loadIssuedUnits(db, requestID)
+		if err != nil {
+			renderReturns(w, tmpl, db, requestID, "Request not found.")
+			return
+		}
+		var unit *IssuedUnit
+		for i := range issued {
+			if issued[i].DonationID == donationID {
+				unit = &issued[i]
+			}
+		}
+		if unit == nil {
+			renderReturns(w, tmpl, db, requestID, "That unit was not issued to this request.")
+			return
+		}
+		if units > unit.Outstanding() {
+			renderReturns(w, tmpl, db, requestID, fmt.Sprintf("Only %d units from this donation are still out.", unit.Outstanding()))
+			return
+		}
+
+		discardReason, detail := assessReturn(unit.Component, minutesOut, temperature, sealIntact, unit.ExpiryDate, unit.Voided)
+		problem, err := recordReturn(db, requestID, donationID, units, minutesOut, temperature, discardReason, detail, staff)
+		if err != nil {
+			renderReturns(w, tmpl, db, requestID, "Could not record return.")
+			return
+		}
+		if problem != "" {
+			renderReturns(w, tmpl, db, requestID, problem)
+			return
+		}
+		if discardReason != "" {
+			renderReturns(w, tmpl, db, requestID, "Return recorded and discarded: "+detail+".")
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/returns?request_id=%d", requestID), http.StatusSeeOther)
+	})
+}
+
+func renderReturns(w http.ResponseWriter, tmpl *template.Template, db *sql.DB, requestID int, msg string) {
+	data := ReturnsData{Message: msg}
+	if requestID != 0 {
+		req, err := loadRequest(db, requestID)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if err == nil {
+			data.Request = &req
+			if data.Issued, err = loadIssuedUnits(db, requestID); err != nil {
+				http.Error(w, "server error", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	returns, err := loadReturns(db, requestID)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	data.Returns = returns
+	if err := tmpl.ExecuteTemplate(w, "returns.html", data); err != nil {
+		log.Println("template error:", err)
+	}
+}
+
+// assessReturn decides whether returned units can go back on the shelf. It
+// returns the discard reason, empty when the units can be restocked, and a
+// human-readable detail. Units of a voided donation are never restocked.
+func assessReturn(component string, minutesOut int, temperature float64, sealIntact bool, expiryDate string, voided bool) (string, string) {
+	limits, known := returnLimits[component]
+	switch {
+	case voided:
+		return "Voided", "donation voided"
+	case !sealIntact:
+		return "Broken bag", "bag seal not intact"
+	case expiryDate < todayDate():
+		return "Expired", "unit expired"
+	case !known:
+		return "Cold-chain breach", "no return limits for " + component
+	case minutesOut > limits.maxMinutesOut:
+		return "Cold-chain breach", fmt.Sprintf("out of storage for more than %d minutes", limits.maxMinutesOut)
+	case temperature < limits.minTemperature || temperature > limits.maxTemperature:
+		return "Cold-chain breach", fmt.Sprintf("temperature outside %.0f to %.0f °C for %s", limits.minTemperature, limits.maxTemperature, component)
+	}
+	return "", ""
+}
+
+// recordReturn logs returned units against the request. Units that pass the
+// cold-chain check go back on the donation and into inventory; the rest are
+// recorded as wastage. A non-empty problem explains why the units cannot be
+// returned and nothing was changed.
+func recordReturn(db *sql.DB, requestID int, donationID int, units int, minutesOut int, temperature float64, discardReason string, detail string, staff string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	outcome := "Restocked"
+	if discardReason != "" {
+		outcome = "Discarded"
+	}
+	_, err = tx.Exec(`
+		INSERT INTO returns (request_id, donation_id, units, minutes_out, temperature, outcome, reason, return_date)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, requestID, donationID, units, minutesOut, temperature, outcome, detail, nowTimestamp())
+	if err != nil {
+		return "", err
+	}
+	// The units still out are counted after the return is written, so a
+	// return of the same units made at the same time waits for this
+	// transaction and then sees it.
+	var issued, returned int
+	err = tx.QueryRow(`
+		SELECT
+			(SELECT COALESCE(SUM(units), 0) FROM issues WHERE request_id = ? AND donation_id = ?),
+			(SELECT COALESCE(SUM(units), 0) FROM returns WHERE request_id = ? AND donation_id = ?)
+	`, requestID, donationID, requestID, donationID).Scan(&issued, &returned)
+	if err != nil {
+		return "", err
+	}
+	if issued == 0 {
+		return "That unit was not issued to this request.", nil
+	}
+	if returned > issued {
+		return fmt.Sprintf("Only %d units from this donation are still out.", issued-(returned-units)), nil
+	}
+	if _, err := tx.Exec("UPDATE requests SET issued_units = issued_units - ? WHERE id = ?", units, requestID); err != nil {
+		return "", err
+	}
+
+	if discardReason != "" {
+		if err := recordDiscard(tx, donationID, units, discardReason, staff); err != nil {
+			return "", err
+		}
+	} else {
+		var bloodTypeID int
+		err := tx.QueryRow(`
+			SELECT donors.blood_type_id
+			FROM donations d
+			JOIN donors ON donors.id = d.donor_id
+			WHERE d.id = ?
+		`, donationID).Scan(&bloodTypeID)
+		if err != nil {
+			return "", err
+		}
+		// The donation may have been voided since the return was assessed;
+		// its units must not come back into stock.
+		res, err := tx.Exec("UPDATE donations SET remaining_units = remaining_units + ? WHERE id = ? AND deleted_at IS NULL", units, donationID)
+		if err != nil {
+			return "", err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return "", err
+		} else if n == 0 {
+			return "That donation has been voided; record the return again to discard the units.", nil
+		}
+		if err := upsertInventoryByTypeID(tx, bloodTypeID, units); err != nil {
+			return "", err
+		}
+	}
+	return "", tx.Commit()
+}
+
+func loadRequest(db *sql.DB, requestID int) (Request, error) {
+	var r Request
+	err := db.QueryRow(`
+		SELECT r.id, r.recipient_id, recipients.name, bt.type, r.units, COALESCE(r.issued_units, 0), r.status, r.request_date
+		FROM requests r
+		JOIN recipients ON recipients.id = r.recipient_id
+		JOIN blood_types bt ON bt.id = recipients.blood_type_id
+		WHERE r.id = ? AND r.deleted_at IS NULL
+	`, requestID).Scan(&r.ID, &r.RecipientID, &r.Recipient, &r.BloodType, &r.Units, &r.IssuedUnits, &r.Status, &r.RequestDate)
+	return r, err
+}
+
+func loadIssuedUnits(db *sql.DB, requestID int) ([]IssuedUnit, error) {
+	rows, err := db.Query(`
+		SELECT d.id, COALESCE(d.din, ''), donors.name, c.name, d.expiry_date, d.deleted_at IS NOT NULL, SUM(i.units),
+			COALESCE((SELECT SUM(rt.units) FROM returns rt WHERE rt.request_id = i.request_id AND rt.donation_id = d.id), 0)
+		FROM issues i
+		JOIN donations d ON d.id = i.donation_id
+		JOIN donors ON donors.id = d.donor_id
+		JOIN components c ON c.id = d.component_id
+		WHERE i.request_id = ?
+		GROUP BY d.id
+		ORDER BY d.id
+	`, requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var issued []IssuedUnit
+	for rows.Next() {
+		var u IssuedUnit
+		if err := rows.Scan(&u.DonationID, &u.DIN, &u.DonorName, &u.Component, &u.ExpiryDate, &u.Voided, &u.Issued, &u.Returned); err != nil {
+			return nil, err
+		}
+		issued = append(issued, u)
+	}
+	return issued, rows.Err()
+}
+
+// loadReturns lists returns for one request, or the most recent returns
+// across all requests when requestID is zero.
+func loadReturns(db *sql.DB, requestID int) ([]Return, error) {
+	rows, err := db.Query(`
+		SELECT rt.id, rt.request_id, rt.donation_id, recipients.name, bt.type, rt.units,
+			rt.minutes_out, rt.temperature, rt.outcome, COALESCE(rt.reason, ''), rt.return_date
+		FROM returns rt
+		JOIN requests r ON r.id = rt.request_id
+		JOIN recipients ON recipients.id = r.recipient_id
+		JOIN blood_types bt ON bt.id = recipients.blood_type_id
+		WHERE ? = 0 OR rt.request_id = ?
+		ORDER BY rt.id DESC
+		LIMIT 50
+	`, requestID, requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var returns []Return
+	for rows.Next() {
+		var rt Return
+		if err := rows.Scan(&rt.ID, &rt.RequestID, &rt.DonationID, &rt.Recipient, &rt.BloodType, &rt.Units,
+			&rt.MinutesOut, &rt.Temperature, &rt.Outcome, &rt.Reason, &rt.ReturnDate); err != nil {
+			return nil, err
+		}
+		returns = append(returns, rt)
+	}
+	return returns, rows.Err()
+}
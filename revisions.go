@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DonationRevision records a void, correction or restore of a donation,
+// keeping the values it had before the change.
+type DonationRevision struct {
+	ID         int
+	DonationID int
+	Action     string
+	OldUnits   int
+	NewUnits   int
+	OldExpiry  string
+	NewExpiry  string
+	Reason     string
+	RevisedAt  string
+}
+
+func registerRevisionRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/donations/void", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		reason := strings.TrimSpace(r.FormValue("reason"))
+		if id == 0 || reason == "" {
+			renderDonation(w, tmpl, db, id, Form{}, "Voiding a donation requires a reason.")
+			return
+		}
+		err := voidDonation(db, id, reason)
+		if err == sql.ErrNoRows {
+			renderDonation(w, tmpl, db, id, Form{}, "Donation not found.")
+			return
+		}
+		if err != nil {
+			renderDonation(w, tmpl, db, id, Form{}, "Could not void donation.")
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/donations/%d", id), http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/donations/correct", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		in, form := correctionForm(r)
+		errs, err := in.Validate(db, id)
+		if err != nil {
+			renderDonation(w, tmpl, db, id, form, "Could not correct donation.")
+			return
+		}
+		form.Merge(errs)
+		if !form.Valid() {
+			renderDonation(w, tmpl, db, id, form, "Please correct the highlighted fields.")
+			return
+		}
+		used, err := correctDonation(db, id, in.Units, in.ExpiryDate, in.Reason)
+		if err == sql.ErrNoRows {
+			renderDonation(w, tmpl, db, id, form, "Donation not found.")
+			return
+		}
+		if err != nil {
+			renderDonation(w, tmpl, db, id, form, "Could not correct donation.")
+			return
+		}
+		if used > in.Units {
+			form.Errors.add("units", fmt.Sprintf("%d units of this donation were already issued or discarded.", used))
+			renderDonation(w, tmpl, db, id, form, "Please correct the highlighted fields.")
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/donations/%d", id), http.StatusSeeOther)
+	})
+}
+
+// voidDonation cancels a donation recorded in error. Only the units still in
+// stock from that donation are taken back out of inventory; units already
+// issued or discarded stay on record so they remain traceable.
+func voidDonation(db *sql.DB, id int, reason string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := voidDonationTx(tx, id, reason); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func voidDonationTx(tx *sql.Tx, id int, reason string) error {
+	var units, remaining, bloodTypeID int
+	var expiry string
+	err := tx.QueryRow(`
+		SELECT d.units, COALESCE(d.remaining_units, 0), d.expiry_date, donors.blood_type_id
+		FROM donations d
+		JOIN donors ON donors.id = d.donor_id
+		WHERE d.id = ? AND d.deleted_at IS NULL
+	`, id).Scan(&units, &remaining, &expiry, &bloodTypeID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE donations SET deleted_at = ?, remaining_units = 0 WHERE id = ?", nowTimestamp(), id); err != nil {
+		return err
+	}
+	if err := removeInventoryByTypeID(tx, bloodTypeID, remaining); err != nil {
+		return err
+	}
+	return recordRevision(tx, id, "Void", units, units, expiry, expiry, reason)
+}
+
+// correctDonation changes the units or expiry of a donation and moves the
+// difference in units into or out of inventory. It returns how many units
+// have already left stock; if that exceeds the new units nothing is changed.
+func correctDonation(db *sql.DB, id int, units int, expiry string, reason string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var oldUnits, remaining, bloodTypeID int
+	var oldExpiry string
+	err = tx.QueryRow(`
+		SELECT d.units, COALESCE(d.remaining_units, 0), d.expiry_date, donors.blood_type_id
+		FROM donations d
+		JOIN donors ON donors.id = d.donor_id
+		WHERE d.id = ? AND d.deleted_at IS NULL
+	`, id).Scan(&oldUnits, &remaining, &oldExpiry, &bloodTypeID)
+	if err != nil {
+		return 0, err
+	}
+	used := oldUnits - remaining
+	if used > units {
+		return used, nil
+	}
+
+	delta := units - oldUnits
+	if _, err := tx.Exec(
+		"UPDATE donations SET units = ?, remaining_units = ?, expiry_date = ? WHERE id = ?",
+		units, remaining+delta, expiry, id,
+	); err != nil {
+		return used, err
+	}
+	if delta > 0 {
+		err = upsertInventoryByTypeID(tx, bloodTypeID, delta)
+	} else if delta < 0 {
+		err = removeInventoryByTypeID(tx, bloodTypeID, -delta)
+	}
+	if err != nil {
+		return used, err
+	}
+	if err := recordRevision(tx, id, "Correct", oldUnits, units, oldExpiry, expiry, reason); err != nil {
+		return used, err
+	}
+	return used, tx.Commit()
+}
+
+func recordRevision(db querier, donationID int, action string, oldUnits int, newUnits int, oldExpiry string, newExpiry string, reason string) error {
+	_, err := db.Exec(`
+		INSERT INTO donation_revisions (donation_id, action, old_units, new_units, old_expiry_date, new_expiry_date, reason, revised_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, donationID, action, oldUnits, newUnits, oldExpiry, newExpiry, reason, nowTimestamp())
+	return err
+}
+
+func loadDonationRevisions(db *sql.DB, donationID int) ([]DonationRevision, error) {
+	rows, err := db.Query(`
+		SELECT id, donation_id, action, old_units, new_units, old_expiry_date, new_expiry_date, reason, revised_at
+		FROM donation_revisions
+		WHERE donation_id = ?
+		ORDER BY id
+	`, donationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []DonationRevision
+	for rows.Next() {
+		var rev DonationRevision
+		if err := rows.Scan(&rev.ID, &rev.DonationID, &rev.Action, &rev.OldUnits, &rev.NewUnits,
+			&rev.OldExpiry, &rev.NewExpiry, &rev.Reason, &rev.RevisedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// snapshotBackfillDays is how far back the first run records closes.
+	snapshotBackfillDays = 90
+	// chartDays is the default span of the stock chart.
+	chartDays = 90
+)
+
+// chartColors are the line colors of the blood types, in bloodTypes order.
+var chartColors = []string{"#e8452e", "#ff9f1c", "#2de2e6", "#3a86ff", "#8338ec", "#ff006e", "#48c774", "#f6f4ef"}
+
+// StockPosition is the stock of one blood type and component at a moment.
+// Expired counts units on hand past their expiry date.
+type StockPosition struct {
+	BloodTypeID int    `json:"-"`
+	BloodType   string `json:"blood_type"`
+	ComponentID int    `json:"-"`
+	Component   string `json:"component"`
+	Units       int    `json:"units"`
+	Expired     int    `json:"expired_units"`
+}
+
+type StockHistoryData struct {
+	At        string
+	Positions []StockPosition
+	Total     int
+	From      string
+	To        string
+	Chart     template.HTML
+	Snapshots int
+	Message   string
+}
+
+func registerSnapshotRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/inventory/history", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		renderStockHistory(w, tmpl, db, r, "")
+	})
+
+	mux.HandleFunc("/inventory/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		n, err := takeSnapshots(db, time.Now())
+		if err != nil {
+			renderStockHistory(w, tmpl, db, r, "Could not record snapshots.")
+			return
+		}
+		renderStockHistory(w, tmpl, db, r, fmt.Sprintf("Recorded %d day closes.", n))
+	})
+
+	mux.HandleFunc("/api/inventory/history", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		at, ok := parseMoment(r.FormValue("at"))
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "at must be a date or a date and time")
+			return
+		}
+		positions, err := stockAt(db, at)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "server error")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"at": at.Format(time.RFC3339), "stock": positions})
+	})
+}
+
+func renderStockHistory(w http.ResponseWriter, tmpl *template.Template, db *sql.DB, r *http.Request, msg string) {
+	data := StockHistoryData{
+		From:    validDate(strings.TrimSpace(r.FormValue("from"))),
+		To:      validDate(strings.TrimSpace(r.FormValue("to"))),
+		Message: msg,
+	}
+	if data.To == "" {
+		data.To = todayDate()
+	}
+	if data.From == "" {
+		to, _ := parseDate(data.To)
+		data.From = to.AddDate(0, 0, -chartDays).Format(dateLayout)
+	}
+
+	at, ok := parseMoment(r.FormValue("at"))
+	if !ok && data.Message == "" {
+		data.Message = "Enter a date, or a date and time, to look back to."
+	}
+	if ok {
+		data.At = at.Format("2006-01-02T15:04")
+		var err error
+		if data.Positions, err = stockAt(db, at); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		for _, p := range data.Positions {
+			data.Total += p.Units
+		}
+	}
+
+	series, days, err := loadSnapshotSeries(db, data.From, data.To)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	data.Snapshots = len(days)
+	data.Chart = stockChartSVG(series, days)
+	renderPage(w, tmpl, "stock_history.html", data)
+}
+
+// parseMoment reads a date, taken as the end of that day, or a date and
+// time from a datetime-local input. An empty value is now.
+func parseMoment(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Now(), true
+	}
+	if t, err := parseDate(value); err == nil {
+		return endOfDay(t), true
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func endOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 23, 59, 59, 0, t.Location())
+}
+
+// stockAt rebuilds stock at a past moment from the donation ledger: units
+// collected by that day, less those issued, plus those returned and less
+// those discarded by that moment. Donations deleted later still count.
+// Records purged from the trash are gone from the ledger, which is why
+// closes are also kept as snapshots. Timestamps are compared as instants,
+// since they may be stored with different offsets.
+func stockAt(db querier, at time.Time) ([]StockPosition, error) {
+	moment := at.Format(time.RFC3339)
+	day := at.Format(dateLayout)
+	rows, err := db.Query(`
+		SELECT s.blood_type_id, bt.type, COALESCE(s.component_id, 0), COALESCE(c.name, ''),
+			SUM(s.units), SUM(CASE WHEN s.expiry_date < ? THEN s.units ELSE 0 END)
+		FROM (
+			SELECT donors.blood_type_id, d.component_id, d.expiry_date,
+				d.units - d.units_out_at_import
+				- COALESCE((SELECT SUM(units) FROM issues WHERE donation_id = d.id AND datetime(issue_date) <= datetime(?)), 0)
+				+ COALESCE((SELECT SUM(units) FROM returns WHERE donation_id = d.id AND datetime(return_date) <= datetime(?)), 0)
+				- COALESCE((SELECT SUM(units) FROM discards WHERE donation_id = d.id AND datetime(discard_date) <= datetime(?)), 0)
+				AS units
+			FROM donations d
+			JOIN donors ON donors.id = d.donor_id
+			WHERE d.donation_date <= ? AND (d.deleted_at IS NULL OR datetime(d.deleted_at) > datetime(?))
+		) s
+		JOIN blood_types bt ON bt.id = s.blood_type_id
+		LEFT JOIN components c ON c.id = s.component_id
+		WHERE s.units > 0
+		GROUP BY s.blood_type_id, s.component_id
+		ORDER BY bt.type, c.id
+	`, day, moment, moment, moment, day, moment)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var positions []StockPosition
+	for rows.Next() {
+		var p StockPosition
+		if err := rows.Scan(&p.BloodTypeID, &p.BloodType, &p.ComponentID, &p.Component, &p.Units, &p.Expired); err != nil {
+			return nil, err
+		}
+		positions = append(positions, p)
+	}
+	return positions, rows.Err()
+}
+
+// takeSnapshots records the close of each day since the last snapshot, up
+// to yesterday, and returns how many days were recorded. Each day has a
+// total row per blood type, with no component, and a row per component in
+// stock.
+func takeSnapshots(db *sql.DB, now time.Time) (int, error) {
+	today, err := parseDate(now.Format(dateLayout))
+	if err != nil {
+		return 0, err
+	}
+	start := today.AddDate(0, 0, -snapshotBackfillDays)
+	var last sql.NullString
+	if err := db.QueryRow("SELECT MAX(snapshot_date) FROM inventory_snapshots").Scan(&last); err != nil {
+		return 0, err
+	}
+	if last.Valid {
+		t, err := parseDate(last.String)
+		if err != nil {
+			return 0, err
+		}
+		start = t.AddDate(0, 0, 1)
+	}
+
+	n := 0
+	for day := start; day.Before(today); day = day.AddDate(0, 0, 1) {
+		if err := takeSnapshot(db, day); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func takeSnapshot(db *sql.DB, day time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	positions, err := stockAt(tx, endOfDay(day))
+	if err != nil {
+		return err
+	}
+	date := day.Format(dateLayout)
+	takenAt := nowTimestamp()
+	totals := map[string][2]int{}
+	for _, p := range positions {
+		t := totals[p.BloodType]
+		totals[p.BloodType] = [2]int{t[0] + p.Units, t[1] + p.Expired}
+		if _, err := tx.Exec(`
+			INSERT OR REPLACE INTO inventory_snapshots (snapshot_date, blood_type_id, component_id, units, expired_units, taken_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, date, p.BloodTypeID, nullIfZero(p.ComponentID), p.Units, p.Expired, takenAt); err != nil {
+			return err
+		}
+	}
+	for _, bt := range bloodTypes {
+		if _, err := tx.Exec(`
+			INSERT OR REPLACE INTO inventory_snapshots (snapshot_date, blood_type_id, component_id, units, expired_units, taken_at)
+			SELECT ?, id, NULL, ?, ?, ? FROM blood_types WHERE type = ?
+		`, date, totals[bt][0], totals[bt][1], takenAt, bt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// loadSnapshotSeries returns the units on hand of each blood type per
+// snapshot day in the range, and the days.
+func loadSnapshotSeries(db *sql.DB, from string, to string) (map[string][]int, []string, error) {
+	rows, err := db.Query(`
+		SELECT s.snapshot_date, bt.type, s.units
+		FROM inventory_snapshots s
+		JOIN blood_types bt ON bt.id = s.blood_type_id
+		WHERE s.component_id IS NULL AND s.snapshot_date BETWEEN ? AND ?
+		ORDER BY s.snapshot_date
+	`, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	series := map[string][]int{}
+	var days []string
+	for rows.Next() {
+		var day, bt string
+		var units int
+		if err := rows.Scan(&day, &bt, &units); err != nil {
+			return nil, nil, err
+		}
+		if len(days) == 0 || days[len(days)-1] != day {
+			days = append(days, day)
+			for _, t := range bloodTypes {
+				series[t] = append(series[t], 0)
+			}
+		}
+		if s, ok := series[bt]; ok {
+			s[len(s)-1] = units
+		}
+	}
+	return series, days, rows.Err()
+}
+
+// stockChartSVG draws a line per blood type over the snapshot days, with
+// the first and last day and the highest count marked on the axes.
+func stockChartSVG(series map[string][]int, days []string) template.HTML {
+	if len(days) == 0 {
+		return ""
+	}
+	const width, height, left, bottom, top, right = 720, 260, 40, 24, 10, 90
+	peak := 1
+	for _, s := range series {
+		for _, v := range s {
+			peak = max(peak, v)
+		}
+	}
+	x := func(i int) float64 {
+		if len(days) == 1 {
+			return left
+		}
+		return left + float64(i)*float64(width-left-right)/float64(len(days)-1)
+	}
+	y := func(v int) float64 {
+		return top + float64(height-top-bottom)*(1-float64(v)/float64(peak))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg class="chart" xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" role="img" aria-label="Units in stock per blood type">`, width, height)
+	fmt.Fprintf(&b, `<path d="M%d %d V%d H%d" fill="none" stroke="#b7bcc5" stroke-width="1"/>`, left, top, height-bottom, width-right)
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end" font-size="11" fill="#b7bcc5">%d</text>`, left-4, top+4, peak)
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end" font-size="11" fill="#b7bcc5">0</text>`, left-4, height-bottom)
+	fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="11" fill="#b7bcc5">%s</text>`, left, height-6, days[0])
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end" font-size="11" fill="#b7bcc5">%s</text>`, width-right, height-6, days[len(days)-1])
+	for i, bt := range bloodTypes {
+		var path strings.Builder
+		for j, v := range series[bt] {
+			cmd := "L"
+			if j == 0 {
+				cmd = "M"
+			}
+			fmt.Fprintf(&path, "%s%.1f %.1f", cmd, x(j), y(v))
+		}
+		color := chartColors[i%len(chartColors)]
+		fmt.Fprintf(&b, `<path d="%s" fill="none" stroke="%s" stroke-width="2"/>`, path.String(), color)
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="12" fill="%s">%s</text>`, width-right+10, top+12+i*16, color, template.HTMLEscapeString(bt))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// runSnapshotJob records day closes at startup and then every hour, so a
+// close is taken soon after midnight and days the server was down are
+// filled in.
+func runSnapshotJob(db *sql.DB) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if n, err := takeSnapshots(db, time.Now()); err != nil {
+			log.Println("snapshot error:", err)
+		} else if n > 0 {
+			log.Printf("recorded inventory snapshots for %d days", n)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+// Stock statuses against a level: below the minimum is low and alerts
+// staff; between the minimum and the target only shows on the inventory
+// page.
+const (
+	stockNotSet      = "Not set"
+	stockLow         = "Low"
+	stockBelowTarget = "Below target"
+	stockOK          = "OK"
+)
+
+// StockLevel is the minimum and target stock of a blood type, or of one
+// component of it. Units counts unexpired units left in stock, so expiries
+// lower it without any unit being issued or discarded.
+type StockLevel struct {
+	ID           int    `json:"id"`
+	BloodTypeID  int    `json:"-"`
+	BloodType    string `json:"blood_type"`
+	ComponentID  int    `json:"component_id,omitempty"`
+	Component    string `json:"component,omitempty"`
+	MinimumUnits int    `json:"minimum_units"`
+	TargetUnits  int    `json:"target_units"`
+	Units        int    `json:"units"`
+	AlertedAt    string `json:"alerted_at,omitempty"`
+}
+
+func (l StockLevel) Status() string {
+	switch {
+	case l.ID == 0:
+		return stockNotSet
+	case l.Units < l.MinimumUnits:
+		return stockLow
+	case l.Units < l.TargetUnits:
+		return stockBelowTarget
+	}
+	return stockOK
+}
+
+// StatusClass is the CSS class that colors a level's row.
+func (l StockLevel) StatusClass() string {
+	switch l.Status() {
+	case stockLow:
+		return "stock-low"
+	case stockBelowTarget:
+		return "stock-short"
+	case stockOK:
+		return "stock-ok"
+	}
+	return ""
+}
+
+// Name is the blood type, followed by the component for component levels.
+func (l StockLevel) Name() string {
+	if l.Component == "" {
+		return l.BloodType
+	}
+	return l.BloodType + " " + l.Component
+}
+
+// InventoryRow is a blood type's inventory with its stock level.
+type InventoryRow struct {
+	Inventory
+	Level StockLevel
+}
+
+const stockLevelColumns = `
+	SELECT l.id, l.blood_type_id, bt.type, COALESCE(l.component_id, 0), COALESCE(c.name, ''),
+		l.minimum_units, l.target_units, COALESCE(l.alerted_at, ''),
+		(SELECT COALESCE(SUM(d.remaining_units), 0)
+			FROM donations d
+			JOIN donors ON donors.id = d.donor_id
+			WHERE donors.blood_type_id = l.blood_type_id
+				AND (l.component_id IS NULL OR d.component_id = l.component_id)
+				AND d.deleted_at IS NULL AND d.remaining_units > 0 AND d.expiry_date >= ?)
+	FROM stock_levels l
+	JOIN blood_types bt ON bt.id = l.blood_type_id
+	LEFT JOIN components c ON c.id = l.component_id
+`
+
+func registerStockLevelRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/inventory/levels", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		in, form := stockLevelForm(r)
+		errs, err := in.Validate(db)
+		if err != nil {
+			renderInventory(w, tmpl, db, form, "Could not save stock level.")
+			return
+		}
+		form.Merge(errs)
+		if !form.Valid() {
+			renderInventory(w, tmpl, db, form, "Please correct the highlighted fields.")
+			return
+		}
+		if err := saveStockLevel(db, in); err != nil {
+			renderInventory(w, tmpl, db, form, "Could not save stock level.")
+			return
+		}
+		http.Redirect(w, r, "/inventory", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/inventory/levels/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		if _, err := db.Exec("DELETE FROM stock_levels WHERE id = ?", id); err != nil {
+			renderInventory(w, tmpl, db, Form{}, "Could not remove stock level.")
+			return
+		}
+		http.Redirect(w, r, "/inventory", http.StatusSeeOther)
+	})
+}
+
+// loadStockLevels returns the levels of one blood type, or of all blood
+// types when bloodTypeID is 0, with the units now in stock.
+func loadStockLevels(db querier, bloodTypeID int) ([]StockLevel, error) {
+	rows, err := db.Query(stockLevelColumns+`
+		WHERE ? = 0 OR l.blood_type_id = ?
+		ORDER BY bt.type, l.component_id IS NOT NULL, c.id
+	`, todayDate(), bloodTypeID, bloodTypeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var levels []StockLevel
+	for rows.Next() {
+		var l StockLevel
+		if err := rows.Scan(&l.ID, &l.BloodTypeID, &l.BloodType, &l.ComponentID, &l.Component,
+			&l.MinimumUnits, &l.TargetUnits, &l.AlertedAt, &l.Units); err != nil {
+			return nil, err
+		}
+		levels = append(levels, l)
+	}
+	return levels, rows.Err()
+}
+
+// loadInventoryRows lists every blood type with its inventory and its
+// whole-type stock level, and returns the component levels separately.
+func loadInventoryRows(db *sql.DB) ([]InventoryRow, []StockLevel, error) {
+	inventory, err := loadInventory(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	levels, err := loadStockLevels(db, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	usable, err := usableUnitsByType(db)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows := make([]InventoryRow, len(bloodTypes))
+	for i, bt := range bloodTypes {
+		rows[i] = InventoryRow{Inventory: Inventory{BloodType: bt}, Level: StockLevel{BloodType: bt, Units: usable[bt]}}
+		for _, inv := range inventory {
+			if inv.BloodType == bt {
+				rows[i].Units = inv.Units
+			}
+		}
+	}
+	var componentLevels []StockLevel
+	for _, l := range levels {
+		if l.ComponentID != 0 {
+			componentLevels = append(componentLevels, l)
+			continue
+		}
+		for i := range rows {
+			if rows[i].BloodType == l.BloodType {
+				rows[i].Level = l
+			}
+		}
+	}
+	return rows, componentLevels, nil
+}
+
+// usableUnitsByType counts the unexpired units in stock of each blood type.
+func usableUnitsByType(db *sql.DB) (map[string]int, error) {
+	rows, err := db.Query(`
+		SELECT bt.type, SUM(d.remaining_units)
+		FROM donations d
+		JOIN donors ON donors.id = d.donor_id
+		JOIN blood_types bt ON bt.id = donors.blood_type_id
+		WHERE d.deleted_at IS NULL AND d.remaining_units > 0 AND d.expiry_date >= ?
+		GROUP BY bt.type
+	`, todayDate())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usable := map[string]int{}
+	for rows.Next() {
+		var bt string
+		var units int
+		if err := rows.Scan(&bt, &units); err != nil {
+			return nil, err
+		}
+		usable[bt] = units
+	}
+	return usable, rows.Err()
+}
+
+// saveStockLevel sets a level, replacing any level already set for the
+// blood type and component, and checks it against the current stock.
+func saveStockLevel(db *sql.DB, in StockLevelInput) error {
+	bloodTypeID, err := getOrCreateBloodTypeID(db, in.BloodType)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"UPDATE stock_levels SET minimum_units = ?, target_units = ? WHERE blood_type_id = ? AND component_id IS ?",
+		in.MinimumUnits, in.TargetUnits, bloodTypeID, nullIfZero(in.ComponentID),
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		if _, err := tx.Exec(
+			"INSERT INTO stock_levels (blood_type_id, component_id, minimum_units, target_units) VALUES (?, ?, ?, ?)",
+			bloodTypeID, nullIfZero(in.ComponentID), in.MinimumUnits, in.TargetUnits,
+		); err != nil {
+			return err
+		}
+	}
+	if err := checkStockLevels(tx, bloodTypeID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkStockLevels alerts staff once when a level's stock falls below its
+// minimum, and rearms the alert when stock is back at the minimum. It runs
+// whenever inventory changes and daily, which catches units expiring.
+// bloodTypeID 0 checks every blood type.
+func checkStockLevels(db querier, bloodTypeID int) error {
+	levels, err := loadStockLevels(db, bloodTypeID)
+	if err != nil {
+		return err
+	}
+	for _, l := range levels {
+		low := l.Units < l.MinimumUnits
+		switch {
+		case low && l.AlertedAt == "":
+			now := nowTimestamp()
+			key := fmt.Sprintf("low_stock:%d:%s", l.ID, now)
+			data := map[string]any{"BloodType": l.Name(), "Units": l.Units, "Threshold": l.MinimumUnits}
+			if err := notifyStaff(db, "low_stock", key, data); err != nil {
+				return err
+			}
+			if _, err := db.Exec("UPDATE stock_levels SET alerted_at = ? WHERE id = ?", now, l.ID); err != nil {
+				return err
+			}
+		case !low && l.AlertedAt != "":
+			if _, err := db.Exec("UPDATE stock_levels SET alerted_at = NULL WHERE id = ?", l.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
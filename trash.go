@@ -0,0 +1,326 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// trashRetentionDays is how long soft-deleted records stay restorable before
+// the purge job removes them for good.
+const trashRetentionDays = 90
+
+var trashEntities = []string{"donors", "recipients", "donations", "requests", "inventory"}
+
+// trashQueries list the soft-deleted rows of each entity with a one-line
+// summary for display.
+var trashQueries = map[string]string{
+	"donors": `
+		SELECT d.id, d.name || ' (' || bt.type || ')', d.deleted_at
+		FROM donors d
+		JOIN blood_types bt ON bt.id = d.blood_type_id
+		WHERE d.deleted_at IS NOT NULL
+		ORDER BY d.deleted_at DESC, d.id DESC`,
+	"recipients": `
+		SELECT r.id, r.name || ' (' || bt.type || ')', r.deleted_at
+		FROM recipients r
+		JOIN blood_types bt ON bt.id = r.blood_type_id
+		WHERE r.deleted_at IS NOT NULL
+		ORDER BY r.deleted_at DESC, r.id DESC`,
+	"donations": `
+		SELECT d.id, donors.name || ' · ' || d.units || ' units · ' || d.donation_date, d.deleted_at
+		FROM donations d
+		JOIN donors ON donors.id = d.donor_id
+		WHERE d.deleted_at IS NOT NULL
+		ORDER BY d.deleted_at DESC, d.id DESC`,
+	"requests": `
+		SELECT r.id, recipients.name || ' · ' || r.units || ' units · ' || r.request_date, r.deleted_at
+		FROM requests r
+		JOIN recipients ON recipients.id = r.recipient_id
+		WHERE r.deleted_at IS NOT NULL
+		ORDER BY r.deleted_at DESC, r.id DESC`,
+	"inventory": `
+		SELECT i.id, bt.type || ' · ' || i.units || ' units', i.deleted_at
+		FROM inventory i
+		JOIN blood_types bt ON bt.id = i.blood_type_id
+		WHERE i.deleted_at IS NOT NULL
+		ORDER BY i.deleted_at DESC, i.id DESC`,
+}
+
+type TrashItem struct {
+	ID        int
+	Summary   string
+	DeletedAt string
+}
+
+type TrashData struct {
+	Entity        string
+	Entities      []string
+	Items         []TrashItem
+	RetentionDays int
+	Message       string
+}
+
+// PurgeResult counts the rows removed by a purge, per entity.
+type PurgeResult map[string]int64
+
+func registerTrashRoutes(mux *http.ServeMux, tmpl *template.Template, db *sql.DB) {
+	mux.HandleFunc("/trash", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		renderTrash(w, tmpl, db, r.FormValue("entity"), "")
+	})
+
+	mux.HandleFunc("/trash/restore", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		entity := r.FormValue("entity")
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		if _, ok := trashQueries[entity]; !ok || id == 0 {
+			renderTrash(w, tmpl, db, entity, "Choose a record to restore.")
+			return
+		}
+		problem, err := restoreRecord(db, entity, id)
+		if err != nil {
+			renderTrash(w, tmpl, db, entity, "Could not restore record.")
+			return
+		}
+		if problem != "" {
+			renderTrash(w, tmpl, db, entity, problem)
+			return
+		}
+		http.Redirect(w, r, "/trash?entity="+entity, http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/trash/purge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		entity := r.FormValue("entity")
+		result, err := purgeTrash(db, time.Now().AddDate(0, 0, -trashRetentionDays))
+		if err != nil {
+			renderTrash(w, tmpl, db, entity, "Could not purge deleted records.")
+			return
+		}
+		renderTrash(w, tmpl, db, entity, fmt.Sprintf("Purged %d records deleted more than %d days ago.", result.Total(), trashRetentionDays))
+	})
+}
+
+func renderTrash(w http.ResponseWriter, tmpl *template.Template, db *sql.DB, entity string, msg string) {
+	query, ok := trashQueries[entity]
+	if !ok {
+		entity = trashEntities[0]
+		query = trashQueries[entity]
+	}
+	data := TrashData{Entity: entity, Entities: trashEntities, RetentionDays: trashRetentionDays, Message: msg}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item TrashItem
+		if err := rows.Scan(&item.ID, &item.Summary, &item.DeletedAt); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		data.Items = append(data.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, "trash.html", data); err != nil {
+		log.Println("template error:", err)
+	}
+}
+
+// restoreRecord brings a soft-deleted record back. A non-empty problem means
+// a dependency is itself deleted and nothing was changed.
+func restoreRecord(db *sql.DB, entity string, id int) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	switch entity {
+	case "donors":
+		var mergedInto sql.NullInt64
+		if err := tx.QueryRow("SELECT merged_into FROM donors WHERE id = ?", id).Scan(&mergedInto); err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+		if mergedInto.Valid {
+			return fmt.Sprintf("Donor was merged into donor #%d and cannot be restored.", mergedInto.Int64), nil
+		}
+		_, err = tx.Exec("UPDATE donors SET deleted_at = NULL WHERE id = ?", id)
+	case "recipients", "inventory":
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET deleted_at = NULL WHERE id = ?", entity), id)
+	case "donations":
+		var parentDeleted bool
+		err = tx.QueryRow(`
+			SELECT donors.deleted_at IS NOT NULL
+			FROM donations d
+			JOIN donors ON donors.id = d.donor_id
+			WHERE d.id = ? AND d.deleted_at IS NOT NULL
+		`, id).Scan(&parentDeleted)
+		if err == sql.ErrNoRows {
+			return "Donation is not in the trash.", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if parentDeleted {
+			return "Restore the donor before restoring their donation.", nil
+		}
+		err = restoreDonation(tx, id)
+	case "requests":
+		var parentDeleted bool
+		err = tx.QueryRow(`
+			SELECT recipients.deleted_at IS NOT NULL
+			FROM requests r
+			JOIN recipients ON recipients.id = r.recipient_id
+			WHERE r.id = ? AND r.deleted_at IS NOT NULL
+		`, id).Scan(&parentDeleted)
+		if err == sql.ErrNoRows {
+			return "Request is not in the trash.", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if parentDeleted {
+			return "Restore the recipient before restoring their request.", nil
+		}
+		_, err = tx.Exec("UPDATE requests SET status = 'Pending', deleted_at = NULL WHERE id = ?", id)
+	}
+	if err != nil {
+		return "", err
+	}
+	return "", tx.Commit()
+}
+
+// restoreDonation puts a voided donation back and re-adds whatever part of
+// it had not already left stock before it was voided.
+func restoreDonation(tx *sql.Tx, id int) error {
+	var units, stock, bloodTypeID int
+	var expiry string
+	err := tx.QueryRow(`
+		SELECT d.units, d.expiry_date, donors.blood_type_id,
+			d.units - d.units_out_at_import
+			- COALESCE((SELECT SUM(units) FROM issues WHERE donation_id = d.id), 0)
+			+ COALESCE((SELECT SUM(units) FROM returns WHERE donation_id = d.id), 0)
+			- COALESCE((SELECT SUM(units) FROM discards WHERE donation_id = d.id), 0)
+		FROM donations d
+		JOIN donors ON donors.id = d.donor_id
+		WHERE d.id = ?
+	`, id).Scan(&units, &expiry, &bloodTypeID, &stock)
+	if err != nil {
+		return err
+	}
+	stock = max(stock, 0)
+	if _, err := tx.Exec("UPDATE donations SET deleted_at = NULL, remaining_units = ? WHERE id = ?", stock, id); err != nil {
+		return err
+	}
+	if stock > 0 {
+		if err := upsertInventoryByTypeID(tx, bloodTypeID, stock); err != nil {
+			return err
+		}
+	}
+	return recordRevision(tx, id, "Restore", units, units, expiry, expiry, "Restored from trash")
+}
+
+// purgeTrash permanently deletes records soft-deleted before cutoff. Rows
+// still referenced by other records, such as donations with issued units
+// that look-back depends on, are kept.
+func purgeTrash(db *sql.DB, cutoff time.Time) (PurgeResult, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	before := cutoff.Format(time.RFC3339)
+	purgeableDonations := `
+		SELECT id FROM donations
+		WHERE deleted_at IS NOT NULL AND datetime(deleted_at) < datetime(?)
+			AND id NOT IN (SELECT donation_id FROM issues)
+			AND id NOT IN (SELECT donation_id FROM returns)
+			AND id NOT IN (SELECT donation_id FROM discards)`
+	purgeableDonors := `
+		SELECT id FROM donors
+		WHERE deleted_at IS NOT NULL AND datetime(deleted_at) < datetime(?)
+			AND id NOT IN (SELECT donor_id FROM donations)
+			AND id NOT IN (SELECT merged_into FROM donors WHERE merged_into IS NOT NULL)`
+	steps := []struct {
+		entity string
+		query  string
+	}{
+		{"requests", `
+			DELETE FROM requests
+			WHERE deleted_at IS NOT NULL AND datetime(deleted_at) < datetime(?)
+				AND id NOT IN (SELECT request_id FROM issues)
+				AND id NOT IN (SELECT request_id FROM returns)`},
+		{"", "DELETE FROM donation_revisions WHERE donation_id IN (" + purgeableDonations + ")"},
+		{"", "UPDATE appointments SET donation_id = NULL WHERE donation_id IN (" + purgeableDonations + ")"},
+		{"donations", "DELETE FROM donations WHERE id IN (" + purgeableDonations + ")"},
+		{"", "DELETE FROM deferrals WHERE donor_id IN (" + purgeableDonors + ")"},
+		{"", "DELETE FROM camp_donors WHERE donor_id IN (" + purgeableDonors + ")"},
+		{"", "DELETE FROM appointments WHERE donor_id IN (" + purgeableDonors + ")"},
+		{"", "DELETE FROM recall_contacts WHERE donor_id IN (" + purgeableDonors + ")"},
+		{"donors", "DELETE FROM donors WHERE id IN (" + purgeableDonors + ")"},
+		{"recipients", `
+			DELETE FROM recipients
+			WHERE deleted_at IS NOT NULL AND datetime(deleted_at) < datetime(?)
+				AND id NOT IN (SELECT recipient_id FROM requests)`},
+		{"inventory", "DELETE FROM inventory WHERE deleted_at IS NOT NULL AND datetime(deleted_at) < datetime(?)"},
+	}
+
+	result := PurgeResult{}
+	for _, step := range steps {
+		res, err := tx.Exec(step.query, before)
+		if err != nil {
+			return nil, err
+		}
+		if step.entity == "" {
+			continue
+		}
+		if result[step.entity], err = res.RowsAffected(); err != nil {
+			return nil, err
+		}
+	}
+	return result, tx.Commit()
+}
+
+func (p PurgeResult) Total() int64 {
+	var total int64
+	for _, n := range p {
+		total += n
+	}
+	return total
+}
+
+// runPurgeJob purges expired trash at startup and then once a day.
+func runPurgeJob(db *sql.DB) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for {
+		result, err := purgeTrash(db, time.Now().AddDate(0, 0, -trashRetentionDays))
+		if err != nil {
+			log.Println("purge error:", err)
+		} else if result.Total() > 0 {
+			log.Printf("purged deleted records: %v", map[string]int64(result))
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,753 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bloodTypes are the ABO/Rh groups accepted for donors and recipients.
+var bloodTypes = []string{"A+", "A-", "B+", "B-", "AB+", "AB-", "O+", "O-"}
+
+var requestStatuses = []string{"Pending", "Fulfilled", "Cancelled"}
+
+// FieldErrors maps a form field name to what is wrong with it. Only the
+// first problem found for each field is kept.
+type FieldErrors map[string]string
+
+func (e FieldErrors) add(field string, msg string) {
+	if _, ok := e[field]; !ok {
+		e[field] = msg
+	}
+}
+
+// Form keeps submitted values and their errors so a page can be rendered
+// again with the input in place and each error next to its field.
+type Form struct {
+	Values map[string]string
+	Errors FieldErrors
+}
+
+func newForm(values map[string]string) Form {
+	if values == nil {
+		values = map[string]string{}
+	}
+	return Form{Values: values, Errors: FieldErrors{}}
+}
+
+// readForm collects the named fields from a submitted form, trimmed.
+func readForm(r *http.Request, fields ...string) Form {
+	f := newForm(nil)
+	for _, name := range fields {
+		f.Values[name] = strings.TrimSpace(r.FormValue(name))
+	}
+	return f
+}
+
+func (f Form) Get(name string) string {
+	return f.Values[name]
+}
+
+func (f Form) Error(name string) string {
+	return f.Errors[name]
+}
+
+func (f Form) Valid() bool {
+	return len(f.Errors) == 0
+}
+
+// Int parses a whole-number field. A value that is present but not a number
+// is recorded as an error; a blank one is left to the validator.
+func (f Form) Int(name string) int {
+	value := f.Values[name]
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		f.Errors.add(name, "Enter a whole number.")
+	}
+	return n
+}
+
+// Merge adds errors from a validator without replacing ones already found
+// while reading the form.
+func (f Form) Merge(errs FieldErrors) {
+	for field, msg := range errs {
+		f.Errors.add(field, msg)
+	}
+}
+
+type DonorInput struct {
+	Name        string `json:"name"`
+	BloodType   string `json:"blood_type"`
+	Phone       string `json:"phone"`
+	City        string `json:"city"`
+	Email       string `json:"email"`
+	DateOfBirth string `json:"date_of_birth"`
+	// AllowDuplicate registers the donor even when it looks like one that
+	// already exists.
+	AllowDuplicate bool `json:"allow_duplicate"`
+}
+
+type RecipientInput struct {
+	Name      string `json:"name"`
+	BloodType string `json:"blood_type"`
+	Phone     string `json:"phone"`
+	Hospital  string `json:"hospital"`
+}
+
+type DonationInput struct {
+	DonorID     int    `json:"donor_id"`
+	DonorNumber string `json:"donor_number"`
+	CampID      int    `json:"camp_id"`
+	// AppointmentID links the donation to the checked-in appointment it
+	// was given at.
+	AppointmentID int    `json:"appointment_id"`
+	ComponentID   int    `json:"component_id"`
+	Units         int    `json:"units"`
+	DonationDate  string `json:"donation_date"`
+	ExpiryDate    string `json:"expiry_date"`
+}
+
+type RequestInput struct {
+	RecipientID int `json:"recipient_id"`
+	Units       int `json:"units"`
+}
+
+type RequestUpdateInput struct {
+	Units  int    `json:"units"`
+	Status string `json:"status"`
+}
+
+type CampInput struct {
+	Name        string `json:"name"`
+	Location    string `json:"location"`
+	CampDate    string `json:"camp_date"`
+	Organizer   string `json:"organizer"`
+	TargetUnits int    `json:"target_units"`
+}
+
+type DeferralInput struct {
+	DonorID       int    `json:"donor_id"`
+	CampID        int    `json:"camp_id"`
+	Reason        string `json:"reason"`
+	DeferredUntil string `json:"deferred_until"`
+	Permanent     bool   `json:"permanent"`
+}
+
+// SlotInput describes a day's appointment slots at one site: the hours are
+// cut into slots of SlotMinutes, each taking up to Capacity donors.
+type SlotInput struct {
+	Site        string `json:"site"`
+	SlotDate    string `json:"slot_date"`
+	StartTime   string `json:"start_time"`
+	EndTime     string `json:"end_time"`
+	SlotMinutes int    `json:"slot_minutes"`
+	Capacity    int    `json:"capacity"`
+}
+
+type AppointmentInput struct {
+	DonorID     int    `json:"donor_id"`
+	DonorNumber string `json:"donor_number"`
+	SlotID      int    `json:"slot_id"`
+}
+
+// RecallInput starts a recall campaign to bring the stock of a blood type
+// up to TargetUnits.
+type RecallInput struct {
+	BloodType         string `json:"blood_type"`
+	TargetUnits       int    `json:"target_units"`
+	City              string `json:"city"`
+	IncludeCompatible bool   `json:"include_compatible"`
+	Message           string `json:"message"`
+}
+
+// StockLevelInput sets the minimum and target stock of a blood type, or of
+// one component of it when ComponentID is set.
+type StockLevelInput struct {
+	BloodType    string `json:"blood_type"`
+	ComponentID  int    `json:"component_id"`
+	MinimumUnits int    `json:"minimum_units"`
+	TargetUnits  int    `json:"target_units"`
+}
+
+type CorrectionInput struct {
+	Units      int    `json:"units"`
+	ExpiryDate string `json:"expiry_date"`
+	Reason     string `json:"reason"`
+}
+
+func donorForm(r *http.Request) (DonorInput, Form) {
+	f := readForm(r, "name", "blood_type", "phone", "city", "email", "date_of_birth", "allow_duplicate")
+	in := DonorInput{
+		Name:           f.Get("name"),
+		BloodType:      f.Get("blood_type"),
+		Phone:          f.Get("phone"),
+		City:           f.Get("city"),
+		Email:          f.Get("email"),
+		DateOfBirth:    f.Get("date_of_birth"),
+		AllowDuplicate: f.Get("allow_duplicate") != "",
+	}
+	return in, f
+}
+
+func recipientForm(r *http.Request) (RecipientInput, Form) {
+	f := readForm(r, "name", "blood_type", "phone", "hospital")
+	in := RecipientInput{Name: f.Get("name"), BloodType: f.Get("blood_type"), Phone: f.Get("phone"), Hospital: f.Get("hospital")}
+	return in, f
+}
+
+func donationForm(r *http.Request) (DonationInput, Form) {
+	f := readForm(r, "donor_number", "donor_id", "camp_id", "appointment_id", "component_id", "units", "donation_date", "expiry_date")
+	in := DonationInput{
+		DonorID:       f.Int("donor_id"),
+		DonorNumber:   f.Get("donor_number"),
+		CampID:        f.Int("camp_id"),
+		AppointmentID: f.Int("appointment_id"),
+		ComponentID:   f.Int("component_id"),
+		Units:         f.Int("units"),
+		DonationDate:  f.Get("donation_date"),
+		ExpiryDate:    f.Get("expiry_date"),
+	}
+	return in, f
+}
+
+func requestForm(r *http.Request) (RequestInput, Form) {
+	f := readForm(r, "recipient_id", "units")
+	in := RequestInput{RecipientID: f.Int("recipient_id"), Units: f.Int("units")}
+	return in, f
+}
+
+func requestUpdateForm(r *http.Request) (RequestUpdateInput, Form) {
+	f := readForm(r, "units", "status")
+	in := RequestUpdateInput{Units: f.Int("units"), Status: f.Get("status")}
+	return in, f
+}
+
+func campForm(r *http.Request) (CampInput, Form) {
+	f := readForm(r, "name", "location", "camp_date", "organizer", "target_units")
+	in := CampInput{
+		Name:        f.Get("name"),
+		Location:    f.Get("location"),
+		CampDate:    f.Get("camp_date"),
+		Organizer:   f.Get("organizer"),
+		TargetUnits: f.Int("target_units"),
+	}
+	return in, f
+}
+
+func deferralForm(r *http.Request) (DeferralInput, Form) {
+	f := readForm(r, "donor_id", "camp_id", "reason", "deferred_until", "permanent")
+	in := DeferralInput{
+		DonorID:       f.Int("donor_id"),
+		CampID:        f.Int("camp_id"),
+		Reason:        f.Get("reason"),
+		DeferredUntil: f.Get("deferred_until"),
+		Permanent:     f.Get("permanent") != "",
+	}
+	return in, f
+}
+
+func slotForm(r *http.Request) (SlotInput, Form) {
+	f := readForm(r, "site", "slot_date", "start_time", "end_time", "slot_minutes", "capacity")
+	in := SlotInput{
+		Site:        f.Get("site"),
+		SlotDate:    f.Get("slot_date"),
+		StartTime:   f.Get("start_time"),
+		EndTime:     f.Get("end_time"),
+		SlotMinutes: f.Int("slot_minutes"),
+		Capacity:    f.Int("capacity"),
+	}
+	return in, f
+}
+
+func appointmentForm(r *http.Request) (AppointmentInput, Form) {
+	f := readForm(r, "donor_number", "donor_id", "slot_id")
+	in := AppointmentInput{DonorID: f.Int("donor_id"), DonorNumber: f.Get("donor_number"), SlotID: f.Int("slot_id")}
+	return in, f
+}
+
+func recallForm(r *http.Request) (RecallInput, Form) {
+	f := readForm(r, "blood_type", "target_units", "city", "include_compatible", "message")
+	in := RecallInput{
+		BloodType:         f.Get("blood_type"),
+		TargetUnits:       f.Int("target_units"),
+		City:              f.Get("city"),
+		IncludeCompatible: f.Get("include_compatible") != "",
+		Message:           f.Get("message"),
+	}
+	return in, f
+}
+
+func stockLevelForm(r *http.Request) (StockLevelInput, Form) {
+	f := readForm(r, "blood_type", "component_id", "minimum_units", "target_units")
+	in := StockLevelInput{
+		BloodType:    f.Get("blood_type"),
+		ComponentID:  f.Int("component_id"),
+		MinimumUnits: f.Int("minimum_units"),
+		TargetUnits:  f.Int("target_units"),
+	}
+	return in, f
+}
+
+func correctionForm(r *http.Request) (CorrectionInput, Form) {
+	f := readForm(r, "units", "expiry_date", "reason")
+	in := CorrectionInput{Units: f.Int("units"), ExpiryDate: f.Get("expiry_date"), Reason: f.Get("reason")}
+	return in, f
+}
+
+func (in *DonorInput) Validate() FieldErrors {
+	errs := FieldErrors{}
+	in.Name = strings.TrimSpace(in.Name)
+	in.BloodType = normalizeBloodType(in.BloodType)
+	in.City = strings.TrimSpace(in.City)
+	requireText(errs, "name", in.Name)
+	checkBloodType(errs, "blood_type", in.BloodType)
+	in.Phone = checkPhone(errs, "phone", in.Phone)
+	in.Email = checkEmail(errs, "email", in.Email)
+	in.DateOfBirth = strings.TrimSpace(in.DateOfBirth)
+	if in.DateOfBirth != "" {
+		if dob, ok := checkDate(errs, "date_of_birth", in.DateOfBirth); ok {
+			if dob.After(time.Now()) || dob.Before(time.Now().AddDate(-120, 0, 0)) {
+				errs.add("date_of_birth", "Enter a real date of birth.")
+			}
+		}
+	}
+	return errs
+}
+
+func (in *RecipientInput) Validate() FieldErrors {
+	errs := FieldErrors{}
+	in.Name = strings.TrimSpace(in.Name)
+	in.BloodType = normalizeBloodType(in.BloodType)
+	in.Hospital = strings.TrimSpace(in.Hospital)
+	requireText(errs, "name", in.Name)
+	checkBloodType(errs, "blood_type", in.BloodType)
+	in.Phone = checkPhone(errs, "phone", in.Phone)
+	return errs
+}
+
+func (in *DonationInput) Validate(db *sql.DB) (FieldErrors, error) {
+	errs := FieldErrors{}
+	var err error
+	if in.DonorID, in.DonorNumber, err = checkDonor(db, errs, in.DonorID, in.DonorNumber); err != nil {
+		return nil, err
+	}
+	if in.AppointmentID != 0 {
+		var donorID int
+		var status string
+		err := db.QueryRow("SELECT donor_id, status FROM appointments WHERE id = ?", in.AppointmentID).Scan(&donorID, &status)
+		if err == sql.ErrNoRows {
+			errs.add("appointment_id", "Appointment not found.")
+		} else if err != nil {
+			return nil, err
+		} else if status != appointmentCheckedIn {
+			errs.add("appointment_id", "Check the donor in before recording their donation.")
+		} else if in.DonorID != 0 && in.DonorID != donorID {
+			errs.add("donor_id", "This is not the donor who was checked in.")
+		}
+	}
+	if in.CampID != 0 {
+		var campDate string
+		err := db.QueryRow("SELECT camp_date FROM camps WHERE id = ?", in.CampID).Scan(&campDate)
+		if err == sql.ErrNoRows {
+			errs.add("camp_id", "Camp not found.")
+		} else if err != nil {
+			return nil, err
+		} else if strings.TrimSpace(in.DonationDate) == "" {
+			// Donations entered for a camp default to the camp's date.
+			in.DonationDate = campDate
+		}
+	}
+	shelfLife := 0
+	if in.ComponentID == 0 {
+		errs.add("component_id", "Choose a component.")
+	} else if err := db.QueryRow("SELECT shelf_life_days FROM components WHERE id = ?", in.ComponentID).Scan(&shelfLife); err == sql.ErrNoRows {
+		errs.add("component_id", "Component not found.")
+	} else if err != nil {
+		return nil, err
+	}
+	checkUnits(errs, "units", in.Units)
+
+	// The donation date defaults to today and cannot be in the future.
+	in.DonationDate = strings.TrimSpace(in.DonationDate)
+	if in.DonationDate == "" {
+		in.DonationDate = todayDate()
+	}
+	in.ExpiryDate = strings.TrimSpace(in.ExpiryDate)
+	donated, donatedOK := checkDate(errs, "donation_date", in.DonationDate)
+	expiry, expiryOK := checkDate(errs, "expiry_date", in.ExpiryDate)
+	today, _ := parseDate(todayDate())
+	if donatedOK && donated.After(today) {
+		errs.add("donation_date", "Donation date cannot be in the future.")
+	}
+	if expiryOK && expiry.Before(today) {
+		errs.add("expiry_date", "Expiry date is already past.")
+	}
+	if donatedOK && expiryOK && shelfLife > 0 {
+		checkExpiry(errs, "expiry_date", donated, expiry, shelfLife)
+	}
+	if in.DonorID != 0 && donatedOK {
+		deferral, err := activeDeferral(db, in.DonorID, in.DonationDate)
+		if err != nil {
+			return nil, err
+		}
+		if deferral != nil {
+			field := "donor_id"
+			if in.DonorNumber != "" {
+				field = "donor_number"
+			}
+			errs.add(field, "Donor is deferred "+deferral.Period()+": "+deferral.Reason+".")
+		}
+	}
+	return errs, nil
+}
+
+func (in *CampInput) Validate() FieldErrors {
+	errs := FieldErrors{}
+	in.Name = strings.TrimSpace(in.Name)
+	in.Location = strings.TrimSpace(in.Location)
+	in.Organizer = strings.TrimSpace(in.Organizer)
+	in.CampDate = strings.TrimSpace(in.CampDate)
+	requireText(errs, "name", in.Name)
+	requireText(errs, "location", in.Location)
+	checkDate(errs, "camp_date", in.CampDate)
+	if in.TargetUnits < 0 {
+		errs.add("target_units", "Target cannot be negative.")
+	}
+	return errs
+}
+
+func (in *DeferralInput) Validate(db *sql.DB) (FieldErrors, error) {
+	errs := FieldErrors{}
+	if in.DonorID == 0 {
+		errs.add("donor_id", "Choose a donor.")
+	} else if ok, err := exists(db, "SELECT 1 FROM donors WHERE id = ? AND deleted_at IS NULL", in.DonorID); err != nil {
+		return nil, err
+	} else if !ok {
+		errs.add("donor_id", "Donor not found.")
+	}
+	if in.CampID != 0 {
+		if ok, err := exists(db, "SELECT 1 FROM camps WHERE id = ?", in.CampID); err != nil {
+			return nil, err
+		} else if !ok {
+			errs.add("camp_id", "Camp not found.")
+		}
+	}
+	in.Reason = strings.TrimSpace(in.Reason)
+	requireText(errs, "reason", in.Reason)
+	in.DeferredUntil = strings.TrimSpace(in.DeferredUntil)
+	if in.Permanent {
+		in.DeferredUntil = ""
+	} else if until, ok := checkDate(errs, "deferred_until", in.DeferredUntil); ok {
+		if today, _ := parseDate(todayDate()); !until.After(today) {
+			errs.add("deferred_until", "Deferral must end after today.")
+		}
+	}
+	return errs, nil
+}
+
+func (in *SlotInput) Validate() FieldErrors {
+	errs := FieldErrors{}
+	in.Site = strings.TrimSpace(in.Site)
+	requireText(errs, "site", in.Site)
+	if date, ok := checkDate(errs, "slot_date", in.SlotDate); ok {
+		if today, _ := parseDate(todayDate()); date.Before(today) {
+			errs.add("slot_date", "Slots cannot be added for a past day.")
+		}
+	}
+	start, startOK := checkClock(errs, "start_time", in.StartTime)
+	end, endOK := checkClock(errs, "end_time", in.EndTime)
+	if startOK && endOK && !end.After(start) {
+		errs.add("end_time", "End time must be after the start time.")
+	}
+	if in.SlotMinutes < 5 || in.SlotMinutes > 480 {
+		errs.add("slot_minutes", "Use a slot length between 5 and 480 minutes.")
+	}
+	if in.Capacity < 1 {
+		errs.add("capacity", "Allow at least 1 donor per slot.")
+	}
+	return errs
+}
+
+// Validate checks that the slot can take the donor, and that the donor may
+// give blood on the slot's day: they must not be deferred or still inside
+// the minimum interval since their last donation.
+func (in *AppointmentInput) Validate(db *sql.DB) (FieldErrors, error) {
+	errs := FieldErrors{}
+	var err error
+	if in.DonorID, in.DonorNumber, err = checkDonor(db, errs, in.DonorID, in.DonorNumber); err != nil {
+		return nil, err
+	}
+	donorField := "donor_id"
+	if in.DonorNumber != "" {
+		donorField = "donor_number"
+	}
+
+	var slotDate string
+	var capacity, booked int
+	if in.SlotID == 0 {
+		errs.add("slot_id", "Choose a slot.")
+	} else if err := db.QueryRow(`
+		SELECT s.slot_date, s.capacity,
+			(SELECT COUNT(*) FROM appointments a WHERE a.slot_id = s.id AND a.status IN (?, ?, ?))
+		FROM appointment_slots s
+		WHERE s.id = ?
+	`, appointmentBooked, appointmentCheckedIn, appointmentDonated, in.SlotID).Scan(&slotDate, &capacity, &booked); err == sql.ErrNoRows {
+		errs.add("slot_id", "Slot not found.")
+	} else if err != nil {
+		return nil, err
+	} else if slotDate < todayDate() {
+		errs.add("slot_id", "This slot has already passed.")
+	} else if booked >= capacity {
+		errs.add("slot_id", "This slot is full.")
+	}
+	if len(errs) > 0 {
+		return errs, nil
+	}
+
+	if ok, err := exists(db, `
+		SELECT 1 FROM appointments a
+		JOIN appointment_slots s ON s.id = a.slot_id
+		WHERE a.donor_id = ? AND s.slot_date = ? AND a.status IN (?, ?)
+	`, in.DonorID, slotDate, appointmentBooked, appointmentCheckedIn); err != nil {
+		return nil, err
+	} else if ok {
+		errs.add(donorField, "Donor already has an appointment that day.")
+	}
+	problem, err := donorEligibility(db, in.DonorID, slotDate)
+	if err != nil {
+		return nil, err
+	}
+	if problem != "" {
+		errs.add(donorField, problem)
+	}
+	return errs, nil
+}
+
+// Validate checks the campaign and returns the current stock of the blood
+// type, which must be below the target.
+func (in *RecallInput) Validate(db *sql.DB) (FieldErrors, int, error) {
+	errs := FieldErrors{}
+	in.BloodType = normalizeBloodType(in.BloodType)
+	in.City = strings.TrimSpace(in.City)
+	in.Message = strings.TrimSpace(in.Message)
+	checkBloodType(errs, "blood_type", in.BloodType)
+	requireText(errs, "message", in.Message)
+	if in.TargetUnits < 1 {
+		errs.add("target_units", "Enter at least 1 unit.")
+	}
+	if len(errs) > 0 {
+		return errs, 0, nil
+	}
+	stock, err := stockOf(db, in.BloodType)
+	if err != nil {
+		return nil, 0, err
+	}
+	if stock >= in.TargetUnits {
+		errs.add("target_units", fmt.Sprintf("%s stock is already %d units.", in.BloodType, stock))
+	}
+	return errs, stock, nil
+}
+
+// Validate checks the blood type, the component if given, and the levels.
+func (in *StockLevelInput) Validate(db *sql.DB) (FieldErrors, error) {
+	errs := FieldErrors{}
+	in.BloodType = normalizeBloodType(in.BloodType)
+	checkBloodType(errs, "blood_type", in.BloodType)
+	if in.MinimumUnits < 0 {
+		errs.add("minimum_units", "Enter 0 or more units.")
+	}
+	if in.TargetUnits < 1 {
+		errs.add("target_units", "Enter at least 1 unit.")
+	} else if in.TargetUnits < in.MinimumUnits {
+		errs.add("target_units", "The target cannot be below the minimum.")
+	}
+	if in.ComponentID != 0 {
+		ok, err := exists(db, "SELECT 1 FROM components WHERE id = ?", in.ComponentID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			errs.add("component_id", "Choose a component.")
+		}
+	}
+	return errs, nil
+}
+
+func (in *RequestInput) Validate(db *sql.DB) (FieldErrors, error) {
+	errs := FieldErrors{}
+	if in.RecipientID == 0 {
+		errs.add("recipient_id", "Choose a recipient.")
+	} else if ok, err := exists(db, "SELECT 1 FROM recipients WHERE id = ? AND deleted_at IS NULL", in.RecipientID); err != nil {
+		return nil, err
+	} else if !ok {
+		errs.add("recipient_id", "Recipient not found.")
+	}
+	checkUnits(errs, "units", in.Units)
+	return errs, nil
+}
+
+func (in *RequestUpdateInput) Validate() FieldErrors {
+	errs := FieldErrors{}
+	checkUnits(errs, "units", in.Units)
+	in.Status = strings.TrimSpace(in.Status)
+	if in.Status == "" {
+		errs.add("status", "Choose a status.")
+	} else if !slices.Contains(requestStatuses, in.Status) {
+		errs.add("status", "Status must be Pending, Fulfilled or Cancelled.")
+	}
+	return errs
+}
+
+// Validate checks a correction against the donation it changes, whose
+// donation date and component bound the new expiry.
+func (in *CorrectionInput) Validate(db *sql.DB, donationID int) (FieldErrors, error) {
+	errs := FieldErrors{}
+	in.ExpiryDate = strings.TrimSpace(in.ExpiryDate)
+	in.Reason = strings.TrimSpace(in.Reason)
+	checkUnits(errs, "units", in.Units)
+	expiry, expiryOK := checkDate(errs, "expiry_date", in.ExpiryDate)
+	requireText(errs, "reason", in.Reason)
+	if !expiryOK {
+		return errs, nil
+	}
+
+	var donationDate string
+	var shelfLife int
+	err := db.QueryRow(`
+		SELECT d.donation_date, c.shelf_life_days
+		FROM donations d
+		JOIN components c ON c.id = d.component_id
+		WHERE d.id = ?
+	`, donationID).Scan(&donationDate, &shelfLife)
+	if err == sql.ErrNoRows {
+		return errs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if donated, err := parseDate(donationDate); err == nil {
+		checkExpiry(errs, "expiry_date", donated, expiry, shelfLife)
+	}
+	return errs, nil
+}
+
+// checkDonor resolves a scanned or typed donor number, which takes the place
+// of choosing a donor, and returns the donor's id and canonical number.
+func checkDonor(db *sql.DB, errs FieldErrors, id int, number string) (int, string, error) {
+	number = strings.TrimSpace(number)
+	if number != "" {
+		canonical, err := parseDonorNumber(number)
+		if err != nil {
+			errs.add("donor_number", "Donor number is not valid; check it and scan or type it again.")
+			return id, number, nil
+		}
+		found, err := findDonorByNumber(db, canonical)
+		if err != nil {
+			return 0, "", err
+		}
+		if found == 0 {
+			errs.add("donor_number", "No donor has this number.")
+		}
+		return found, canonical, nil
+	}
+	if id == 0 {
+		errs.add("donor_id", "Choose a donor or enter a donor number.")
+	} else if ok, err := exists(db, "SELECT 1 FROM donors WHERE id = ? AND deleted_at IS NULL", id); err != nil {
+		return 0, "", err
+	} else if !ok {
+		errs.add("donor_id", "Donor not found.")
+	}
+	return id, "", nil
+}
+
+func requireText(errs FieldErrors, field string, value string) {
+	if value == "" {
+		errs.add(field, "This field is required.")
+	}
+}
+
+func checkBloodType(errs FieldErrors, field string, value string) {
+	if value == "" {
+		errs.add(field, "This field is required.")
+	} else if !slices.Contains(bloodTypes, value) {
+		errs.add(field, "Use one of "+strings.Join(bloodTypes, ", ")+".")
+	}
+}
+
+// checkPhone returns an optional phone number in E.164 form.
+func checkPhone(errs FieldErrors, field string, value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+	phone, err := normalizePhone(value)
+	if err != nil {
+		errs.add(field, "Enter a valid phone number, e.g. +91 98765 43210.")
+		return value
+	}
+	return phone
+}
+
+// checkEmail returns an optional email address, lower-cased.
+func checkEmail(errs FieldErrors, field string, value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+	email, err := normalizeEmail(value)
+	if err != nil {
+		errs.add(field, "Enter a valid email address.")
+		return value
+	}
+	return email
+}
+
+func checkUnits(errs FieldErrors, field string, units int) {
+	if units <= 0 {
+		errs.add(field, "Enter at least 1 unit.")
+	}
+}
+
+// checkDate requires a YYYY-MM-DD date and returns it parsed.
+func checkDate(errs FieldErrors, field string, value string) (time.Time, bool) {
+	if value == "" {
+		errs.add(field, "This field is required.")
+		return time.Time{}, false
+	}
+	t, err := parseDate(value)
+	if err != nil {
+		errs.add(field, "Use a real date in the format YYYY-MM-DD.")
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// checkClock requires a 24-hour HH:MM time of day and returns it parsed.
+func checkClock(errs FieldErrors, field string, value string) (time.Time, bool) {
+	if value == "" {
+		errs.add(field, "This field is required.")
+		return time.Time{}, false
+	}
+	t, err := time.Parse(clockLayout, value)
+	if err != nil {
+		errs.add(field, "Use a time in the format HH:MM.")
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func exists(db *sql.DB, query string, args ...any) (bool, error) {
+	var one int
+	err := db.QueryRow(query, args...).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}